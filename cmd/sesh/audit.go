@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// auditLogger is a domain.LogService that writes a JSON object per line, so that what operators did can be collected
+// with the rest of the logs
+type auditLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newAuditLogger(out io.Writer) *auditLogger {
+	return &auditLogger{out: out}
+}
+
+func (l *auditLogger) write(level string, message string, err error, fields domain.LogFields) {
+	entry := map[string]string{}
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339)
+	entry["level"] = level
+	entry["message"] = message
+	if err != nil {
+		entry["error"] = err.Error()
+	}
+
+	line, encodeErr := json.Marshal(entry)
+	if encodeErr != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+func (l *auditLogger) Info(message string, fields domain.LogFields) {
+	l.write("info", message, nil, fields)
+}
+
+func (l *auditLogger) WarnError(message string, err error, fields domain.LogFields) {
+	l.write("warn", message, err, fields)
+}
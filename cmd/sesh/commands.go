@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/dbstore"
+	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/seshadmin"
+)
+
+// writeJSON writes v as indented JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeSessions writes a table of sessions
+func writeSessions(w io.Writer, sessions []domain.Session) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tACCOUNT\tSTATE\tAUTH LEVEL\tEXPIRES AT\tEXPIRED\tACTOR")
+	for _, session := range sessions {
+		info := seshadmin.NewSessionInfo(session)
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%t\t%s\n", info.ID, info.AccountID, info.State, info.AuthLevel,
+			info.ExpiresAt.Format(time.RFC3339), info.Expired, info.ActorAccountID)
+	}
+	return table.Flush()
+}
+
+// sessionInfos describes sessions without their keys
+func sessionInfos(sessions []domain.Session) []seshadmin.SessionInfo {
+	infos := []seshadmin.SessionInfo{}
+	for _, session := range sessions {
+		infos = append(infos, seshadmin.NewSessionInfo(session))
+	}
+	return infos
+}
+
+func runMigrate(ctx context.Context, c *cli, args []string) error {
+	flags := c.newFlagSet("migrate", "")
+	parseErr := parse(flags, args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	db, _, connectErr := c.connect()
+	if connectErr != nil {
+		return connectErr
+	}
+	defer db.Close()
+
+	migrateErr := dbstore.Migrate(ctx, db, dbstore.WithTable(c.table))
+	if migrateErr != nil {
+		return migrateErr
+	}
+
+	c.log.Info(domain.SessionTablesMigrated, domain.LogFields{"table": c.table, "operator": c.operator})
+	return nil
+}
+
+func runList(ctx context.Context, c *cli, args []string) error {
+	flags := c.newFlagSet("list", "-account <account id> [-json]")
+	accountID := flags.String("account", "", "account to list the sessions of")
+	asJSON := flags.Bool("json", false, "write the sessions as JSON")
+	parseErr := parse(flags, args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	if *accountID == "" {
+		fmt.Fprintln(c.stderr, "-account is required")
+		flags.Usage()
+		return errUsage
+	}
+
+	_, store, connectErr := c.connect()
+	if connectErr != nil {
+		return connectErr
+	}
+	defer store.Close()
+
+	sessions, listErr := store.ListAccountSessions(ctx, *accountID)
+	if listErr != nil {
+		return listErr
+	}
+
+	if *asJSON {
+		return writeJSON(c.stdout, sessionInfos(sessions))
+	}
+	return writeSessions(c.stdout, sessions)
+}
+
+// runRevoke revokes sessions. It only says what it would revoke unless -yes is given, and it needs a -reason, which is
+// recorded in the audit log along with the operator.
+func runRevoke(ctx context.Context, c *cli, args []string) error {
+	flags := c.newFlagSet("revoke", "-account <account id> | -session-hash <id> -reason <reason> [-yes]")
+	accountID := flags.String("account", "", "revoke every session and remember me token of this account")
+	sessionHash := flags.String("session-hash", "", "revoke the session with this id, the session_hash in the logs")
+	reason := flags.String("reason", "", "why the sessions are revoked, for the audit log")
+	yes := flags.Bool("yes", false, "revoke the sessions, rather than only listing them")
+	parseErr := parse(flags, args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	if (*accountID == "") == (*sessionHash == "") {
+		fmt.Fprintln(c.stderr, "exactly one of -account and -session-hash is required")
+		flags.Usage()
+		return errUsage
+	}
+	if *reason == "" {
+		fmt.Fprintln(c.stderr, "-reason is required")
+		flags.Usage()
+		return errUsage
+	}
+	if c.operator == "" {
+		fmt.Fprintln(c.stderr, "-operator is required when $USER isn't set")
+		return errUsage
+	}
+
+	_, store, connectErr := c.connect()
+	if connectErr != nil {
+		return connectErr
+	}
+	defer store.Close()
+
+	sessions := []domain.Session{}
+	if *sessionHash != "" {
+		session, fetchErr := store.FetchSessionByHash(ctx, *sessionHash)
+		if fetchErr != nil {
+			if fetchErr == domain.ErrValidSessionNotFound {
+				return errors.New("no session has that id")
+			}
+			return fetchErr
+		}
+		sessions = append(sessions, session)
+	} else {
+		accountSessions, listErr := store.ListAccountSessions(ctx, *accountID)
+		if listErr != nil {
+			return listErr
+		}
+		sessions = accountSessions
+	}
+
+	writeErr := writeSessions(c.stdout, sessions)
+	if writeErr != nil {
+		return writeErr
+	}
+
+	if !*yes {
+		fmt.Fprintln(c.stdout, "\nNothing was revoked, run again with -yes to revoke these sessions.")
+		return nil
+	}
+
+	if *sessionHash != "" {
+		session := sessions[0]
+		deleteErr := store.DeleteSession(ctx, session.SessionKey)
+		if deleteErr != nil && deleteErr != domain.ErrValidSessionNotFound {
+			return deleteErr
+		}
+
+		c.log.Info(domain.SessionRevoked, domain.LogFields{
+			"session_hash": *sessionHash,
+			"account_id":   session.AccountID,
+			"operator":     c.operator,
+			"reason":       *reason,
+		})
+		return nil
+	}
+
+	deleteErr := store.DeleteAccountSessions(ctx, *accountID)
+	if deleteErr != nil {
+		return deleteErr
+	}
+
+	forgetErr := store.DeleteAccountRememberTokens(ctx, *accountID)
+	if forgetErr != nil {
+		return forgetErr
+	}
+
+	c.log.Info(domain.AccountSessionsRevoked, domain.LogFields{
+		"account_id": *accountID,
+		"sessions":   fmt.Sprint(len(sessions)),
+		"operator":   c.operator,
+		"reason":     *reason,
+	})
+	return nil
+}
+
+func runPurgeExpired(ctx context.Context, c *cli, args []string) error {
+	flags := c.newFlagSet("purge-expired", "")
+	parseErr := parse(flags, args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	_, store, connectErr := c.connect()
+	if connectErr != nil {
+		return connectErr
+	}
+	defer store.Close()
+
+	sessions, sessionsErr := store.DeleteExpiredSessions(ctx)
+	if sessionsErr != nil {
+		return sessionsErr
+	}
+
+	tokens, tokensErr := store.DeleteExpiredRememberTokens(ctx)
+	if tokensErr != nil {
+		return tokensErr
+	}
+
+	c.log.Info(domain.ExpiredSessionsPurged, domain.LogFields{
+		"sessions":        fmt.Sprint(sessions),
+		"remember_tokens": fmt.Sprint(tokens),
+		"operator":        c.operator,
+	})
+	return nil
+}
+
+func runStats(ctx context.Context, c *cli, args []string) error {
+	flags := c.newFlagSet("stats", "[-expiring-within <duration>] [-top <n>] [-json]")
+	expiringWithin := flags.Duration("expiring-within", seshadmin.DefaultExpiringWithin, "count sessions that expire within this as expiring soon")
+	top := flags.Int("top", seshadmin.DefaultTopAccounts, "how many of the accounts with the most sessions to list")
+	asJSON := flags.Bool("json", false, "write the stats as JSON")
+	parseErr := parse(flags, args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	_, store, connectErr := c.connect()
+	if connectErr != nil {
+		return connectErr
+	}
+	defer store.Close()
+
+	stats, statsErr := store.SessionStats(ctx, *expiringWithin, *top)
+	if statsErr != nil {
+		return statsErr
+	}
+
+	if *asJSON {
+		return writeJSON(c.stdout, stats)
+	}
+
+	table := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Active\t%d\n", stats.Active)
+	fmt.Fprintf(table, "Pending\t%d\n", stats.Pending)
+	fmt.Fprintf(table, "Impersonations\t%d\n", stats.Impersonations)
+	fmt.Fprintf(table, "Expiring within %s\t%d\n", *expiringWithin, stats.ExpiringSoon)
+	fmt.Fprintf(table, "Expired\t%d\n", stats.Expired)
+	fmt.Fprintln(table, "\nACCOUNT\tSESSIONS")
+	for _, account := range stats.TopAccounts {
+		fmt.Fprintf(table, "%s\t%d\n", account.AccountID, account.Sessions)
+	}
+	return table.Flush()
+}
+
+func runExport(ctx context.Context, c *cli, args []string) error {
+	flags := c.newFlagSet("export", "")
+	parseErr := parse(flags, args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	_, store, connectErr := c.connect()
+	if connectErr != nil {
+		return connectErr
+	}
+	defer store.Close()
+
+	sessions, listErr := store.ListSessions(ctx)
+	if listErr != nil {
+		return listErr
+	}
+
+	return writeJSON(c.stdout, sessionInfos(sessions))
+}
@@ -0,0 +1,159 @@
+// Command sesh manages the sessions in a sesh database, for operators. Run "sesh -h" for its commands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+
+	"github.com/trussworks/sesh/pkg/dbstore"
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// errUsage is returned by commands that were run with the wrong flags, after they have printed their usage
+var errUsage = errors.New("usage")
+
+// cli is what every command runs with
+type cli struct {
+	stdout      io.Writer
+	stderr      io.Writer
+	log         domain.LogService
+	databaseURL string
+	table       string
+	operator    string
+}
+
+// command is a subcommand of sesh
+type command struct {
+	summary string
+	run     func(ctx context.Context, c *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"migrate":       {"create or update the session tables", runMigrate},
+	"list":          {"list the sessions of an account", runList},
+	"revoke":        {"revoke a session, or every session of an account", runRevoke},
+	"purge-expired": {"delete expired sessions and remember me tokens", runPurgeExpired},
+	"stats":         {"count the sessions", runStats},
+	"export":        {"write every session to JSON, without their keys", runExport},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command in args and returns the exit code
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr, log: newAuditLogger(stderr)}
+
+	flags := flag.NewFlagSet("sesh", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&c.databaseURL, "database-url", os.Getenv("DATABASE_URL"), "postgres URL of the database, defaults to $DATABASE_URL")
+	flags.StringVar(&c.table, "table", dbstore.DefaultTable, "table the sessions are kept in")
+	flags.StringVar(&c.operator, "operator", os.Getenv("USER"), "who is running the command, recorded in the audit log")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: sesh [flags] <command> [command flags]")
+		fmt.Fprintln(stderr, "\nCommands:")
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(stderr, "  %-14s %s\n", name, commands[name].summary)
+		}
+		fmt.Fprintln(stderr, "\nFlags:")
+		flags.PrintDefaults()
+	}
+
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		if parseErr == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "sesh: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+
+	runErr := cmd.run(ctx, c, flags.Args()[1:])
+	if runErr != nil {
+		if runErr == errUsage {
+			return 2
+		}
+		if runErr == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintf(stderr, "sesh %s: %v\n", flags.Arg(0), runErr)
+		return 1
+	}
+
+	return 0
+}
+
+// newFlagSet returns the flags of a command, which print its usage to stderr
+func (c *cli) newFlagSet(name string, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: sesh %s %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parse parses the flags of a command, which takes no arguments
+func parse(flags *flag.FlagSet, args []string) error {
+	parseErr := flags.Parse(args)
+	if parseErr == flag.ErrHelp {
+		return parseErr
+	}
+	if parseErr != nil {
+		return errUsage
+	}
+
+	if flags.NArg() != 0 {
+		fmt.Fprintf(flags.Output(), "unexpected arguments: %s\n", strings.Join(flags.Args(), " "))
+		flags.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// connect opens the database. Deletions notify dbstore.RevocationChannel, so that running instances drop revoked
+// sessions from their caches.
+func (c *cli) connect() (*sqlx.DB, dbstore.DBStore, error) {
+	if c.databaseURL == "" {
+		return nil, dbstore.DBStore{}, errors.New("no database, set -database-url or $DATABASE_URL")
+	}
+
+	db, openErr := sqlx.Open("postgres", c.databaseURL)
+	if openErr != nil {
+		return nil, dbstore.DBStore{}, fmt.Errorf("Failed to open the database: %w", openErr)
+	}
+
+	return db, dbstore.NewDBStore(db, dbstore.WithTable(c.table), dbstore.WithRevocationNotifications()), nil
+}
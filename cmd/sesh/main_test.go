@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+func TestCommandsCheckTheirFlagsBeforeConnecting(t *testing.T) {
+	usageErrors := [][]string{
+		{},
+		{"nope"},
+		{"list"},
+		{"list", "-account", "alice", "extra"},
+		{"revoke", "-reason", "stolen laptop"},
+		{"revoke", "-account", "alice", "-session-hash", "abc", "-reason", "stolen laptop"},
+		{"revoke", "-account", "alice"},
+		{"-operator", "", "revoke", "-account", "alice", "-reason", "stolen laptop"},
+	}
+
+	for _, args := range usageErrors {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		// No database is given, so anything that gets as far as connecting fails with 1 instead.
+		code := run(context.Background(), append([]string{"-database-url", ""}, args...), stdout, stderr)
+		if code != 2 {
+			t.Fatal("Should have printed the usage", args, code, stderr.String())
+		}
+	}
+
+	stderr := &bytes.Buffer{}
+	code := run(context.Background(), []string{"-database-url", "", "stats"}, &bytes.Buffer{}, stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "no database") {
+		t.Fatal("Should have failed without a database", code, stderr.String())
+	}
+}
+
+func TestAuditLogsAreJSONLines(t *testing.T) {
+	out := &bytes.Buffer{}
+	log := newAuditLogger(out)
+
+	log.Info(domain.SessionRevoked, domain.LogFields{"operator": "ops", "reason": "stolen laptop"})
+	log.WarnError(domain.SessionUnexpectedError, errors.New("boom"), domain.LogFields{})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Should have written a line per entry", lines)
+	}
+
+	entry := map[string]string{}
+	decodeErr := json.Unmarshal([]byte(lines[0]), &entry)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if entry["message"] != domain.SessionRevoked || entry["operator"] != "ops" || entry["reason"] != "stolen laptop" || entry["level"] != "info" {
+		t.Fatal("Should have logged the message and its fields", entry)
+	}
+
+	decodeErr = json.Unmarshal([]byte(lines[1]), &entry)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if entry["error"] != "boom" || entry["level"] != "warn" {
+		t.Fatal("Should have logged the error", entry)
+	}
+}
@@ -0,0 +1,93 @@
+// Package seshtrace holds the OpenTelemetry plumbing shared by the sesh packages.
+// Spans are started with the global TracerProvider, so install yours with otel.SetTracerProvider.
+package seshtrace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/keyring"
+)
+
+// TracerName is the instrumentation name of every sesh span
+const TracerName = "github.com/trussworks/sesh"
+
+// attribute keys
+const (
+	SessionHashKey = attribute.Key("sesh.session_hash")
+	OutcomeKey     = attribute.Key("sesh.outcome")
+)
+
+// outcomes
+const (
+	OutcomeOK            = "ok"
+	OutcomeMissingCookie = domain.ReasonMissingCookie
+	OutcomeNotFound      = domain.ReasonNotFound
+	OutcomeExpired       = domain.ReasonExpired
+	OutcomeRateLimited   = domain.ReasonRateLimited
+	OutcomeMismatch      = string(domain.EventFingerprintMismatch)
+	OutcomePending       = domain.ReasonPending
+	OutcomeError         = "error"
+)
+
+// Start starts a span named name as a child of any span in ctx
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, opts...)
+}
+
+// SessionHash is the span attribute for a session key, which is hashed so that it's safe to export
+func SessionHash(sessionKey string) attribute.KeyValue {
+	return SessionHashKey.String(domain.HashSessionKey(sessionKey))
+}
+
+// End records the outcome of err on the span and ends it.
+// Sessions that aren't found or are expired are expected outcomes, so they don't mark the span as failed.
+func End(span trace.Span, err error) {
+	outcome := Outcome(err)
+	span.SetAttributes(OutcomeKey.String(outcome))
+
+	switch outcome {
+	case OutcomeOK:
+	case OutcomeError:
+		span.SetAttributes(semconv.ErrorTypeKey.String(fmt.Sprintf("%T", err)))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	default:
+		span.SetAttributes(semconv.ErrorTypeKey.String(outcome))
+	}
+
+	span.End()
+}
+
+// Outcome describes the result of a session operation that returned err
+func Outcome(err error) string {
+	switch err {
+	case nil:
+		return OutcomeOK
+	case http.ErrNoCookie:
+		return OutcomeMissingCookie
+	case domain.ErrValidSessionNotFound, sql.ErrNoRows, keyring.ErrUnknownKey:
+		return OutcomeNotFound
+	case domain.ErrSessionExpired:
+		return OutcomeExpired
+	case domain.ErrRateLimited:
+		return OutcomeRateLimited
+	case domain.ErrFingerprintMismatch:
+		return OutcomeMismatch
+	case domain.ErrRememberTokenInvalid:
+		return OutcomeNotFound
+	case domain.ErrSessionPending:
+		return OutcomePending
+	default:
+		return OutcomeError
+	}
+}
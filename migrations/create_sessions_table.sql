@@ -1,5 +0,0 @@
-CREATE TABLE sessions(
-    session_key     text PRIMARY KEY,
-    account_id      text UNIQUE NOT NULL,
-    expiration_date timestamp NOT NULL
-);
\ No newline at end of file
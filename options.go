@@ -0,0 +1,168 @@
+package sesh
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/seshadmin"
+	"github.com/trussworks/sesh/pkg/seshttp"
+)
+
+// Option configures optional behavior of Sessions
+type Option func(*config)
+
+// config holds everything that can be set with an Option
+type config struct {
+	cookieKeys       [][]byte
+	eventHandlers    []domain.EventHandler
+	rateLimiter      seshttp.RateLimiter
+	clientKey        func(r *http.Request) string
+	fingerprint      *seshttp.FingerprintPolicy
+	pendingTimeout   time.Duration
+	rememberTokens   domain.RememberTokenStorageService
+	rememberDuration time.Duration
+	expiryHeaders    bool
+	expiryWarning    time.Duration
+	epochs           domain.AccountEpochStorageService
+	cacheEpochs      bool
+	epochCacheTTL    time.Duration
+	validator        domain.AccountValidator
+	validateRequests bool
+	validationTTL    time.Duration
+	adminStore       domain.SessionAdminStorageService
+	adminAuthorizer  seshadmin.Authorizer
+}
+
+func newConfig(opts []Option) config {
+	config := config{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// WithCookieKeys signs the session cookie with the given hash and block key pairs, ordered newest first.
+// New cookies are signed with the first pair and any pair is accepted, so to rotate keys add a new pair to the front.
+// Cookies signed with an older pair are transparently re-issued with the newest one by the AuthenticationMiddleware.
+func WithCookieKeys(keyPairs ...[]byte) Option {
+	return func(c *config) {
+		c.cookieKeys = keyPairs
+	}
+}
+
+// WithEventHandler notifies the given handler of session lifecycle events: sessions being created, destroyed, or
+// replaced, and requests that fail to authenticate. It can be passed more than once to notify several handlers.
+func WithEventHandler(handler domain.EventHandler) Option {
+	return func(c *config) {
+		c.eventHandlers = append(c.eventHandlers, handler)
+	}
+}
+
+// WithRateLimiter limits how many requests with invalid sessions each client can make. Clients over the limit are
+// turned away by the AuthenticationMiddleware with 429 Too Many Requests and a Retry-After header.
+// Use seshttp.NewMemoryRateLimiter for a single instance, or seshredis.NewRateLimiter to share limits between instances.
+func WithRateLimiter(limiter seshttp.RateLimiter) Option {
+	return func(c *config) {
+		c.rateLimiter = limiter
+	}
+}
+
+// WithClientKey sets how clients are told apart for rate limiting. It defaults to seshttp.RemoteIP, the address the
+// request came from, which is wrong behind a proxy.
+func WithClientKey(clientKey func(r *http.Request) string) Option {
+	return func(c *config) {
+		c.clientKey = clientKey
+	}
+}
+
+// WithFingerprintPolicy binds sessions to a fingerprint of the client that logged in, so that a stolen cookie is no
+// good to a client that doesn't look the same. The AuthenticationMiddleware takes the policy's action on a mismatch.
+// Sessions created before the policy was set aren't bound to a client and aren't checked.
+func WithFingerprintPolicy(policy seshttp.FingerprintPolicy) Option {
+	return func(c *config) {
+		c.fingerprint = &policy
+	}
+}
+
+// WithPendingTimeout sets how long users have between the first and second step of logging in, see
+// Sessions.UserDidPartiallyAuthenticate. It defaults to session.DefaultPendingTimeout.
+func WithPendingTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.pendingTimeout = timeout
+	}
+}
+
+// WithRememberMe lets users stay logged in across browser sessions, see Sessions.RememberAccount. Remember me tokens
+// last for duration since they were last used, and are kept in tokens, which can be the same dbstore.DBStore that
+// keeps the sessions. Once a session has ended, the AuthenticationMiddleware exchanges the token for a new session.
+func WithRememberMe(tokens domain.RememberTokenStorageService, duration time.Duration) Option {
+	return func(c *config) {
+		c.rememberTokens = tokens
+		c.rememberDuration = duration
+	}
+}
+
+// WithExpiryHeaders has the AuthenticationMiddleware tell clients when their session ends, in the X-Session-Expires-At
+// and X-Session-Idle-Timeout headers of every response. See also Sessions.StatusHandler.
+func WithExpiryHeaders() Option {
+	return func(c *config) {
+		c.expiryHeaders = true
+	}
+}
+
+// WithExpiryWarning sets how long before a session times out Sessions.EventStreamHandler warns the client.
+// It defaults to seshttp.DefaultExpiryWarning.
+func WithExpiryWarning(warning time.Duration) Option {
+	return func(c *config) {
+		c.expiryWarning = warning
+	}
+}
+
+// WithAdmin lets operators manage sessions through Sessions.AdminHandler, for requests that authorize allows.
+// store is where the sessions are managed, it can be the same dbstore.DBStore that keeps them.
+func WithAdmin(store domain.SessionAdminStorageService, authorize seshadmin.Authorizer) Option {
+	return func(c *config) {
+		c.adminStore = store
+		c.adminAuthorizer = authorize
+	}
+}
+
+// WithAccountEpochs stamps sessions with their account's epoch, kept in epochs, so that Sessions.InvalidateAccountEpoch
+// can end every session of an account at once. epochs can be the same dbstore.DBStore that keeps the sessions, or
+// seshredis.EpochStore for the stateless cookiestore. The epoch is checked on every request, and cached for
+// session.DefaultEpochCacheTTL, see WithAccountEpochCache.
+func WithAccountEpochs(epochs domain.AccountEpochStorageService) Option {
+	return func(c *config) {
+		c.epochs = epochs
+	}
+}
+
+// WithAccountEpochCache sets how long account epochs are cached between requests, 0 fetches them on every request.
+// Sessions.InvalidateAccountEpoch takes effect right away on the instance that calls it. Other instances see it once
+// their cached epoch expires, or right away if revocations are passed on to Sessions.Revoke, see
+// dbstore.ListenForRevocations.
+func WithAccountEpochCache(ttl time.Duration) Option {
+	return func(c *config) {
+		c.cacheEpochs = true
+		c.epochCacheTTL = ttl
+	}
+}
+
+// WithAccountValidator asks validator whether an account is still allowed, not disabled, locked, or deleted, before
+// logging it in. Denied accounts have their sessions destroyed and UserDidAuthenticate returns domain.ErrAccountDenied.
+func WithAccountValidator(validator domain.AccountValidator) Option {
+	return func(c *config) {
+		c.validator = validator
+	}
+}
+
+// WithRequestAccountValidation also asks the AccountValidator about the account of every authenticated request, so that
+// disabling an account ends its sessions right away rather than when they time out. Allowed accounts are cached for
+// cacheTTL, 0 asks every time. Requests of denied accounts get 403 Forbidden with the code seshttp.ErrorCodeAccountDenied.
+func WithRequestAccountValidation(cacheTTL time.Duration) Option {
+	return func(c *config) {
+		c.validateRequests = true
+		c.validationTTL = cacheTTL
+	}
+}
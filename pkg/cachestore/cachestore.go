@@ -0,0 +1,320 @@
+// Package cachestore implements a SessionStorageService that caches the sessions of another one.
+// Most authenticated requests are answered from memory, and the expiration date is only extended
+// in the wrapped store once it has drifted far enough from where it would have been extended to.
+package cachestore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// defaults, each can be changed with an Option
+const (
+	DefaultMaxEntries     = 10000
+	DefaultTTL            = 10 * time.Second
+	DefaultWriteThreshold = time.Minute
+)
+
+// entry is a cached session, along with the key it is cached under so that it can be evicted
+type entry struct {
+	sessionKey string
+	session    domain.Session
+	cachedAt   time.Time
+}
+
+// CacheStore is a SessionStorageService that caches the sessions of the store it wraps in a bounded LRU.
+//
+// A cached session is trusted for the TTL, after which it is read from the wrapped store again. Sessions
+// deleted through the CacheStore are dropped from the cache right away, but a session deleted through
+// another instance can still be served from this one until its entry expires, unless the CacheStore
+// is passed its revocations with Revoke.
+type CacheStore struct {
+	store          domain.SessionStorageService
+	maxEntries     int
+	ttl            time.Duration
+	writeThreshold time.Duration
+	now            func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// keys maps the hash of each cached session key to the key, since revocations only hold the hash
+	keys map[string]string
+}
+
+// Option configures optional behavior of a CacheStore
+type Option func(*CacheStore)
+
+// WithMaxEntries sets the number of sessions to cache before the least recently used are evicted
+func WithMaxEntries(maxEntries int) Option {
+	return func(s *CacheStore) {
+		s.maxEntries = maxEntries
+	}
+}
+
+// WithTTL sets how long a cached session is trusted before it is read from the wrapped store again
+func WithTTL(ttl time.Duration) Option {
+	return func(s *CacheStore) {
+		s.ttl = ttl
+	}
+}
+
+// WithWriteThreshold sets how far the stored expiration date may fall behind before it is extended in the wrapped store.
+// Sessions can end up to this much earlier than the session timeout says they would.
+func WithWriteThreshold(writeThreshold time.Duration) Option {
+	return func(s *CacheStore) {
+		s.writeThreshold = writeThreshold
+	}
+}
+
+// NewCacheStore returns a CacheStore wrapping store
+func NewCacheStore(store domain.SessionStorageService, opts ...Option) *CacheStore {
+	cache := &CacheStore{
+		store:          store,
+		maxEntries:     DefaultMaxEntries,
+		ttl:            DefaultTTL,
+		writeThreshold: DefaultWriteThreshold,
+		now:            time.Now,
+		entries:        map[string]*list.Element{},
+		lru:            list.New(),
+		keys:           map[string]string{},
+	}
+
+	for _, opt := range opts {
+		opt(cache)
+	}
+
+	return cache
+}
+
+// get returns the cached entry for a session key, marking it as recently used
+func (s *CacheStore) get(sessionKey string) (entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[sessionKey]
+	if !ok {
+		return entry{}, false
+	}
+
+	s.lru.MoveToFront(element)
+	return element.Value.(entry), true
+}
+
+// put caches a session under a session key, evicting the least recently used entries if the cache is full
+func (s *CacheStore) put(sessionKey string, session domain.Session, cachedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached := entry{sessionKey, session, cachedAt}
+
+	if element, ok := s.entries[sessionKey]; ok {
+		element.Value = cached
+		s.lru.MoveToFront(element)
+		return
+	}
+
+	s.entries[sessionKey] = s.lru.PushFront(cached)
+	s.keys[domain.HashSessionKey(sessionKey)] = sessionKey
+
+	for s.lru.Len() > s.maxEntries {
+		s.removeLocked(s.lru.Back().Value.(entry).sessionKey)
+	}
+}
+
+// remove drops a session key from the cache
+func (s *CacheStore) remove(sessionKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeLocked(sessionKey)
+}
+
+// removeLocked drops a session key from the cache, s.mu must be held
+func (s *CacheStore) removeLocked(sessionKey string) {
+	element, ok := s.entries[sessionKey]
+	if !ok {
+		return
+	}
+
+	s.lru.Remove(element)
+	delete(s.entries, sessionKey)
+	delete(s.keys, domain.HashSessionKey(sessionKey))
+}
+
+// Revoke drops revoked sessions from the cache. It makes the CacheStore a domain.RevocationHandler,
+// so that sessions deleted through other instances can be dropped right away with dbstore.ListenForRevocations.
+func (s *CacheStore) Revoke(revocation domain.Revocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if revocation.SessionHash != "" {
+		if sessionKey, ok := s.keys[revocation.SessionHash]; ok {
+			s.removeLocked(sessionKey)
+		}
+		return
+	}
+
+	for sessionKey, element := range s.entries {
+		session := element.Value.(entry).session
+		if session.AccountID == revocation.AccountID || session.ActorAccountID == revocation.AccountID {
+			s.removeLocked(sessionKey)
+		}
+	}
+}
+
+// Purge empties the cache
+func (s *CacheStore) Purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = map[string]*list.Element{}
+	s.keys = map[string]string{}
+	s.lru.Init()
+}
+
+// Len returns the number of cached sessions
+func (s *CacheStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lru.Len()
+}
+
+// Close closes the wrapped store
+func (s *CacheStore) Close() error {
+	return s.store.Close()
+}
+
+// CreateSession creates the session in the wrapped store and caches it
+func (s *CacheStore) CreateSession(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	session, createErr := s.store.CreateSession(ctx, accountID, sessionKey, expirationDuration)
+	if createErr != nil {
+		return domain.Session{}, createErr
+	}
+
+	s.put(session.SessionKey, session, s.now())
+
+	return session, nil
+}
+
+// ReplaceSessionForAccount replaces the session in the wrapped store, dropping the replaced session from the cache
+// and caching the new one
+func (s *CacheStore) ReplaceSessionForAccount(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration, metadata domain.SessionMetadata) (domain.Session, *domain.Session, error) {
+	session, replaced, replaceErr := s.store.ReplaceSessionForAccount(ctx, accountID, sessionKey, expirationDuration, metadata)
+	if replaceErr != nil {
+		return domain.Session{}, nil, replaceErr
+	}
+
+	if replaced != nil {
+		s.remove(replaced.SessionKey)
+	}
+	s.put(session.SessionKey, session, s.now())
+
+	return session, replaced, nil
+}
+
+// FetchPossiblyExpiredSession is not cached, it is only used when logging in.
+func (s *CacheStore) FetchPossiblyExpiredSession(ctx context.Context, accountID string) (domain.Session, error) {
+	return s.store.FetchPossiblyExpiredSession(ctx, accountID)
+}
+
+// DeleteSession drops the session from the cache and deletes it from the wrapped store
+func (s *CacheStore) DeleteSession(ctx context.Context, sessionKey string) error {
+	s.remove(sessionKey)
+	deleteErr := s.store.DeleteSession(ctx, sessionKey)
+	// A request that was already extending the session could have cached it again in the meantime.
+	s.remove(sessionKey)
+
+	return deleteErr
+}
+
+// DeleteAccountSessions drops the account's sessions from the cache and deletes them from the wrapped store
+func (s *CacheStore) DeleteAccountSessions(ctx context.Context, accountID string) error {
+	revocation := domain.Revocation{AccountID: accountID}
+
+	s.Revoke(revocation)
+	deleteErr := s.store.DeleteAccountSessions(ctx, accountID)
+	// A request that was already extending one of the sessions could have cached it again in the meantime.
+	s.Revoke(revocation)
+
+	return deleteErr
+}
+
+// FetchSession returns the cached session if it is still fresh, otherwise it fetches it from the wrapped store.
+func (s *CacheStore) FetchSession(ctx context.Context, sessionKey string) (domain.Session, error) {
+	now := s.now()
+
+	cached, ok := s.get(sessionKey)
+	if ok && now.Sub(cached.cachedAt) < s.ttl && cached.session.ExpirationDate.After(now) {
+		return cached.session, nil
+	}
+
+	return s.fetch(ctx, sessionKey, now)
+}
+
+// fetch reads a session from the wrapped store without extending it and caches it
+func (s *CacheStore) fetch(ctx context.Context, sessionKey string, now time.Time) (domain.Session, error) {
+	session, fetchErr := s.store.FetchSession(ctx, sessionKey)
+	if fetchErr != nil {
+		s.remove(sessionKey)
+		return domain.Session{}, fetchErr
+	}
+
+	s.put(sessionKey, session, now)
+
+	return session, nil
+}
+
+// ExtendAndFetchSession only extends the session in the wrapped store if its stored expiration date is at least
+// the write threshold behind the one it is being extended to, by its own idle timeout if it has one. Otherwise it returns the session with its stored
+// expiration date, from the cache if it is fresh or else from the wrapped store. Pending sessions are never extended,
+// so they are fetched just like FetchSession does.
+// On failure, it can return ErrValidSessionNotFound, ErrSessionExpired, or an unexpected error
+func (s *CacheStore) ExtendAndFetchSession(ctx context.Context, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	now := s.now()
+
+	cached, ok := s.get(sessionKey)
+	if ok && cached.session.IsPending() {
+		return s.FetchSession(ctx, sessionKey)
+	}
+	if ok && cached.session.IdleTimeout > 0 {
+		expirationDuration = cached.session.IdleTimeout
+	}
+	expirationDate := now.Add(expirationDuration)
+
+	if ok && cached.session.ExpirationDate.After(now) && expirationDate.Sub(cached.session.ExpirationDate) < s.writeThreshold {
+		if now.Sub(cached.cachedAt) < s.ttl {
+			return cached.session, nil
+		}
+
+		return s.fetch(ctx, sessionKey, now)
+	}
+
+	session, extendErr := s.store.ExtendAndFetchSession(ctx, sessionKey, expirationDuration)
+	if extendErr != nil {
+		s.remove(sessionKey)
+		return domain.Session{}, extendErr
+	}
+
+	s.put(sessionKey, session, now)
+
+	return session, nil
+}
+
+// UpdateSessionMetadata updates the session in the wrapped store and caches the updated session
+func (s *CacheStore) UpdateSessionMetadata(ctx context.Context, sessionKey string, metadata domain.SessionMetadata) (domain.Session, error) {
+	s.remove(sessionKey)
+	session, updateErr := s.store.UpdateSessionMetadata(ctx, sessionKey, metadata)
+	if updateErr != nil {
+		return domain.Session{}, updateErr
+	}
+
+	s.put(session.SessionKey, session, s.now())
+
+	return session, nil
+}
@@ -0,0 +1,394 @@
+package cachestore
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// memoryStore is a SessionStorageService that counts the calls that would hit the database
+type memoryStore struct {
+	now      func() time.Time
+	sessions map[string]domain.Session
+
+	fetches int
+	extends int
+}
+
+func newMemoryStore(now func() time.Time) *memoryStore {
+	return &memoryStore{
+		now:      now,
+		sessions: map[string]domain.Session{},
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) CreateSession(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	session := domain.Session{
+		AccountID:      accountID,
+		SessionKey:     sessionKey,
+		ExpirationDate: s.now().Add(expirationDuration),
+	}
+	s.sessions[sessionKey] = session
+	return session, nil
+}
+
+func (s *memoryStore) ReplaceSessionForAccount(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration, metadata domain.SessionMetadata) (domain.Session, *domain.Session, error) {
+	var replaced *domain.Session
+	for extantKey, extantSession := range s.sessions {
+		if extantSession.AccountID == accountID {
+			replaced = &extantSession
+			delete(s.sessions, extantKey)
+		}
+	}
+
+	session, createErr := s.CreateSession(ctx, accountID, sessionKey, expirationDuration)
+	session.SessionMetadata = metadata
+	s.sessions[sessionKey] = session
+	return session, replaced, createErr
+}
+
+func (s *memoryStore) FetchPossiblyExpiredSession(ctx context.Context, accountID string) (domain.Session, error) {
+	return domain.Session{}, sql.ErrNoRows
+}
+
+func (s *memoryStore) DeleteSession(ctx context.Context, sessionKey string) error {
+	if _, ok := s.sessions[sessionKey]; !ok {
+		return domain.ErrValidSessionNotFound
+	}
+	delete(s.sessions, sessionKey)
+	return nil
+}
+
+func (s *memoryStore) DeleteAccountSessions(ctx context.Context, accountID string) error {
+	for sessionKey, session := range s.sessions {
+		if session.AccountID == accountID || session.ActorAccountID == accountID {
+			delete(s.sessions, sessionKey)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) FetchSession(ctx context.Context, sessionKey string) (domain.Session, error) {
+	s.fetches++
+
+	session, ok := s.sessions[sessionKey]
+	if !ok {
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	}
+	if !session.ExpirationDate.After(s.now()) {
+		return domain.Session{}, domain.ErrSessionExpired
+	}
+	return session, nil
+}
+
+func (s *memoryStore) ExtendAndFetchSession(ctx context.Context, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	s.extends++
+
+	session, fetchErr := s.FetchSession(ctx, sessionKey)
+	s.fetches--
+	if fetchErr != nil {
+		return domain.Session{}, fetchErr
+	}
+
+	if session.IdleTimeout > 0 {
+		expirationDuration = session.IdleTimeout
+	}
+
+	session.ExpirationDate = s.now().Add(expirationDuration)
+	s.sessions[sessionKey] = session
+	return session, nil
+}
+
+func (s *memoryStore) UpdateSessionMetadata(ctx context.Context, sessionKey string, metadata domain.SessionMetadata) (domain.Session, error) {
+	session, fetchErr := s.FetchSession(ctx, sessionKey)
+	s.fetches--
+	if fetchErr != nil {
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	}
+
+	session.SessionMetadata = metadata
+	s.sessions[sessionKey] = session
+	return session, nil
+}
+
+// testClock is a clock that only moves when it is told to
+type testClock struct {
+	current time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.current
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+// getTestObjects gives you a CacheStore, the store it wraps, and the clock they both use
+func getTestObjects(t *testing.T, opts ...Option) (*CacheStore, *memoryStore, *testClock) {
+	t.Helper()
+
+	clock := &testClock{time.Now().UTC()}
+	backing := newMemoryStore(clock.now)
+
+	cache := NewCacheStore(backing, opts...)
+	cache.now = clock.now
+
+	return cache, backing, clock
+}
+
+func TestExtendOnlyWritesPastTheThreshold(t *testing.T) {
+	cache, backing, clock := getTestObjects(t, WithTTL(time.Hour), WithWriteThreshold(time.Minute))
+	timeout := 5 * time.Minute
+
+	created, createErr := cache.CreateSession(context.Background(), uuid.New().String(), uuid.New().String(), timeout)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	for i := 0; i < 5; i++ {
+		clock.advance(10 * time.Second)
+		session, extendErr := cache.ExtendAndFetchSession(context.Background(), created.SessionKey, timeout)
+		if extendErr != nil {
+			t.Fatal(extendErr)
+		}
+		if session.ExpirationDate != created.ExpirationDate {
+			t.Fatal("The stored expiration date should not have moved yet", session.ExpirationDate, created.ExpirationDate)
+		}
+	}
+
+	if backing.extends != 0 || backing.fetches != 0 {
+		t.Fatal("Should have answered from the cache", backing.extends, backing.fetches)
+	}
+
+	clock.advance(11 * time.Second)
+	session, extendErr := cache.ExtendAndFetchSession(context.Background(), created.SessionKey, timeout)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+
+	if backing.extends != 1 {
+		t.Fatal("Should have extended the session once it drifted past the threshold", backing.extends)
+	}
+
+	if session.ExpirationDate != clock.now().Add(timeout) {
+		t.Fatal("Should have returned the extended session", session.ExpirationDate)
+	}
+}
+
+func TestSessionsAreExtendedByTheirOwnIdleTimeout(t *testing.T) {
+	cache, backing, clock := getTestObjects(t, WithTTL(time.Hour), WithWriteThreshold(time.Minute))
+	idleTimeout := 2 * time.Minute
+
+	created, _, createErr := cache.ReplaceSessionForAccount(context.Background(), uuid.New().String(), uuid.New().String(), idleTimeout, domain.NewSessionMetadata(domain.WithIdleTimeout(idleTimeout)))
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	// Extending by the service's much longer timeout would have written right away.
+	clock.advance(10 * time.Second)
+	session, extendErr := cache.ExtendAndFetchSession(context.Background(), created.SessionKey, time.Hour)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+	if backing.extends != 0 || session.ExpirationDate != created.ExpirationDate {
+		t.Fatal("Should have measured the threshold against the session's own timeout", backing.extends, session.ExpirationDate)
+	}
+
+	clock.advance(time.Minute)
+	session, extendErr = cache.ExtendAndFetchSession(context.Background(), created.SessionKey, time.Hour)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+	if backing.extends != 1 || session.ExpirationDate != clock.now().Add(idleTimeout) {
+		t.Fatal("Should have extended the session by its own timeout", backing.extends, session.ExpirationDate)
+	}
+}
+
+func TestPendingSessionsAreServedFromTheCache(t *testing.T) {
+	cache, backing, clock := getTestObjects(t, WithTTL(time.Hour), WithWriteThreshold(time.Minute))
+
+	metadata := domain.NewSessionMetadata()
+	metadata.State = domain.SessionStatePending
+	created, _, createErr := cache.ReplaceSessionForAccount(context.Background(), uuid.New().String(), uuid.New().String(), 5*time.Minute, metadata)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	// A pending session's stored expiration date never moves, so it is always far behind the service's timeout.
+	for i := 0; i < 5; i++ {
+		clock.advance(10 * time.Second)
+		session, extendErr := cache.ExtendAndFetchSession(context.Background(), created.SessionKey, time.Hour)
+		if extendErr != nil {
+			t.Fatal(extendErr)
+		}
+		if session.ExpirationDate != created.ExpirationDate {
+			t.Fatal("A pending session should not have been extended", session.ExpirationDate, created.ExpirationDate)
+		}
+	}
+
+	if backing.extends != 0 || backing.fetches != 0 {
+		t.Fatal("Should have answered from the cache", backing.extends, backing.fetches)
+	}
+}
+
+func TestStaleEntriesAreReadAgainWithoutWriting(t *testing.T) {
+	cache, backing, clock := getTestObjects(t, WithTTL(10*time.Second), WithWriteThreshold(time.Minute))
+	timeout := 5 * time.Minute
+
+	created, createErr := cache.CreateSession(context.Background(), uuid.New().String(), uuid.New().String(), timeout)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	clock.advance(11 * time.Second)
+	_, extendErr := cache.ExtendAndFetchSession(context.Background(), created.SessionKey, timeout)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+
+	if backing.fetches != 1 || backing.extends != 0 {
+		t.Fatal("Should have read the stale session without extending it", backing.fetches, backing.extends)
+	}
+
+	// Another instance logs the session out
+	delete(backing.sessions, created.SessionKey)
+
+	clock.advance(11 * time.Second)
+	_, err := cache.ExtendAndFetchSession(context.Background(), created.SessionKey, timeout)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal("Should have noticed the session is gone once the entry went stale, got", err)
+	}
+
+	if cache.Len() != 0 {
+		t.Fatal("A session that wasn't found should not stay cached")
+	}
+}
+
+func TestDeleteInvalidatesTheCache(t *testing.T) {
+	cache, _, _ := getTestObjects(t, WithTTL(time.Hour))
+
+	created, createErr := cache.CreateSession(context.Background(), uuid.New().String(), uuid.New().String(), 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	deleteErr := cache.DeleteSession(context.Background(), created.SessionKey)
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+
+	_, err := cache.ExtendAndFetchSession(context.Background(), created.SessionKey, 5*time.Minute)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal("A deleted session should not be served from the cache, got", err)
+	}
+}
+
+func TestExpiredSessionsAreNotServedFromTheCache(t *testing.T) {
+	cache, _, clock := getTestObjects(t, WithTTL(time.Hour))
+
+	created, createErr := cache.CreateSession(context.Background(), uuid.New().String(), uuid.New().String(), 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	clock.advance(6 * time.Minute)
+	_, err := cache.ExtendAndFetchSession(context.Background(), created.SessionKey, 5*time.Minute)
+	if err != domain.ErrSessionExpired {
+		t.Fatal(err)
+	}
+}
+
+func TestLeastRecentlyUsedSessionsAreEvicted(t *testing.T) {
+	cache, backing, _ := getTestObjects(t, WithMaxEntries(2), WithTTL(time.Hour))
+
+	var sessionKeys []string
+	for i := 0; i < 3; i++ {
+		created, createErr := cache.CreateSession(context.Background(), uuid.New().String(), uuid.New().String(), 5*time.Minute)
+		if createErr != nil {
+			t.Fatal(createErr)
+		}
+		sessionKeys = append(sessionKeys, created.SessionKey)
+	}
+
+	if cache.Len() != 2 {
+		t.Fatal("The cache should be bounded", cache.Len())
+	}
+
+	_, extendErr := cache.ExtendAndFetchSession(context.Background(), sessionKeys[0], 5*time.Minute)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+
+	if backing.extends != 1 {
+		t.Fatal("The oldest session should have been evicted", backing.extends)
+	}
+
+	_, extendErr = cache.ExtendAndFetchSession(context.Background(), sessionKeys[2], 5*time.Minute)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+
+	if backing.extends != 1 {
+		t.Fatal("The newest session should still be cached", backing.extends)
+	}
+}
+
+func TestRevocationsDropSessionsFromTheCache(t *testing.T) {
+	cache, backing, _ := getTestObjects(t, WithTTL(time.Hour))
+	accountID := uuid.New().String()
+
+	revokedSession, createErr := cache.CreateSession(context.Background(), uuid.New().String(), uuid.New().String(), 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	accountSession, createErr := cache.CreateSession(context.Background(), accountID, uuid.New().String(), 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	otherSession, createErr := cache.CreateSession(context.Background(), uuid.New().String(), uuid.New().String(), 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	// Another instance deletes two of the sessions and tells us about it
+	delete(backing.sessions, revokedSession.SessionKey)
+	delete(backing.sessions, accountSession.SessionKey)
+	cache.Revoke(domain.Revocation{SessionHash: domain.HashSessionKey(revokedSession.SessionKey), AccountID: revokedSession.AccountID})
+	cache.Revoke(domain.Revocation{AccountID: accountID})
+
+	if cache.Len() != 1 {
+		t.Fatal("Only the session that wasn't revoked should be cached", cache.Len())
+	}
+
+	_, err := cache.ExtendAndFetchSession(context.Background(), revokedSession.SessionKey, 5*time.Minute)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal("The revoked session should not be served from the cache, got", err)
+	}
+
+	_, err = cache.ExtendAndFetchSession(context.Background(), accountSession.SessionKey, 5*time.Minute)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal("The revoked account's session should not be served from the cache, got", err)
+	}
+
+	cache.Purge()
+	if cache.Len() != 0 {
+		t.Fatal("Purging should empty the cache", cache.Len())
+	}
+
+	_, err = cache.ExtendAndFetchSession(context.Background(), otherSession.SessionKey, 5*time.Minute)
+	if err != nil {
+		t.Fatal("Purging should not end any sessions", err)
+	}
+}
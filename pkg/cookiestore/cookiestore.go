@@ -0,0 +1,270 @@
+// Package cookiestore implements a stateless SessionStorageService. Instead of keeping a row per session
+// it seals the session itself into the session key, which the client then carries around in its cookie.
+package cookiestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/keyring"
+)
+
+// sealName is mixed into the MAC of every sealed session so that values sealed for another purpose
+// with the same keys can't be passed off as sessions.
+const sealName = "sesh-session"
+
+// sealedSession is everything that is sealed into a session key
+type sealedSession struct {
+	ID             string        `json:"id"`
+	AccountID      string        `json:"account_id"`
+	ExpirationDate time.Time     `json:"expiration_date"`
+	Timeout        time.Duration `json:"timeout"`
+	domain.SessionMetadata
+}
+
+// CookieStore seals sessions into their session keys with securecookie.
+type CookieStore struct {
+	keys     keyring.Keyring
+	denylist Denylist
+}
+
+// NewCookieStore returns a CookieStore that seals sessions with the given hash and block keys.
+// keyPairs are given newest first, see keyring.New: the first pair seals new sessions and
+// every pair is tried when opening one, so keys can be rotated by prepending a new pair.
+// The block key of a pair should be set so that sessions are encrypted, not just signed.
+//
+// denylist may be nil, in which case ending a session only removes it from the client.
+func NewCookieStore(denylist Denylist, keyPairs ...[]byte) CookieStore {
+	return CookieStore{
+		keyring.New(keyPairs...),
+		denylist,
+	}
+}
+
+// seal encodes a session into a session key using the newest keys
+func (s CookieStore) seal(sealed sealedSession) (domain.Session, error) {
+	sessionKey, encodeErr := s.keys.Encode(sealName, sealed)
+	if encodeErr != nil {
+		return domain.Session{}, fmt.Errorf("Failed to seal a session: %w", encodeErr)
+	}
+
+	return sealed.session(sessionKey), nil
+}
+
+// session returns the sealed session as a domain.Session with the given key
+func (sealed sealedSession) session(sessionKey string) domain.Session {
+	return domain.Session{
+		AccountID:       sealed.AccountID,
+		SessionKey:      sessionKey,
+		ExpirationDate:  sealed.ExpirationDate,
+		SessionMetadata: sealed.SessionMetadata,
+	}
+}
+
+// open decodes a session key, returning ErrValidSessionNotFound if it was not sealed by any of our keys
+// or if it has been put on the denylist. Sessions sealed with an old key are resealed whenever they are extended,
+// so there is no need to tell the caller which key opened it.
+func (s CookieStore) open(sessionKey string) (sealedSession, error) {
+	sealed := sealedSession{}
+	_, decodeErr := s.keys.Decode(sealName, sessionKey, &sealed)
+	if decodeErr != nil {
+		return sealedSession{}, domain.ErrValidSessionNotFound
+	}
+
+	if s.denylist != nil {
+		denied, denyErr := s.denylist.Contains(sealed.ID)
+		if denyErr != nil {
+			return sealedSession{}, fmt.Errorf("Unexpected error checking the session denylist: %w", denyErr)
+		}
+		if denied {
+			return sealedSession{}, domain.ErrValidSessionNotFound
+		}
+	}
+
+	return sealed, nil
+}
+
+// Close is a no-op, there is no connection to close.
+func (s CookieStore) Close() error {
+	return nil
+}
+
+// CreateSession seals a new session. The given session key becomes the ID of the session,
+// the returned session's SessionKey is the sealed session.
+func (s CookieStore) CreateSession(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	return s.createSession(accountID, sessionKey, expirationDuration, domain.SessionMetadata{})
+}
+
+func (s CookieStore) createSession(accountID string, sessionKey string, expirationDuration time.Duration, metadata domain.SessionMetadata) (domain.Session, error) {
+	sealed := sealedSession{
+		ID:              sessionKey,
+		AccountID:       accountID,
+		ExpirationDate:  time.Now().UTC().Add(expirationDuration),
+		Timeout:         expirationDuration,
+		SessionMetadata: metadata,
+	}
+
+	return s.seal(sealed)
+}
+
+// ReplaceSessionForAccount seals a new session. It never replaces one, since there is no way to find the account's
+// other sessions, see FetchPossiblyExpiredSession.
+func (s CookieStore) ReplaceSessionForAccount(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration, metadata domain.SessionMetadata) (domain.Session, *domain.Session, error) {
+	session, createErr := s.createSession(accountID, sessionKey, expirationDuration, metadata)
+	return session, nil, createErr
+}
+
+// FetchPossiblyExpiredSession always returns sql.ErrNoRows. Sessions are not stored anywhere, so there is no
+// way to find one by account. This means that in this mode logging in does not end an account's other sessions.
+func (s CookieStore) FetchPossiblyExpiredSession(ctx context.Context, accountID string) (domain.Session, error) {
+	return domain.Session{}, sql.ErrNoRows
+}
+
+// DeleteSession puts the session on the denylist until it would have expired on its own.
+func (s CookieStore) DeleteSession(ctx context.Context, sessionKey string) error {
+	sealed, openErr := s.open(sessionKey)
+	if openErr != nil {
+		return openErr
+	}
+
+	if s.denylist == nil {
+		return nil
+	}
+
+	// Every key for this session was sealed no later than now, so none of them can outlive a full timeout from now.
+	denyErr := s.denylist.Add(sealed.ID, time.Now().UTC().Add(sealed.Timeout))
+	if denyErr != nil {
+		return fmt.Errorf("Failed to deny session: %w", denyErr)
+	}
+
+	return nil
+}
+
+// DeleteAccountSessions always returns ErrAccountSessionsNotStored, for the same reason as FetchPossiblyExpiredSession.
+// Every session of an account can only be ended by moving its epoch on, see session.WithAccountEpochs.
+func (s CookieStore) DeleteAccountSessions(ctx context.Context, accountID string) error {
+	return domain.ErrAccountSessionsNotStored
+}
+
+// FetchSession opens the session without resealing it, so the returned SessionKey is the one passed in.
+// On failure, it can return ErrValidSessionNotFound, ErrSessionExpired, or an unexpected error
+func (s CookieStore) FetchSession(ctx context.Context, sessionKey string) (domain.Session, error) {
+	sealed, openErr := s.open(sessionKey)
+	if openErr != nil {
+		return domain.Session{}, openErr
+	}
+
+	if !sealed.ExpirationDate.After(time.Now().UTC()) {
+		return domain.Session{}, domain.ErrSessionExpired
+	}
+
+	return sealed.session(sessionKey), nil
+}
+
+// ExtendAndFetchSession opens the session and reseals it with a new expiration date, unless it is pending.
+// Sessions that were sealed with an idle timeout are extended by it instead of expirationDuration.
+// On success it returns the session with its new session key
+// On failure, it can return ErrValidSessionNotFound, ErrSessionExpired, or an unexpected error
+func (s CookieStore) ExtendAndFetchSession(ctx context.Context, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	sealed, openErr := s.open(sessionKey)
+	if openErr != nil {
+		return domain.Session{}, openErr
+	}
+
+	now := time.Now().UTC()
+	if !sealed.ExpirationDate.After(now) {
+		return domain.Session{}, domain.ErrSessionExpired
+	}
+
+	if sealed.IsPending() {
+		return sealed.session(sessionKey), nil
+	}
+
+	if sealed.IdleTimeout > 0 {
+		expirationDuration = sealed.IdleTimeout
+	}
+
+	sealed.ExpirationDate = now.Add(expirationDuration)
+	sealed.Timeout = expirationDuration
+
+	return s.seal(sealed)
+}
+
+// UpdateSessionMetadata opens the session and reseals it with the given metadata, keeping its expiration date.
+// On success it returns the session with its new session key. The old key is left valid, with the old metadata,
+// since the denylist can only end a session along with every key for it.
+// On failure, it can return ErrValidSessionNotFound or an unexpected error
+func (s CookieStore) UpdateSessionMetadata(ctx context.Context, sessionKey string, metadata domain.SessionMetadata) (domain.Session, error) {
+	sealed, openErr := s.open(sessionKey)
+	if openErr != nil {
+		return domain.Session{}, openErr
+	}
+
+	if !sealed.ExpirationDate.After(time.Now().UTC()) {
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	}
+
+	sealed.SessionMetadata = metadata
+
+	return s.seal(sealed)
+}
+
+// Denylist records ended sessions until they would have expired on their own
+type Denylist interface {
+	// Add denies the session with the given ID until the given time
+	Add(sessionID string, until time.Time) error
+	// Contains reports whether the session with the given ID is denied
+	Contains(sessionID string) (bool, error)
+}
+
+// MemoryDenylist is a Denylist kept in memory. It is only suitable for a single instance.
+type MemoryDenylist struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// NewMemoryDenylist returns an empty MemoryDenylist
+func NewMemoryDenylist() *MemoryDenylist {
+	return &MemoryDenylist{
+		entries: map[string]time.Time{},
+	}
+}
+
+// Add denies the session with the given ID until the given time, and forgets about any entries that have lapsed.
+func (d *MemoryDenylist) Add(sessionID string, until time.Time) error {
+	if sessionID == "" {
+		return errors.New("Can't deny a session without an ID")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for id, entryUntil := range d.entries {
+		if entryUntil.Before(now) {
+			delete(d.entries, id)
+		}
+	}
+
+	d.entries[sessionID] = until
+
+	return nil
+}
+
+// Contains reports whether the session with the given ID is denied
+func (d *MemoryDenylist) Contains(sessionID string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	until, ok := d.entries[sessionID]
+	if !ok {
+		return false, nil
+	}
+
+	return until.After(time.Now()), nil
+}
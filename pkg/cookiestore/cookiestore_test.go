@@ -0,0 +1,249 @@
+package cookiestore
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/securecookie"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+func newTestKeyPair() [][]byte {
+	return [][]byte{securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)}
+}
+
+// getTestObjects gives you a Store, and two random UUIDs
+func getTestObjects(t *testing.T, keyPairs ...[]byte) (CookieStore, string, string) {
+	t.Helper()
+
+	if len(keyPairs) == 0 {
+		keyPairs = newTestKeyPair()
+	}
+
+	store := NewCookieStore(NewMemoryDenylist(), keyPairs...)
+	accountID := uuid.New().String()
+	sessionKey := uuid.New().String()
+	return store, accountID, sessionKey
+}
+
+func timeIsCloseToTime(test time.Time, expected time.Time, diff time.Duration) bool {
+	lowerBound := expected.Add(-diff)
+	upperBound := expected.Add(diff)
+
+	if !(test.After(lowerBound) && test.Before(upperBound)) {
+		return false
+	}
+	return true
+}
+
+func TestCreateSessionSealsTheSession(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	expirationDuration := 5 * time.Minute
+
+	session, createErr := store.CreateSession(context.Background(), accountID, sessionKey, expirationDuration)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	if session.SessionKey == sessionKey {
+		t.Fatal("The session key should be the sealed session, not the ID we passed in")
+	}
+
+	fetchedSession, fetchErr := store.ExtendAndFetchSession(context.Background(), session.SessionKey, expirationDuration)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+
+	if fetchedSession.AccountID != accountID {
+		t.Fatal("Didn't get the expected account back", fetchedSession)
+	}
+
+	expectedExpiration := time.Now().UTC().Add(expirationDuration)
+	if !timeIsCloseToTime(fetchedSession.ExpirationDate, expectedExpiration, time.Second) {
+		t.Fatal("The returned expiration date is different from the expected", fetchedSession.ExpirationDate, expectedExpiration)
+	}
+}
+
+func TestFetchSessionExtendsValidSession(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+
+	session, createErr := store.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	longDuration := 5 * time.Hour
+	extendedSession, err := store.ExtendAndFetchSession(context.Background(), session.SessionKey, longDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLongExpiration := time.Now().UTC().Add(longDuration)
+	if !timeIsCloseToTime(extendedSession.ExpirationDate, expectedLongExpiration, time.Second) {
+		t.Fatal("The returned expiration date is different from the expected", extendedSession.ExpirationDate, expectedLongExpiration)
+	}
+
+	if extendedSession.SessionKey == session.SessionKey {
+		t.Fatal("Extending the session should have resealed it")
+	}
+}
+
+func TestFetchSessionReturnsErrorOnExpiredSession(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	expirationDuration := -10 * time.Minute
+
+	session, createErr := store.CreateSession(context.Background(), accountID, sessionKey, expirationDuration)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	_, err := store.ExtendAndFetchSession(context.Background(), session.SessionKey, expirationDuration)
+	if err != domain.ErrSessionExpired {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchSessionReturnsErrorOnGarbage(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+
+	_, err := store.ExtendAndFetchSession(context.Background(), "GARBAGE", 5*time.Minute)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal(err)
+	}
+
+	// A session sealed with somebody else's keys is just as bad
+	otherStore, _, _ := getTestObjects(t)
+	otherSession, createErr := otherStore.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	_, err = store.ExtendAndFetchSession(context.Background(), otherSession.SessionKey, 5*time.Minute)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteSessionDeniesEveryKeyForTheSession(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	expirationDuration := 5 * time.Minute
+
+	session, createErr := store.CreateSession(context.Background(), accountID, sessionKey, expirationDuration)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	extendedSession, fetchErr := store.ExtendAndFetchSession(context.Background(), session.SessionKey, expirationDuration)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+
+	delErr := store.DeleteSession(context.Background(), extendedSession.SessionKey)
+	if delErr != nil {
+		t.Fatal(delErr)
+	}
+
+	// The key from before the extension is for the same session, so it is denied as well.
+	_, err := store.ExtendAndFetchSession(context.Background(), session.SessionKey, expirationDuration)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal("the original key should be denied, got", err)
+	}
+
+	err = store.DeleteSession(context.Background(), extendedSession.SessionKey)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal("deleting twice should not find the session, got", err)
+	}
+}
+
+func TestFetchPossiblyExpiredSessionFindsNothing(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+
+	_, createErr := store.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	_, fetchErr := store.FetchPossiblyExpiredSession(context.Background(), accountID)
+	if fetchErr != sql.ErrNoRows {
+		t.Fatal(fetchErr)
+	}
+}
+
+func TestRotatedKeysStillOpenSessions(t *testing.T) {
+	oldKeys := newTestKeyPair()
+	oldStore, accountID, sessionKey := getTestObjects(t, oldKeys...)
+
+	session, createErr := oldStore.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	rotatedKeys := append(newTestKeyPair(), oldKeys...)
+	rotatedStore, _, _ := getTestObjects(t, rotatedKeys...)
+
+	extendedSession, fetchErr := rotatedStore.ExtendAndFetchSession(context.Background(), session.SessionKey, 5*time.Minute)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+
+	// The resealed session uses the new keys, so a store that only knows the old ones can't open it.
+	_, oldFetchErr := oldStore.ExtendAndFetchSession(context.Background(), extendedSession.SessionKey, 5*time.Minute)
+	if oldFetchErr != domain.ErrValidSessionNotFound {
+		t.Fatal("the session should have been resealed with the newest keys, got", oldFetchErr)
+	}
+}
+
+func TestFetchSessionWithoutExtendingKeepsTheKey(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+
+	session, createErr := store.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	fetchedSession, fetchErr := store.FetchSession(context.Background(), session.SessionKey)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+
+	if fetchedSession != session {
+		t.Fatal("Fetching should not have changed the session", fetchedSession, session)
+	}
+
+	deleteErr := store.DeleteSession(context.Background(), session.SessionKey)
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+
+	_, err := store.FetchSession(context.Background(), session.SessionKey)
+	if err != domain.ErrValidSessionNotFound {
+		t.Fatal("a deleted session should not be found, got", err)
+	}
+}
+
+func TestSessionsAreExtendedByTheirOwnIdleTimeout(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	idleTimeout := 2 * time.Minute
+
+	session, _, createErr := store.ReplaceSessionForAccount(context.Background(), accountID, sessionKey, idleTimeout, domain.NewSessionMetadata(domain.WithIdleTimeout(idleTimeout)))
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	extended, extendErr := store.ExtendAndFetchSession(context.Background(), session.SessionKey, time.Hour)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+
+	if !timeIsCloseToTime(extended.ExpirationDate, time.Now().UTC().Add(idleTimeout), time.Second) {
+		t.Fatal("Should have extended the session by its own timeout", extended.ExpirationDate)
+	}
+
+	if extended.IdleTimeout != idleTimeout {
+		t.Fatal("The session should have kept its timeout", extended.IdleTimeout)
+	}
+}
@@ -0,0 +1,138 @@
+package dbstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/trussworks/sesh/internal/seshtrace"
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// sessionHashExpression computes domain.HashSessionKey of a row's session key
+const sessionHashExpression = "left(encode(sha512(convert_to(session_key, 'UTF8')), 'hex'), 12)"
+
+// ListAccountSessions returns every stored session of an account, expired or not, including impersonations of it and
+// by it, the latest to expire first
+func (s DBStore) ListAccountSessions(ctx context.Context, accountID string) ([]domain.Session, error) {
+	listQuery := fmt.Sprintf(`SELECT %s FROM %s WHERE account_id = $1 OR actor_account_id = $1 ORDER BY expiration_date DESC`, sessionColumns, s.table)
+
+	ctx, span := s.startQuerySpan(ctx, "ListAccountSessions", listQuery)
+	sessions := []domain.Session{}
+	selectErr := s.db.SelectContext(ctx, &sessions, listQuery, accountID)
+	seshtrace.End(span, selectErr)
+	if selectErr != nil {
+		return nil, fmt.Errorf("Failed to list account sessions: %w", selectErr)
+	}
+
+	for i := range sessions {
+		sessions[i] = inUTC(sessions[i])
+	}
+
+	return sessions, nil
+}
+
+// FetchSessionByHash returns the stored session whose key has the given domain.HashSessionKey, expired or not.
+// It scans the whole table, so it is meant for the occasional lookup by an operator.
+// On failure, it can return ErrValidSessionNotFound or an unexpected error
+func (s DBStore) FetchSessionByHash(ctx context.Context, sessionHash string) (domain.Session, error) {
+	// Fetch two rows so that a collision on the truncated hash isn't mistaken for the session being looked for.
+	fetchQuery := fmt.Sprintf(`SELECT %s FROM %s WHERE %s = $1 LIMIT 2`, sessionColumns, s.table, sessionHashExpression)
+
+	ctx, span := s.startQuerySpan(ctx, "FetchSessionByHash", fetchQuery)
+	sessions := []domain.Session{}
+	selectErr := s.db.SelectContext(ctx, &sessions, fetchQuery, sessionHash)
+	if selectErr != nil {
+		seshtrace.End(span, selectErr)
+		return domain.Session{}, fmt.Errorf("Unexpected error fetching session by hash: %w", selectErr)
+	}
+
+	switch len(sessions) {
+	case 0:
+		seshtrace.End(span, domain.ErrValidSessionNotFound)
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	case 1:
+		seshtrace.End(span, nil)
+		return inUTC(sessions[0]), nil
+	default:
+		ambiguousErr := fmt.Errorf("More than one session has the hash %s", sessionHash)
+		seshtrace.End(span, ambiguousErr)
+		return domain.Session{}, ambiguousErr
+	}
+}
+
+// SessionStats summarizes the stored sessions, counting those that expire within expiringWithin as expiring soon
+// and listing up to topAccounts accounts
+func (s DBStore) SessionStats(ctx context.Context, expiringWithin time.Duration, topAccounts int) (domain.SessionStats, error) {
+	countQuery := fmt.Sprintf(`SELECT
+			count(*) FILTER (WHERE expiration_date > $1) AS active,
+			count(*) FILTER (WHERE expiration_date > $1 AND state = 'pending') AS pending,
+			count(*) FILTER (WHERE expiration_date > $1 AND actor_account_id <> '') AS impersonations,
+			count(*) FILTER (WHERE expiration_date > $1 AND expiration_date <= $2) AS expiring_soon,
+			count(*) FILTER (WHERE expiration_date <= $1) AS expired
+		FROM %s`, s.table)
+	topQuery := fmt.Sprintf(`SELECT account_id, count(*) AS sessions FROM %s
+		WHERE expiration_date > $1
+		GROUP BY account_id
+		ORDER BY sessions DESC, account_id
+		LIMIT $2`, s.table)
+
+	now := time.Now().UTC()
+
+	countCtx, countSpan := s.startQuerySpan(ctx, "SessionStats", countQuery)
+	stats := domain.SessionStats{}
+	countErr := s.db.GetContext(countCtx, &stats, countQuery, now, now.Add(expiringWithin))
+	seshtrace.End(countSpan, countErr)
+	if countErr != nil {
+		return domain.SessionStats{}, fmt.Errorf("Failed to count sessions: %w", countErr)
+	}
+
+	topCtx, topSpan := s.startQuerySpan(ctx, "SessionStats", topQuery)
+	stats.TopAccounts = []domain.AccountSessionCount{}
+	topErr := s.db.SelectContext(topCtx, &stats.TopAccounts, topQuery, now, topAccounts)
+	seshtrace.End(topSpan, topErr)
+	if topErr != nil {
+		return domain.SessionStats{}, fmt.Errorf("Failed to find the accounts with the most sessions: %w", topErr)
+	}
+
+	return stats, nil
+}
+
+// ListSessions returns every stored session, expired or not, ordered by account
+func (s DBStore) ListSessions(ctx context.Context) ([]domain.Session, error) {
+	listQuery := fmt.Sprintf(`SELECT %s FROM %s ORDER BY account_id, expiration_date DESC`, sessionColumns, s.table)
+
+	ctx, span := s.startQuerySpan(ctx, "ListSessions", listQuery)
+	sessions := []domain.Session{}
+	selectErr := s.db.SelectContext(ctx, &sessions, listQuery)
+	seshtrace.End(span, selectErr)
+	if selectErr != nil {
+		return nil, fmt.Errorf("Failed to list sessions: %w", selectErr)
+	}
+
+	for i := range sessions {
+		sessions[i] = inUTC(sessions[i])
+	}
+
+	return sessions, nil
+}
+
+// DeleteExpiredSessions removes the sessions that have expired, which are otherwise kept until their account logs in
+// again. It returns how many were removed.
+func (s DBStore) DeleteExpiredSessions(ctx context.Context) (int, error) {
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE expiration_date <= $1`, s.table)
+
+	ctx, span := s.startQuerySpan(ctx, "DeleteExpiredSessions", deleteQuery)
+	result, deleteErr := s.db.ExecContext(ctx, deleteQuery, time.Now().UTC())
+	seshtrace.End(span, deleteErr)
+	if deleteErr != nil {
+		return 0, fmt.Errorf("Failed to delete expired sessions: %w", deleteErr)
+	}
+
+	deleted, rowsErr := result.RowsAffected()
+	if rowsErr != nil {
+		return 0, fmt.Errorf("Failed to count deleted sessions: %w", rowsErr)
+	}
+
+	return int(deleted), nil
+}
@@ -1,24 +1,116 @@
 package dbstore
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/trussworks/sesh/internal/seshtrace"
 	"github.com/trussworks/sesh/pkg/domain"
 )
 
+// sessionColumns are the columns that make up a domain.Session
+const sessionColumns = "session_key, account_id, expiration_date, fingerprint, auth_level, elevated_at, state, actor_account_id, actor_session_hash, idle_timeout, epoch, actor_epoch"
+
+// DefaultTable is the table sessions are kept in unless another is given with WithTable
+const DefaultTable = "sessions"
+
+// RememberTableSuffix is appended to the name of the sessions table to name the remember me tokens table
+const RememberTableSuffix = "_remember_tokens"
+
+// EpochTableSuffix is appended to the name of the sessions table to name the account epochs table
+const EpochTableSuffix = "_account_epochs"
+
 type DBStore struct {
-	db *sqlx.DB
+	db                *sqlx.DB
+	tableName         string
+	table             string
+	rememberTable     string
+	epochTable        string
+	notifyRevocations bool
+}
+
+// Option configures optional behavior of a DBStore
+type Option func(*DBStore)
+
+// WithTable keeps sessions in the given table instead of DefaultTable. The name may be qualified with a schema,
+// as in "auth.user_sessions", in which case the schema must already exist. Each part is quoted, so it is used verbatim.
+// Pass the same option to Migrate to create the table.
+func WithTable(name string) Option {
+	return func(s *DBStore) {
+		s.tableName = name
+		s.table = quoteTable(name)
+	}
 }
 
-func NewDBStore(db *sqlx.DB) DBStore {
-	return DBStore{
-		db,
+// quoteTable quotes each part of a possibly schema qualified table name
+func quoteTable(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
 	}
+	return strings.Join(parts, ".")
+}
+
+// WithRevocationNotifications has the DBStore send a notification on RevocationChannel whenever sessions are deleted,
+// so that every instance can drop them from its cache. See ListenForRevocations.
+func WithRevocationNotifications() Option {
+	return func(s *DBStore) {
+		s.notifyRevocations = true
+	}
+}
+
+func NewDBStore(db *sqlx.DB, opts ...Option) DBStore {
+	store := DBStore{
+		db:        db,
+		tableName: DefaultTable,
+		table:     quoteTable(DefaultTable),
+	}
+
+	for _, opt := range opts {
+		opt(&store)
+	}
+
+	store.rememberTable = quoteTable(store.tableName + RememberTableSuffix)
+	store.epochTable = quoteTable(store.tableName + EpochTableSuffix)
+
+	return store
+}
+
+// inUTC sets a session's times to UTC. They come back from the db in the connection's TimeZone,
+// so we set them to UTC to be consistent.
+func inUTC(session domain.Session) domain.Session {
+	session.ExpirationDate = session.ExpirationDate.UTC()
+	session.ElevatedAt = session.ElevatedAt.UTC()
+	return session
+}
+
+// startQuerySpan starts a span for a single query on the sessions table. End it with seshtrace.End.
+func (s DBStore) startQuerySpan(ctx context.Context, operation string, query string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.startTableQuerySpan(ctx, s.tableName, operation, query, attributes...)
+}
+
+// startTableQuerySpan starts a span for a single query on the given table. End it with seshtrace.End.
+func (s DBStore) startTableQuerySpan(ctx context.Context, tableName string, operation string, query string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	attributes = append(attributes,
+		semconv.DBSystemNamePostgreSQL,
+		semconv.DBCollectionName(tableName),
+		semconv.DBOperationName(operation),
+		semconv.DBQueryText(query),
+	)
+
+	return seshtrace.Start(ctx, "sesh.DBStore."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes...),
+	)
 }
 
 func (s DBStore) Close() error {
@@ -26,29 +118,116 @@ func (s DBStore) Close() error {
 }
 
 // CreateSession creates a new session. It errors if a valid session already exists.
-func (s DBStore) CreateSession(accountID string, sessionKey string, expirationDuration time.Duration) error {
+func (s DBStore) CreateSession(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
 	expirationDate := time.Now().UTC().Add(expirationDuration)
 
-	createQuery := `INSERT INTO sessions (session_key, account_id, expiration_date)
-		VALUES ($1, $2, $3)`
+	createQuery := fmt.Sprintf(`INSERT INTO %s (session_key, account_id, expiration_date)
+		VALUES ($1, $2, $3)`, s.table)
 
-	_, createErr := s.db.Exec(createQuery, sessionKey, accountID, expirationDate)
+	ctx, span := s.startQuerySpan(ctx, "CreateSession", createQuery, seshtrace.SessionHash(sessionKey))
+	_, createErr := s.db.ExecContext(ctx, createQuery, sessionKey, accountID, expirationDate)
+	seshtrace.End(span, createErr)
 	if createErr != nil {
 
-		return fmt.Errorf("Unexpectedly failed to create a session: %w", createErr)
+		return domain.Session{}, fmt.Errorf("Unexpectedly failed to create a session: %w", createErr)
 	}
 
-	return nil
+	session := domain.Session{
+		AccountID:      accountID,
+		SessionKey:     sessionKey,
+		ExpirationDate: expirationDate,
+	}
+
+	return session, nil
+}
+
+// ReplaceSessionForAccount creates a new session for an account, replacing its current session if it has one.
+// Concurrent logins for the same account are serialized with an advisory lock, so the last one wins and
+// each one gets back the session it actually replaced. An impersonation session only replaces the same actor's
+// impersonation of the account, never the account's own session, and a pending session only replaces the account's
+// pending session.
+func (s DBStore) ReplaceSessionForAccount(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration, metadata domain.SessionMetadata) (domain.Session, *domain.Session, error) {
+	expirationDate := time.Now().UTC().Add(expirationDuration)
+	if metadata.State == "" {
+		metadata.State = domain.SessionStateActive
+	}
+
+	tx, beginErr := s.db.BeginTxx(ctx, nil)
+	if beginErr != nil {
+		return domain.Session{}, nil, fmt.Errorf("Failed to begin replacing a session: %w", beginErr)
+	}
+	defer tx.Rollback()
+
+	lockQuery := `SELECT pg_advisory_xact_lock(hashtext($1))`
+
+	lockCtx, span := s.startQuerySpan(ctx, "LockAccount", lockQuery)
+	_, lockErr := tx.ExecContext(lockCtx, lockQuery, s.tableName+":"+accountID)
+	seshtrace.End(span, lockErr)
+	if lockErr != nil {
+		return domain.Session{}, nil, fmt.Errorf("Failed to lock the account's session: %w", lockErr)
+	}
+
+	fetchQuery := fmt.Sprintf(`SELECT %s FROM %s WHERE account_id = $1 AND actor_account_id = $2 AND state = $3`, sessionColumns, s.table)
+
+	fetchCtx, span := s.startQuerySpan(ctx, "FetchPossiblyExpiredSession", fetchQuery)
+	var replaced *domain.Session
+	extantSession := domain.Session{}
+	selectErr := tx.GetContext(fetchCtx, &extantSession, fetchQuery, accountID, metadata.ActorAccountID, metadata.State)
+	seshtrace.End(span, selectErr)
+	if selectErr == nil {
+		extantSession = inUTC(extantSession)
+		replaced = &extantSession
+	} else if selectErr != sql.ErrNoRows {
+		return domain.Session{}, nil, fmt.Errorf("Failed to fetch a session row: %w", selectErr)
+	}
+
+	upsertQuery := fmt.Sprintf(`INSERT INTO %s (%s)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (account_id, actor_account_id, state) DO UPDATE
+			SET session_key = EXCLUDED.session_key, expiration_date = EXCLUDED.expiration_date, fingerprint = EXCLUDED.fingerprint,
+				auth_level = EXCLUDED.auth_level, elevated_at = EXCLUDED.elevated_at,
+				actor_session_hash = EXCLUDED.actor_session_hash, idle_timeout = EXCLUDED.idle_timeout, epoch = EXCLUDED.epoch,
+				actor_epoch = EXCLUDED.actor_epoch`, s.table, sessionColumns)
+
+	upsertCtx, span := s.startQuerySpan(ctx, "ReplaceSessionForAccount", upsertQuery, seshtrace.SessionHash(sessionKey))
+	_, upsertErr := tx.ExecContext(upsertCtx, upsertQuery, sessionKey, accountID, expirationDate, metadata.Fingerprint, metadata.AuthLevel, metadata.ElevatedAt, metadata.State, metadata.ActorAccountID, metadata.ActorSessionHash, metadata.IdleTimeout, metadata.Epoch, metadata.ActorEpoch)
+	seshtrace.End(span, upsertErr)
+	if upsertErr != nil {
+		return domain.Session{}, nil, fmt.Errorf("Unexpectedly failed to create a session: %w", upsertErr)
+	}
+
+	if replaced != nil && s.notifyRevocations {
+		notifyErr := s.notifyRevocation(ctx, tx, domain.Revocation{SessionHash: domain.HashSessionKey(replaced.SessionKey), AccountID: accountID})
+		if notifyErr != nil {
+			return domain.Session{}, nil, notifyErr
+		}
+	}
+
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		return domain.Session{}, nil, fmt.Errorf("Failed to commit the new session: %w", commitErr)
+	}
+
+	session := domain.Session{
+		AccountID:       accountID,
+		SessionKey:      sessionKey,
+		ExpirationDate:  expirationDate,
+		SessionMetadata: metadata,
+	}
+
+	return session, replaced, nil
 }
 
 // FetchPossiblyExpiredSession returns a session row by account ID regardless of wether it is expired
 // This is potentially dangerous, it is only intended to be used during the new login flow, never to check
 // on a valid session for authentication purposes.
-func (s DBStore) FetchPossiblyExpiredSession(accountID string) (domain.Session, error) {
-	fetchQuery := `SELECT * FROM sessions WHERE account_id = $1`
+func (s DBStore) FetchPossiblyExpiredSession(ctx context.Context, accountID string) (domain.Session, error) {
+	fetchQuery := fmt.Sprintf(`SELECT %s FROM %s WHERE account_id = $1 AND actor_account_id = '' AND state = 'active'`, sessionColumns, s.table)
 
+	ctx, span := s.startQuerySpan(ctx, "FetchPossiblyExpiredSession", fetchQuery)
 	session := domain.Session{}
-	selectErr := s.db.Get(&session, fetchQuery, accountID)
+	selectErr := s.db.GetContext(ctx, &session, fetchQuery, accountID)
+	seshtrace.End(span, selectErr)
 	if selectErr != nil {
 		if selectErr == sql.ErrNoRows {
 			return domain.Session{}, sql.ErrNoRows
@@ -56,44 +235,138 @@ func (s DBStore) FetchPossiblyExpiredSession(accountID string) (domain.Session,
 		return domain.Session{}, fmt.Errorf("Failed to fetch a session row: %w", selectErr)
 	}
 
-	return session, nil
-
+	return inUTC(session), nil
 }
 
 // DeleteSession removes a session record from the db
-func (s DBStore) DeleteSession(sessionKey string) error {
-	deleteQuery := "DELETE FROM sessions WHERE session_key = $1"
+func (s DBStore) DeleteSession(ctx context.Context, sessionKey string) error {
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE session_key = $1 RETURNING account_id`, s.table)
 
-	sqlResult, deleteErr := s.db.Exec(deleteQuery, sessionKey)
+	revocation := domain.Revocation{SessionHash: domain.HashSessionKey(sessionKey)}
+	deleted, deleteErr := s.deleteSessions(ctx, "DeleteSession", deleteQuery, sessionKey, &revocation, seshtrace.SessionHash(sessionKey))
 	if deleteErr != nil {
 		return fmt.Errorf("Failed to delete session: %w", deleteErr)
 	}
 
-	rowsAffected, _ := sqlResult.RowsAffected()
-	if rowsAffected == 0 {
+	if deleted == 0 {
 		return domain.ErrValidSessionNotFound
 	}
 
 	return nil
 }
 
-// ExtendAndFetchSession fetches session data from the db
+// DeleteAccountSessions removes every session of an account from the db, including its impersonations of other
+// accounts. It is not an error if there are none.
+func (s DBStore) DeleteAccountSessions(ctx context.Context, accountID string) error {
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE account_id = $1 OR actor_account_id = $1 RETURNING account_id`, s.table)
+
+	revocation := domain.Revocation{AccountID: accountID}
+	_, deleteErr := s.deleteSessions(ctx, "DeleteAccountSessions", deleteQuery, accountID, &revocation)
+	if deleteErr != nil {
+		return fmt.Errorf("Failed to delete account sessions: %w", deleteErr)
+	}
+
+	return nil
+}
+
+// deleteSessions runs a delete query that returns the account_id of each deleted row and returns how many were deleted.
+// If revocation notifications are on, the revocation is sent in the same transaction, once, with its AccountID filled in
+// if it wasn't set.
+func (s DBStore) deleteSessions(ctx context.Context, operation string, deleteQuery string, arg string, revocation *domain.Revocation, attributes ...attribute.KeyValue) (int, error) {
+	var queryer sqlx.ExtContext = s.db
+	var tx *sqlx.Tx
+	if s.notifyRevocations {
+		var beginErr error
+		tx, beginErr = s.db.BeginTxx(ctx, nil)
+		if beginErr != nil {
+			return 0, beginErr
+		}
+		defer tx.Rollback()
+		queryer = tx
+	}
+
+	deleteCtx, span := s.startQuerySpan(ctx, operation, deleteQuery, attributes...)
+	accountIDs := []string{}
+	deleteErr := sqlx.SelectContext(deleteCtx, queryer, &accountIDs, deleteQuery, arg)
+	seshtrace.End(span, deleteErr)
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+
+	if tx == nil || len(accountIDs) == 0 {
+		return len(accountIDs), nil
+	}
+
+	if revocation.AccountID == "" {
+		revocation.AccountID = accountIDs[0]
+	}
+	notifyErr := s.notifyRevocation(ctx, tx, *revocation)
+	if notifyErr != nil {
+		return 0, notifyErr
+	}
+
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		return 0, commitErr
+	}
+
+	return len(accountIDs), nil
+}
+
+// FetchSession fetches a valid session from the db without extending it
+// On failure, it can return ErrValidSessionNotFound, ErrSessionExpired, or an unexpected error
+func (s DBStore) FetchSession(ctx context.Context, sessionKey string) (domain.Session, error) {
+	fetchQuery := fmt.Sprintf(`SELECT %s FROM %s WHERE session_key = $1`, sessionColumns, s.table)
+
+	ctx, span := s.startQuerySpan(ctx, "FetchSession", fetchQuery, seshtrace.SessionHash(sessionKey))
+	session := domain.Session{}
+	selectErr := s.db.GetContext(ctx, &session, fetchQuery, sessionKey)
+	if selectErr != nil {
+		if selectErr == sql.ErrNoRows {
+			seshtrace.End(span, domain.ErrValidSessionNotFound)
+			return domain.Session{}, domain.ErrValidSessionNotFound
+		}
+		seshtrace.End(span, selectErr)
+		return domain.Session{}, fmt.Errorf("Unexpected error fetching session: %w", selectErr)
+	}
+
+	session = inUTC(session)
+	if !session.ExpirationDate.After(time.Now().UTC()) {
+		seshtrace.End(span, domain.ErrSessionExpired)
+		return domain.Session{}, domain.ErrSessionExpired
+	}
+
+	seshtrace.End(span, nil)
+	return session, nil
+}
+
+// ExtendAndFetchSession fetches session data from the db, extending it by its own idle timeout, or by
+// expirationDuration if it was stored without one.
 // On success it returns the session
 // On failure, it can return ErrValidSessionNotFound, ErrSessionExpired, or an unexpected error
-func (s DBStore) ExtendAndFetchSession(sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
-	expirationDate := time.Now().UTC().Add(expirationDuration)
+func (s DBStore) ExtendAndFetchSession(ctx context.Context, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	now := time.Now().UTC()
+	expirationDate := now.Add(expirationDuration)
 
-	// We update the session expiration date to be $DURATION from now and fetch the account and the session.
-	fetchQuery := `UPDATE sessions
-					SET expiration_date = $1
+	// We update the session expiration date to be its idle timeout, or $DURATION, from now and fetch the account and
+	// the session. idle_timeout is in nanoseconds, like a time.Duration.
+	// Pending sessions keep their expiration date, they are only meant to last long enough to finish logging in.
+	fetchQuery := fmt.Sprintf(`UPDATE %s
+					SET expiration_date = CASE
+						WHEN state = 'pending' THEN expiration_date
+						WHEN idle_timeout > 0 THEN $3 + idle_timeout / 1000 * interval '1 microsecond'
+						ELSE $1
+					END
 				WHERE
 					session_key = $2
 					AND expiration_date > $3
 				RETURNING
-					session_key, account_id, expiration_date`
+					%s`, s.table, sessionColumns)
 
+	extendCtx, span := s.startQuerySpan(ctx, "ExtendAndFetchSession", fetchQuery, seshtrace.SessionHash(sessionKey))
 	session := domain.Session{}
-	selectErr := s.db.Get(&session, fetchQuery, expirationDate, sessionKey, time.Now().UTC())
+	selectErr := s.db.GetContext(extendCtx, &session, fetchQuery, expirationDate, sessionKey, now)
+	seshtrace.End(span, selectErr)
 	if selectErr != nil {
 		if selectErr != sql.ErrNoRows {
 			return domain.Session{}, fmt.Errorf("Unexpected error looking for valid session: %w", selectErr)
@@ -101,10 +374,12 @@ func (s DBStore) ExtendAndFetchSession(sessionKey string, expirationDuration tim
 
 		// If the above query returns no rows, either the session is expired, or it does not exist.
 		// To determine which and return an appropriate error, we do a second query to see if it exists
-		existsQuery := `SELECT * FROM sessions WHERE session_key = $1`
+		existsQuery := fmt.Sprintf(`SELECT %s FROM %s WHERE session_key = $1`, sessionColumns, s.table)
 
+		existsCtx, span := s.startQuerySpan(ctx, "FetchInvalidSession", existsQuery, seshtrace.SessionHash(sessionKey))
 		session := domain.Session{}
-		selectAgainErr := s.db.Get(&session, existsQuery, sessionKey)
+		selectAgainErr := s.db.GetContext(existsCtx, &session, existsQuery, sessionKey)
+		seshtrace.End(span, selectAgainErr)
 		if selectAgainErr != nil {
 			if selectAgainErr == sql.ErrNoRows {
 				return domain.Session{}, domain.ErrValidSessionNotFound
@@ -112,18 +387,76 @@ func (s DBStore) ExtendAndFetchSession(sessionKey string, expirationDuration tim
 			return domain.Session{}, fmt.Errorf("Unexpected error fetching single invalid session: %w", selectAgainErr)
 		}
 
-		// quick sanity check:
-		if session.ExpirationDate.After(time.Now()) {
-			errors.New(fmt.Sprintf("For some reason, this session we could not find was not actually expired: %s", session.SessionKey))
-		}
 		// The session must have been expired, not deleted.
 		return domain.Session{}, domain.ErrSessionExpired
 	}
 
-	// time.Times come back from the db with no tz info, so let's set it to UTC to be safe and consistent.
-	session.ExpirationDate = session.ExpirationDate.UTC()
+	return inUTC(session), nil
+}
 
-	fmt.Printf("NO ERROR %+v\n", session)
+// UpdateSessionMetadata replaces the metadata of a valid session without extending it
+// If revocation notifications are on, the update is sent like a revocation of the session, so that every instance
+// drops its cached copy.
+// On failure, it can return ErrValidSessionNotFound or an unexpected error
+func (s DBStore) UpdateSessionMetadata(ctx context.Context, sessionKey string, metadata domain.SessionMetadata) (domain.Session, error) {
+	var queryer sqlx.ExtContext = s.db
+	var tx *sqlx.Tx
+	if s.notifyRevocations {
+		var beginErr error
+		tx, beginErr = s.db.BeginTxx(ctx, nil)
+		if beginErr != nil {
+			return domain.Session{}, fmt.Errorf("Failed to begin updating a session: %w", beginErr)
+		}
+		defer tx.Rollback()
+		queryer = tx
+	}
 
-	return session, nil
+	updateQuery := fmt.Sprintf(`UPDATE %s
+					SET fingerprint = $1, auth_level = $2, elevated_at = $3, state = $4, actor_account_id = $5, actor_session_hash = $6,
+						idle_timeout = $7
+				WHERE
+					session_key = $8
+					AND expiration_date > $9
+				RETURNING
+					%s`, s.table, sessionColumns)
+
+	updateCtx, span := s.startQuerySpan(ctx, "UpdateSessionMetadata", updateQuery, seshtrace.SessionHash(sessionKey))
+	session := domain.Session{}
+	updateErr := sqlx.GetContext(updateCtx, queryer, &session, updateQuery, metadata.Fingerprint, metadata.AuthLevel, metadata.ElevatedAt, metadata.State, metadata.ActorAccountID, metadata.ActorSessionHash, metadata.IdleTimeout, sessionKey, time.Now().UTC())
+	if updateErr != nil {
+		if updateErr == sql.ErrNoRows {
+			seshtrace.End(span, domain.ErrValidSessionNotFound)
+			return domain.Session{}, domain.ErrValidSessionNotFound
+		}
+		seshtrace.End(span, updateErr)
+		return domain.Session{}, fmt.Errorf("Unexpected error updating session: %w", updateErr)
+	}
+	seshtrace.End(span, nil)
+
+	if tx != nil {
+		notifyErr := s.notifyRevocation(ctx, tx, domain.Revocation{SessionHash: domain.HashSessionKey(sessionKey), AccountID: session.AccountID})
+		if notifyErr != nil {
+			return domain.Session{}, notifyErr
+		}
+
+		commitErr := tx.Commit()
+		if commitErr != nil {
+			return domain.Session{}, fmt.Errorf("Failed to commit the session update: %w", commitErr)
+		}
+	}
+
+	return inUTC(session), nil
+}
+
+// CountActiveSessions returns the number of sessions that have not yet expired
+func (s DBStore) CountActiveSessions() (int, error) {
+	countQuery := fmt.Sprintf(`SELECT count(*) FROM %s WHERE expiration_date > $1`, s.table)
+
+	var count int
+	countErr := s.db.Get(&count, countQuery, time.Now().UTC())
+	if countErr != nil {
+		return 0, fmt.Errorf("Failed to count active sessions: %w", countErr)
+	}
+
+	return count, nil
 }
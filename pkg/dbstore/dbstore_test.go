@@ -1,17 +1,22 @@
 package dbstore
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/session"
 )
 
 func dbURLFromEnv() string {
@@ -26,15 +31,28 @@ func dbURLFromEnv() string {
 	return connStr
 }
 
-func getTestStore() (DBStore, error) {
-	connStr := dbURLFromEnv()
+func getTestStore(opts ...Option) (DBStore, error) {
+	return getTestStoreWithURL(dbURLFromEnv(), opts...)
+}
+
+// getTestStoreInTimeZone connects with the TimeZone of the db session set to timeZone
+func getTestStoreInTimeZone(timeZone string, opts ...Option) (DBStore, error) {
+	return getTestStoreWithURL(dbURLFromEnv()+"&TimeZone="+url.QueryEscape(timeZone), opts...)
+}
+
+func getTestStoreWithURL(connStr string, opts ...Option) (DBStore, error) {
 
 	connection, err := sqlx.Open("postgres", connStr)
 	if err != nil {
 		return DBStore{}, fmt.Errorf("error connecting to database using sqlx.Open: %w", err)
 	}
 
-	return NewDBStore(connection), nil
+	migrateErr := Migrate(context.Background(), connection)
+	if migrateErr != nil {
+		return DBStore{}, fmt.Errorf("error migrating the test database: %w", migrateErr)
+	}
+
+	return NewDBStore(connection, opts...), nil
 
 }
 
@@ -65,18 +83,18 @@ func TestFetchExistingSessionToOverwrite(t *testing.T) {
 	store, accountID, firstSessionKey := getTestObjects(t)
 	expirationDuration := 5 * time.Minute
 
-	firstCreateErr := store.CreateSession(accountID, firstSessionKey, expirationDuration)
+	_, firstCreateErr := store.CreateSession(context.Background(), accountID, firstSessionKey, expirationDuration)
 	if firstCreateErr != nil {
 		t.Fatal(firstCreateErr)
 	}
 
-	firstSession, fetchErr := store.ExtendAndFetchSession(firstSessionKey, expirationDuration)
+	firstSession, fetchErr := store.ExtendAndFetchSession(context.Background(), firstSessionKey, expirationDuration)
 	if fetchErr != nil {
 		t.Fatal(fetchErr)
 	}
 
 	// Duplicate what we do in Sessions.UserDidAuth
-	fetchedSession, fetchErr := store.FetchPossiblyExpiredSession(accountID)
+	fetchedSession, fetchErr := store.FetchPossiblyExpiredSession(context.Background(), accountID)
 	if fetchErr != nil {
 		t.Fatal(fetchErr)
 	}
@@ -85,18 +103,18 @@ func TestFetchExistingSessionToOverwrite(t *testing.T) {
 		t.Fatal("Didn't get the same session back!")
 	}
 
-	delErr := store.DeleteSession(firstSessionKey)
+	delErr := store.DeleteSession(context.Background(), firstSessionKey)
 	if delErr != nil {
 		t.Fatal(delErr)
 	}
 
 	secondSessionKey := uuid.New().String()
-	secondCreateErr := store.CreateSession(accountID, secondSessionKey, expirationDuration)
+	_, secondCreateErr := store.CreateSession(context.Background(), accountID, secondSessionKey, expirationDuration)
 	if secondCreateErr != nil {
 		t.Fatal(secondCreateErr)
 	}
 
-	secondSession, fetchErr := store.ExtendAndFetchSession(secondSessionKey, expirationDuration)
+	secondSession, fetchErr := store.ExtendAndFetchSession(context.Background(), secondSessionKey, expirationDuration)
 	if fetchErr != nil {
 		t.Fatal(fetchErr)
 	}
@@ -105,7 +123,7 @@ func TestFetchExistingSessionToOverwrite(t *testing.T) {
 		t.Fatal("both fetches should return the same account")
 	}
 
-	_, expectedFetchErr := store.ExtendAndFetchSession(firstSessionKey, expirationDuration)
+	_, expectedFetchErr := store.ExtendAndFetchSession(context.Background(), firstSessionKey, expirationDuration)
 	if expectedFetchErr != domain.ErrValidSessionNotFound {
 		t.Fatal("using the first session key should cause an error to be thrown, since it has been overwritten, got", expectedFetchErr)
 	}
@@ -115,12 +133,12 @@ func TestFetchSessionReturnsAccountAndSessionOnValidSession(t *testing.T) {
 	store, accountID, sessionKey := getTestObjects(t)
 	expirationDuration := 5 * time.Minute
 
-	createErr := store.CreateSession(accountID, sessionKey, expirationDuration)
+	_, createErr := store.CreateSession(context.Background(), accountID, sessionKey, expirationDuration)
 	if createErr != nil {
 		t.Fatal(createErr)
 	}
 
-	actualSession, err := store.ExtendAndFetchSession(sessionKey, expirationDuration)
+	actualSession, err := store.ExtendAndFetchSession(context.Background(), sessionKey, expirationDuration)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,12 +163,12 @@ func TestFetchSessionExtendsValidSession(t *testing.T) {
 
 	shortInitialDuration := 5 * time.Minute
 
-	createErr := store.CreateSession(accountID, sessionKey, shortInitialDuration)
+	_, createErr := store.CreateSession(context.Background(), accountID, sessionKey, shortInitialDuration)
 	if createErr != nil {
 		t.Fatal(createErr)
 	}
 
-	session, err := store.ExtendAndFetchSession(sessionKey, shortInitialDuration)
+	session, err := store.ExtendAndFetchSession(context.Background(), sessionKey, shortInitialDuration)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,7 +179,7 @@ func TestFetchSessionExtendsValidSession(t *testing.T) {
 	}
 
 	longDuration := 5 * time.Hour
-	secondSession, err := store.ExtendAndFetchSession(sessionKey, longDuration)
+	secondSession, err := store.ExtendAndFetchSession(context.Background(), sessionKey, longDuration)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -177,21 +195,55 @@ func TestFetchSessionReturnsErrorOnExpiredSession(t *testing.T) {
 	store, accountID, sessionKey := getTestObjects(t)
 	expirationDuration := -10 * time.Minute
 
-	createErr := store.CreateSession(accountID, sessionKey, expirationDuration)
+	_, createErr := store.CreateSession(context.Background(), accountID, sessionKey, expirationDuration)
 	if createErr != nil {
 		t.Fatal(createErr)
 	}
 
-	_, err := store.ExtendAndFetchSession(sessionKey, expirationDuration)
+	_, err := store.ExtendAndFetchSession(context.Background(), sessionKey, expirationDuration)
 	if err != domain.ErrSessionExpired {
 		t.Fatal(err)
 	}
 }
 
+func TestFetchSessionDoesNotExtend(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+
+	created, createErr := store.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	session, fetchErr := store.FetchSession(context.Background(), sessionKey)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+
+	if !timeIsCloseToTime(session.ExpirationDate, created.ExpirationDate, time.Millisecond) {
+		t.Fatal("Fetching should not have changed the expiration date", session.ExpirationDate, created.ExpirationDate)
+	}
+
+	expiredSessionKey := uuid.New().String()
+	_, expiredCreateErr := store.CreateSession(context.Background(), uuid.New().String(), expiredSessionKey, -10*time.Minute)
+	if expiredCreateErr != nil {
+		t.Fatal(expiredCreateErr)
+	}
+
+	_, expiredErr := store.FetchSession(context.Background(), expiredSessionKey)
+	if expiredErr != domain.ErrSessionExpired {
+		t.Fatal(expiredErr)
+	}
+
+	_, missingErr := store.FetchSession(context.Background(), uuid.New().String())
+	if missingErr != domain.ErrValidSessionNotFound {
+		t.Fatal(missingErr)
+	}
+}
+
 func TestDeleteSessionRemovesRecord(t *testing.T) {
 	store, accountID, sessionKey := getTestObjects(t)
 	expirationDuration := 5 * time.Minute
-	store.CreateSession(accountID, sessionKey, expirationDuration)
+	store.CreateSession(context.Background(), accountID, sessionKey, expirationDuration)
 
 	fetchQuery := `SELECT * FROM sessions WHERE session_key = $1`
 	row := domain.Session{}
@@ -200,7 +252,7 @@ func TestDeleteSessionRemovesRecord(t *testing.T) {
 		t.Fatal("new session should have been created")
 	}
 
-	err := store.DeleteSession(sessionKey)
+	err := store.DeleteSession(context.Background(), sessionKey)
 	if err != nil {
 		t.Fatal("encountered issue when trinyg to delete session")
 	}
@@ -220,12 +272,762 @@ func TestDeleteSessionReturnsErrIfSessionNotFound(t *testing.T) {
 	defer store.Close()
 	sessionKeyWithNoAssociatedRecord := uuid.New().String()
 
-	err := store.DeleteSession(sessionKeyWithNoAssociatedRecord)
+	err := store.DeleteSession(context.Background(), sessionKeyWithNoAssociatedRecord)
 	if err != domain.ErrValidSessionNotFound {
 		t.Fatal("session should not exist")
 	}
 }
 
+func TestDeletesNotifyRevocations(t *testing.T) {
+	store, storeErr := getTestStore(WithRevocationNotifications())
+	if storeErr != nil {
+		t.Fatal(storeErr)
+	}
+	defer store.Close()
+
+	// The listener retries forever, so make sure there is a db to connect to first
+	pingErr := store.db.Ping()
+	if pingErr != nil {
+		t.Fatal(pingErr)
+	}
+
+	listener := pq.NewListener(dbURLFromEnv(), time.Second, time.Second, nil)
+	defer listener.Close()
+	listenErr := listener.Listen(RevocationChannel)
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+
+	accountID, sessionKey := uuid.New().String(), uuid.New().String()
+	nextRevocation := func() domain.Revocation {
+		t.Helper()
+		select {
+		case notification := <-listener.Notify:
+			if strings.Contains(notification.Extra, sessionKey) {
+				t.Fatal("Revocations should not hold session keys", notification.Extra)
+			}
+			revocation := domain.Revocation{}
+			decodeErr := json.Unmarshal([]byte(notification.Extra), &revocation)
+			if decodeErr != nil {
+				t.Fatal(decodeErr)
+			}
+			return revocation
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a revocation")
+		}
+		return domain.Revocation{}
+	}
+
+	_, createErr := store.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	deleteErr := store.DeleteSession(context.Background(), sessionKey)
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+
+	revocation := nextRevocation()
+	if revocation.SessionHash != domain.HashSessionKey(sessionKey) || revocation.AccountID != accountID {
+		t.Fatal("Should have been notified that the session was deleted", revocation)
+	}
+
+	otherAccountID := uuid.New().String()
+	_, createErr = store.CreateSession(context.Background(), otherAccountID, uuid.New().String(), 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	deleteErr = store.DeleteAccountSessions(context.Background(), otherAccountID)
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+
+	revocation = nextRevocation()
+	if revocation.SessionHash != "" || revocation.AccountID != otherAccountID {
+		t.Fatal("Should have been notified that the account's sessions were deleted", revocation)
+	}
+
+	_, fetchErr := store.FetchPossiblyExpiredSession(context.Background(), otherAccountID)
+	if fetchErr != sql.ErrNoRows {
+		t.Fatal("The account's session should be gone", fetchErr)
+	}
+}
+
+func TestMigrationsAreVersioned(t *testing.T) {
+	migrations, loadErr := loadMigrations()
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	if len(migrations) == 0 || migrations[0].version != 1 {
+		t.Fatal("The first migration should be version 1", migrations)
+	}
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version <= migrations[i-1].version {
+			t.Fatal("Migrations should be in version order", migrations[i-1].name, migrations[i].name)
+		}
+	}
+}
+
+func TestMigrateRecordsAppliedVersions(t *testing.T) {
+	store, storeErr := getTestStore()
+	if storeErr != nil {
+		t.Fatal(storeErr)
+	}
+	defer store.Close()
+
+	// getTestStore has already migrated, so this should have nothing left to do.
+	migrateErr := Migrate(context.Background(), store.db)
+	if migrateErr != nil {
+		t.Fatal(migrateErr)
+	}
+
+	migrations, loadErr := loadMigrations()
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	var appliedCount int
+	countErr := store.db.Get(&appliedCount, `SELECT count(*) FROM sesh_schema_migrations WHERE sessions_table = $1`, DefaultTable)
+	if countErr != nil {
+		t.Fatal(countErr)
+	}
+
+	if appliedCount != len(migrations) {
+		t.Fatal("Every migration should have been recorded exactly once", appliedCount, len(migrations))
+	}
+}
+
+func TestTableNamesAreQuoted(t *testing.T) {
+	store := NewDBStore(nil, WithTable(`auth.user "sessions"`))
+
+	if store.table != `"auth"."user ""sessions"""` {
+		t.Fatal("Each part of the table name should be quoted", store.table)
+	}
+
+	migrations, loadErr := loadMigrations()
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	statements, renderErr := migrations[0].sql(store)
+	if renderErr != nil {
+		t.Fatal(renderErr)
+	}
+
+	if !strings.Contains(statements, `CREATE TABLE IF NOT EXISTS "auth"."user ""sessions"""(`) {
+		t.Fatal("The migration should create the configured table", statements)
+	}
+}
+
+func TestStoresWithDifferentTablesAreIndependent(t *testing.T) {
+	store, storeErr := getTestStore()
+	if storeErr != nil {
+		t.Fatal(storeErr)
+	}
+	defer store.Close()
+
+	_, schemaErr := store.db.Exec(`CREATE SCHEMA IF NOT EXISTS sesh_test`)
+	if schemaErr != nil {
+		t.Fatal(schemaErr)
+	}
+
+	tableOption := WithTable("sesh_test.admin sessions")
+	migrateErr := Migrate(context.Background(), store.db, tableOption)
+	if migrateErr != nil {
+		t.Fatal(migrateErr)
+	}
+	adminStore := NewDBStore(store.db, tableOption)
+
+	accountID, sessionKey := uuid.New().String(), uuid.New().String()
+	_, createErr := adminStore.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	// The same account can have a session in each table
+	_, createErr = store.CreateSession(context.Background(), accountID, uuid.New().String(), 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	_, fetchErr := store.ExtendAndFetchSession(context.Background(), sessionKey, 5*time.Minute)
+	if fetchErr != domain.ErrValidSessionNotFound {
+		t.Fatal("The default store should not see the admin store's session", fetchErr)
+	}
+
+	adminSession, adminFetchErr := adminStore.ExtendAndFetchSession(context.Background(), sessionKey, 5*time.Minute)
+	if adminFetchErr != nil {
+		t.Fatal(adminFetchErr)
+	}
+
+	if adminSession.AccountID != accountID {
+		t.Fatal("Got the wrong session back", adminSession)
+	}
+
+	deleteErr := adminStore.DeleteSession(context.Background(), sessionKey)
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+}
+
+func TestSessionsWorkInAnyTimeZone(t *testing.T) {
+	utcStore, storeErr := getTestStore()
+	if storeErr != nil {
+		t.Fatal(storeErr)
+	}
+	defer utcStore.Close()
+
+	for _, timeZone := range []string{"Pacific/Auckland", "America/Los_Angeles"} {
+		store, storeErr := getTestStoreInTimeZone(timeZone)
+		if storeErr != nil {
+			t.Fatal(storeErr)
+		}
+		defer store.Close()
+
+		var sessionTimeZone string
+		settingErr := store.db.Get(&sessionTimeZone, `SELECT current_setting('TimeZone')`)
+		if settingErr != nil {
+			t.Fatal(settingErr)
+		}
+		if sessionTimeZone != timeZone {
+			t.Fatal("The test connection should be in the requested time zone", sessionTimeZone, timeZone)
+		}
+
+		accountID, sessionKey := uuid.New().String(), uuid.New().String()
+		created, createErr := store.CreateSession(context.Background(), accountID, sessionKey, 5*time.Minute)
+		if createErr != nil {
+			t.Fatal(createErr)
+		}
+
+		fetched, fetchErr := store.FetchPossiblyExpiredSession(context.Background(), accountID)
+		if fetchErr != nil {
+			t.Fatal(fetchErr)
+		}
+		if !fetched.ExpirationDate.Equal(created.ExpirationDate.Truncate(time.Microsecond)) || fetched.ExpirationDate.Location() != time.UTC {
+			t.Fatal("Should have read back the same instant, in UTC", timeZone, fetched.ExpirationDate, created.ExpirationDate)
+		}
+
+		// A connection in another time zone sees the same instant
+		utcFetched, utcFetchErr := utcStore.FetchSession(context.Background(), sessionKey)
+		if utcFetchErr != nil {
+			t.Fatal(utcFetchErr)
+		}
+		if !utcFetched.ExpirationDate.Equal(fetched.ExpirationDate) {
+			t.Fatal("Every connection should see the same expiration date", timeZone, utcFetched.ExpirationDate, fetched.ExpirationDate)
+		}
+
+		extended, extendErr := store.ExtendAndFetchSession(context.Background(), sessionKey, time.Hour)
+		if extendErr != nil {
+			t.Fatal(extendErr)
+		}
+		if !timeIsCloseToTime(extended.ExpirationDate, time.Now().Add(time.Hour), time.Second) {
+			t.Fatal("The session should have been extended by an hour", timeZone, extended.ExpirationDate)
+		}
+
+		// A session that expired a minute ago is expired no matter how far the time zone is from UTC
+		expiredKey := uuid.New().String()
+		_, expiredCreateErr := store.CreateSession(context.Background(), uuid.New().String(), expiredKey, -time.Minute)
+		if expiredCreateErr != nil {
+			t.Fatal(expiredCreateErr)
+		}
+
+		_, expiredErr := store.ExtendAndFetchSession(context.Background(), expiredKey, 5*time.Minute)
+		if expiredErr != domain.ErrSessionExpired {
+			t.Fatal("The session should be expired", timeZone, expiredErr)
+		}
+
+		_, expiredErr = store.FetchSession(context.Background(), expiredKey)
+		if expiredErr != domain.ErrSessionExpired {
+			t.Fatal("The session should be expired", timeZone, expiredErr)
+		}
+	}
+}
+
+func TestConcurrentLoginsReplaceEachOther(t *testing.T) {
+	store, accountID, _ := getTestObjects(t)
+	defer store.Close()
+
+	logins := 10
+	type result struct {
+		session  domain.Session
+		replaced *domain.Session
+		err      error
+	}
+	results := make(chan result, logins)
+
+	for i := 0; i < logins; i++ {
+		go func() {
+			session, replaced, err := store.ReplaceSessionForAccount(context.Background(), accountID, uuid.New().String(), 5*time.Minute, domain.SessionMetadata{})
+			results <- result{session, replaced, err}
+		}()
+	}
+
+	created := map[string]bool{}
+	replaced := map[string]bool{}
+	firstLogins := 0
+	for i := 0; i < logins; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal("Concurrent logins should not fail", r.err)
+		}
+		created[r.session.SessionKey] = true
+		if r.replaced == nil {
+			firstLogins++
+		} else {
+			replaced[r.replaced.SessionKey] = true
+		}
+	}
+
+	if firstLogins != 1 {
+		t.Fatal("Exactly one login should have found no session to replace", firstLogins)
+	}
+
+	// Every session but the last one to be created was replaced by another login
+	if len(replaced) != logins-1 {
+		t.Fatal("Each login should have replaced a different session", len(replaced))
+	}
+
+	current, fetchErr := store.FetchPossiblyExpiredSession(context.Background(), accountID)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+
+	if !created[current.SessionKey] || replaced[current.SessionKey] {
+		t.Fatal("The remaining session should be the one that wasn't replaced", current)
+	}
+}
+
+func TestSessionMetadataIsStored(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	metadata := domain.NewSessionMetadata(domain.WithFingerprint("FINGERPRINT"), domain.WithAuthLevel(domain.AuthLevelMFA))
+	metadata.ElevatedAt = time.Now().UTC()
+	_, _, replaceErr := store.ReplaceSessionForAccount(context.Background(), accountID, sessionKey, 5*time.Minute, metadata)
+	if replaceErr != nil {
+		t.Fatal(replaceErr)
+	}
+
+	session, fetchErr := store.ExtendAndFetchSession(context.Background(), sessionKey, 5*time.Minute)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+
+	if session.Fingerprint != metadata.Fingerprint || session.AuthLevel != metadata.AuthLevel || !timeIsCloseToTime(session.ElevatedAt, metadata.ElevatedAt, time.Millisecond) {
+		t.Fatal("The session's metadata should have been stored", session.SessionMetadata)
+	}
+}
+
+func TestUpdateSessionMetadata(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	created, _, replaceErr := store.ReplaceSessionForAccount(context.Background(), accountID, sessionKey, 5*time.Minute, domain.NewSessionMetadata(domain.WithFingerprint("FINGERPRINT")))
+	if replaceErr != nil {
+		t.Fatal(replaceErr)
+	}
+
+	metadata := created.SessionMetadata
+	metadata.AuthLevel = domain.AuthLevelHardwareKey
+	metadata.ElevatedAt = time.Now().UTC()
+
+	updated, updateErr := store.UpdateSessionMetadata(context.Background(), sessionKey, metadata)
+	if updateErr != nil {
+		t.Fatal(updateErr)
+	}
+
+	if updated.SessionKey != sessionKey || updated.AuthLevel != domain.AuthLevelHardwareKey || updated.Fingerprint != "FINGERPRINT" {
+		t.Fatal("The session should have been updated", updated)
+	}
+
+	if !timeIsCloseToTime(updated.ExpirationDate, created.ExpirationDate, time.Millisecond) {
+		t.Fatal("Updating should not have extended the session", updated.ExpirationDate, created.ExpirationDate)
+	}
+
+	_, missingErr := store.UpdateSessionMetadata(context.Background(), uuid.New().String(), metadata)
+	if missingErr != domain.ErrValidSessionNotFound {
+		t.Fatal(missingErr)
+	}
+}
+
+func TestPendingSessionsAreNotExtended(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	metadata := domain.NewSessionMetadata()
+	metadata.State = domain.SessionStatePending
+	created, _, replaceErr := store.ReplaceSessionForAccount(context.Background(), accountID, sessionKey, time.Minute, metadata)
+	if replaceErr != nil {
+		t.Fatal(replaceErr)
+	}
+
+	session, extendErr := store.ExtendAndFetchSession(context.Background(), sessionKey, time.Hour)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+
+	if !session.IsPending() {
+		t.Fatal("The session should still be pending", session.State)
+	}
+
+	if !timeIsCloseToTime(session.ExpirationDate, created.ExpirationDate, time.Millisecond) {
+		t.Fatal("A pending session should not have been extended", session.ExpirationDate, created.ExpirationDate)
+	}
+}
+
+func TestPendingSessionsDoNotReplaceTheAccountsSession(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	service := session.NewSessionService(time.Minute, store, domain.FmtLogger(true))
+
+	_, _, replaceErr := store.ReplaceSessionForAccount(context.Background(), accountID, sessionKey, time.Minute, domain.NewSessionMetadata())
+	if replaceErr != nil {
+		t.Fatal(replaceErr)
+	}
+
+	pendingKey, pendingErr := service.UserDidPartiallyAuthenticate(context.Background(), accountID)
+	if pendingErr != nil {
+		t.Fatal(pendingErr)
+	}
+
+	_, fetchErr := store.FetchSession(context.Background(), sessionKey)
+	if fetchErr != nil {
+		t.Fatal("Starting a login should not end the account's session", fetchErr)
+	}
+
+	completedKey, completeErr := service.UserDidCompleteAuthentication(context.Background(), pendingKey, domain.AuthLevelMFA)
+	if completeErr != nil {
+		t.Fatal(completeErr)
+	}
+
+	_, replacedErr := store.FetchSession(context.Background(), sessionKey)
+	if replacedErr != domain.ErrValidSessionNotFound {
+		t.Fatal("Completing the login should replace the account's session", replacedErr)
+	}
+
+	_, pendingFetchErr := store.FetchSession(context.Background(), pendingKey)
+	if pendingFetchErr != domain.ErrValidSessionNotFound {
+		t.Fatal("Completing the login should end the pending session", pendingFetchErr)
+	}
+
+	_, completedErr := store.FetchSession(context.Background(), completedKey)
+	if completedErr != nil {
+		t.Fatal(completedErr)
+	}
+}
+
+func TestImpersonationDoesNotReplaceTheAccountsSession(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	_, _, replaceErr := store.ReplaceSessionForAccount(context.Background(), accountID, sessionKey, 5*time.Minute, domain.NewSessionMetadata())
+	if replaceErr != nil {
+		t.Fatal(replaceErr)
+	}
+
+	metadata := domain.NewSessionMetadata()
+	metadata.ActorAccountID = uuid.New().String()
+	metadata.ActorSessionHash = domain.HashSessionKey(uuid.New().String())
+
+	impersonationKey := uuid.New().String()
+	impersonation, replaced, impersonateErr := store.ReplaceSessionForAccount(context.Background(), accountID, impersonationKey, 5*time.Minute, metadata)
+	if impersonateErr != nil {
+		t.Fatal(impersonateErr)
+	}
+
+	if replaced != nil {
+		t.Fatal("Impersonating an account should not replace its session", replaced)
+	}
+	if impersonation.ActorAccountID != metadata.ActorAccountID {
+		t.Fatal("The impersonation should record its actor", impersonation)
+	}
+
+	_, fetchErr := store.FetchSession(context.Background(), sessionKey)
+	if fetchErr != nil {
+		t.Fatal("The account's own session should still be valid", fetchErr)
+	}
+
+	own, ownErr := store.FetchPossiblyExpiredSession(context.Background(), accountID)
+	if ownErr != nil {
+		t.Fatal(ownErr)
+	}
+	if own.SessionKey != sessionKey {
+		t.Fatal("Should have fetched the account's own session", own.SessionKey)
+	}
+
+	_, replaced, reimpersonateErr := store.ReplaceSessionForAccount(context.Background(), accountID, uuid.New().String(), 5*time.Minute, metadata)
+	if reimpersonateErr != nil {
+		t.Fatal(reimpersonateErr)
+	}
+	if replaced == nil || replaced.SessionKey != impersonationKey {
+		t.Fatal("Impersonating an account again should replace the actor's earlier impersonation", replaced)
+	}
+}
+
+func TestSessionsAreExtendedByTheirOwnIdleTimeout(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	idleTimeout := 2 * time.Minute
+	_, _, replaceErr := store.ReplaceSessionForAccount(context.Background(), accountID, sessionKey, idleTimeout, domain.NewSessionMetadata(domain.WithIdleTimeout(idleTimeout)))
+	if replaceErr != nil {
+		t.Fatal(replaceErr)
+	}
+
+	extended, extendErr := store.ExtendAndFetchSession(context.Background(), sessionKey, time.Hour)
+	if extendErr != nil {
+		t.Fatal(extendErr)
+	}
+
+	if !timeIsCloseToTime(extended.ExpirationDate, time.Now().UTC().Add(idleTimeout), time.Second) {
+		t.Fatal("Should have extended the session by its own timeout", extended.ExpirationDate)
+	}
+
+	if extended.IdleTimeout != idleTimeout {
+		t.Fatal("The session should have kept its timeout", extended.IdleTimeout)
+	}
+
+	otherAccountID := uuid.New().String()
+	otherKey := uuid.New().String()
+	_, _, otherErr := store.ReplaceSessionForAccount(context.Background(), otherAccountID, otherKey, idleTimeout, domain.NewSessionMetadata())
+	if otherErr != nil {
+		t.Fatal(otherErr)
+	}
+
+	fallback, fallbackErr := store.ExtendAndFetchSession(context.Background(), otherKey, time.Hour)
+	if fallbackErr != nil {
+		t.Fatal(fallbackErr)
+	}
+
+	if !timeIsCloseToTime(fallback.ExpirationDate, time.Now().UTC().Add(time.Hour), time.Second) {
+		t.Fatal("A session without a timeout should be extended by the given duration", fallback.ExpirationDate)
+	}
+}
+
+func TestRememberTokensAreRotatedOnce(t *testing.T) {
+	store, accountID, _ := getTestObjects(t)
+	defer store.Close()
+
+	token := domain.RememberToken{
+		Selector:       uuid.New().String(),
+		ValidatorHash:  "OLD",
+		AccountID:      accountID,
+		ExpirationDate: time.Now().UTC().Add(time.Hour),
+	}
+
+	createErr := store.CreateRememberToken(context.Background(), token)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	rotated := token
+	rotated.ValidatorHash = "NEW"
+	rotated.ExpirationDate = time.Now().UTC().Add(2 * time.Hour)
+	rotated.PreviousValidatorHash = token.ValidatorHash
+	rotated.RotatedAt = time.Now().UTC()
+
+	rotateErr := store.RotateRememberToken(context.Background(), rotated, token.ValidatorHash)
+	if rotateErr != nil {
+		t.Fatal(rotateErr)
+	}
+
+	fetched, fetchErr := store.FetchRememberToken(context.Background(), token.Selector)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+	if fetched.ValidatorHash != "NEW" || fetched.AccountID != accountID || !timeIsCloseToTime(fetched.ExpirationDate, rotated.ExpirationDate, time.Second) ||
+		fetched.PreviousValidatorHash != "OLD" || !timeIsCloseToTime(fetched.RotatedAt, rotated.RotatedAt, time.Second) {
+		t.Fatal("Should have stored the rotated token", fetched)
+	}
+
+	rotateAgainErr := store.RotateRememberToken(context.Background(), rotated, token.ValidatorHash)
+	if rotateAgainErr != domain.ErrRememberTokenInvalid {
+		t.Fatal("Should not rotate a token that has already been rotated", rotateAgainErr)
+	}
+
+	deleteErr := store.DeleteAccountRememberTokens(context.Background(), accountID)
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+
+	_, deletedErr := store.FetchRememberToken(context.Background(), token.Selector)
+	if deletedErr != domain.ErrRememberTokenInvalid {
+		t.Fatal("The account's tokens should have been deleted", deletedErr)
+	}
+}
+
+func TestSessionsCanBeManagedByAdministrators(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	_, createErr := store.CreateSession(context.Background(), accountID, sessionKey, time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	expiredKey := uuid.New().String()
+	_, expiredErr := store.CreateSession(context.Background(), accountID, expiredKey, -time.Minute)
+	if expiredErr != nil {
+		t.Fatal(expiredErr)
+	}
+
+	sessions, listErr := store.ListAccountSessions(context.Background(), accountID)
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	if len(sessions) != 2 || sessions[0].SessionKey != sessionKey || sessions[1].SessionKey != expiredKey {
+		t.Fatal("Should have listed both sessions, the latest to expire first", sessions)
+	}
+
+	fetched, fetchErr := store.FetchSessionByHash(context.Background(), domain.HashSessionKey(expiredKey))
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+	if fetched.SessionKey != expiredKey || fetched.AccountID != accountID {
+		t.Fatal("Should have found the session by its hash", fetched)
+	}
+
+	_, missingErr := store.FetchSessionByHash(context.Background(), domain.HashSessionKey(uuid.New().String()))
+	if missingErr != domain.ErrValidSessionNotFound {
+		t.Fatal("Should not have found a session that doesn't exist", missingErr)
+	}
+
+	stats, statsErr := store.SessionStats(context.Background(), 5*time.Minute, 1000000)
+	if statsErr != nil {
+		t.Fatal(statsErr)
+	}
+	if stats.Active < 1 || stats.ExpiringSoon < 1 || stats.Expired < 1 {
+		t.Fatal("Should have counted the account's sessions", stats)
+	}
+
+	counted := false
+	for _, top := range stats.TopAccounts {
+		if top.AccountID == accountID {
+			counted = true
+			if top.Sessions != 1 {
+				t.Fatal("Should only count the account's active sessions", top)
+			}
+		}
+	}
+	if !counted {
+		t.Fatal("Should have listed the account", stats.TopAccounts)
+	}
+
+	deleteErr := store.DeleteAccountSessions(context.Background(), accountID)
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+
+	deleted, deletedErr := store.ListAccountSessions(context.Background(), accountID)
+	if deletedErr != nil {
+		t.Fatal(deletedErr)
+	}
+	if len(deleted) != 0 {
+		t.Fatal("Should have deleted every session of the account", deleted)
+	}
+}
+
+func TestExpiredSessionsArePurged(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	_, createErr := store.CreateSession(context.Background(), accountID, sessionKey, time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	expiredKey := uuid.New().String()
+	_, expiredErr := store.CreateSession(context.Background(), accountID, expiredKey, -time.Minute)
+	if expiredErr != nil {
+		t.Fatal(expiredErr)
+	}
+
+	expiredToken := domain.RememberToken{
+		Selector:       uuid.New().String(),
+		ValidatorHash:  "EXPIRED",
+		AccountID:      accountID,
+		ExpirationDate: time.Now().UTC().Add(-time.Minute),
+	}
+	tokenErr := store.CreateRememberToken(context.Background(), expiredToken)
+	if tokenErr != nil {
+		t.Fatal(tokenErr)
+	}
+
+	deleted, deleteErr := store.DeleteExpiredSessions(context.Background())
+	if deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	if deleted < 1 {
+		t.Fatal("Should have deleted the expired session", deleted)
+	}
+
+	deletedTokens, deleteTokensErr := store.DeleteExpiredRememberTokens(context.Background())
+	if deleteTokensErr != nil {
+		t.Fatal(deleteTokensErr)
+	}
+	if deletedTokens < 1 {
+		t.Fatal("Should have deleted the expired token", deletedTokens)
+	}
+
+	sessions, listErr := store.ListSessions(context.Background())
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	found := false
+	for _, session := range sessions {
+		if session.SessionKey == expiredKey {
+			t.Fatal("The expired session should be gone")
+		}
+		if session.SessionKey == sessionKey {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("The valid session should have been kept")
+	}
+}
+
+func TestAccountEpochsAreIncremented(t *testing.T) {
+	store, accountID, sessionKey := getTestObjects(t)
+	defer store.Close()
+
+	epoch, fetchErr := store.FetchAccountEpoch(context.Background(), accountID)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+	if epoch != 0 {
+		t.Fatal("Accounts should start at epoch 0", epoch)
+	}
+
+	for expected := int64(1); expected <= 2; expected++ {
+		incremented, incrementErr := store.IncrementAccountEpoch(context.Background(), accountID)
+		if incrementErr != nil {
+			t.Fatal(incrementErr)
+		}
+		if incremented != expected {
+			t.Fatal("Should have moved the account on to the next epoch", incremented)
+		}
+	}
+
+	_, _, replaceErr := store.ReplaceSessionForAccount(context.Background(), accountID, sessionKey, time.Minute, domain.SessionMetadata{Epoch: 2})
+	if replaceErr != nil {
+		t.Fatal(replaceErr)
+	}
+
+	session, sessionErr := store.FetchSession(context.Background(), sessionKey)
+	if sessionErr != nil {
+		t.Fatal(sessionErr)
+	}
+	if session.Epoch != 2 {
+		t.Fatal("Should have stored the session's epoch", session.Epoch)
+	}
+}
+
 func TestSessionDBConstraints(t *testing.T) {
 	s, accountID, sessionKey := getTestObjects(t)
 	expirationDuration := 5 * time.Minute
@@ -248,7 +1050,7 @@ func TestSessionDBConstraints(t *testing.T) {
 		t.Log("Should not have created a bogus session: missing account id")
 		t.Fail()
 
-		s.DeleteSession(sessionKey)
+		s.DeleteSession(context.Background(), sessionKey)
 	}
 
 	// nil sessionkey
@@ -291,20 +1093,30 @@ func TestSessionDBConstraints(t *testing.T) {
 
 }
 
-// func TestDeleteAccountDeletesSession(t *testing.T) {
-// 	store, account, sessionKey := getTestObjects(t)
-// 	expirationDuration := -5 * time.Minute
+func TestDeletedAccountsLoseTheirSessions(t *testing.T) {
+	store, accountID, _ := getTestObjects(t)
+	defer store.Close()
+
+	deleted := false
+	validator := func(ctx context.Context, validatedID string) (bool, error) {
+		return !(deleted && validatedID == accountID), nil
+	}
+	service := session.NewSessionService(time.Minute, store, domain.FmtLogger(true),
+		session.WithAccountValidator(validator), session.WithRequestAccountValidation(0))
 
-// 	firstCreateErr := store.CreateSession(account.ID, sessionKey, api.NullString(), expirationDuration)
-// 	if firstCreateErr != nil {
-// 		t.Fatal(firstCreateErr)
-// 	}
+	sessionKey, authErr := service.UserDidAuthenticate(context.Background(), accountID)
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
 
-// 	deleteAccountQuery := `DELETE FROM accounts WHERE id = $1`
-// 	store.db.MustExec(deleteAccountQuery, account.ID)
+	deleted = true
+	_, getErr := service.GetSessionIfValid(context.Background(), sessionKey)
+	if getErr != domain.ErrAccountDenied {
+		t.Fatal("Sessions of deleted accounts should not be valid", getErr)
+	}
 
-// 	_, fetchErr := store.FetchPossiblyExpiredSession(account.ID)
-// 	if fetchErr == nil {
-// 		t.Fatal("Should have failed to find a session matching this account.")
-// 	}
-// }
+	_, fetchErr := store.FetchPossiblyExpiredSession(context.Background(), accountID)
+	if fetchErr != sql.ErrNoRows {
+		t.Fatal("Should have deleted the sessions of the account", fetchErr)
+	}
+}
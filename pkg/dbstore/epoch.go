@@ -0,0 +1,73 @@
+package dbstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/trussworks/sesh/internal/seshtrace"
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// FetchAccountEpoch returns the account's current epoch, 0 if it has never been incremented
+func (s DBStore) FetchAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	fetchQuery := fmt.Sprintf(`SELECT epoch FROM %s WHERE account_id = $1`, s.epochTable)
+
+	ctx, span := s.startTableQuerySpan(ctx, s.tableName+EpochTableSuffix, "FetchAccountEpoch", fetchQuery)
+	var epoch int64
+	selectErr := s.db.GetContext(ctx, &epoch, fetchQuery, accountID)
+	if selectErr == sql.ErrNoRows {
+		seshtrace.End(span, nil)
+		return 0, nil
+	}
+	seshtrace.End(span, selectErr)
+	if selectErr != nil {
+		return 0, fmt.Errorf("Failed to fetch the account's epoch: %w", selectErr)
+	}
+
+	return epoch, nil
+}
+
+// IncrementAccountEpoch moves the account on to a new epoch and returns it. With WithRevocationNotifications, it
+// notifies a revocation of every session of the account, since none of them are valid anymore.
+func (s DBStore) IncrementAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	var queryer sqlx.ExtContext = s.db
+	var tx *sqlx.Tx
+	if s.notifyRevocations {
+		var beginErr error
+		tx, beginErr = s.db.BeginTxx(ctx, nil)
+		if beginErr != nil {
+			return 0, fmt.Errorf("Failed to begin incrementing the account's epoch: %w", beginErr)
+		}
+		defer tx.Rollback()
+		queryer = tx
+	}
+
+	incrementQuery := fmt.Sprintf(`INSERT INTO %s AS epochs (account_id, epoch) VALUES ($1, 1)
+		ON CONFLICT (account_id) DO UPDATE SET epoch = epochs.epoch + 1
+		RETURNING epoch`, s.epochTable)
+
+	incrementCtx, span := s.startTableQuerySpan(ctx, s.tableName+EpochTableSuffix, "IncrementAccountEpoch", incrementQuery)
+	var epoch int64
+	incrementErr := sqlx.GetContext(incrementCtx, queryer, &epoch, incrementQuery, accountID)
+	seshtrace.End(span, incrementErr)
+	if incrementErr != nil {
+		return 0, fmt.Errorf("Failed to increment the account's epoch: %w", incrementErr)
+	}
+
+	if tx != nil {
+		notifyErr := s.notifyRevocation(ctx, tx, domain.Revocation{AccountID: accountID})
+		if notifyErr != nil {
+			return 0, notifyErr
+		}
+
+		commitErr := tx.Commit()
+		if commitErr != nil {
+			return 0, fmt.Errorf("Failed to commit the account's epoch: %w", commitErr)
+		}
+	}
+
+	return epoch, nil
+}
@@ -0,0 +1,206 @@
+package dbstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// migrationFiles are the schema migrations, each named with its version, an underscore, and a description.
+// They are templates, see migrationData.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key of the advisory lock held while migrating, "sesh" in ASCII
+const migrationLockID = 0x73657368
+
+// migration is a single version of the schema
+type migration struct {
+	version  int
+	name     string
+	template *template.Template
+}
+
+// migrationData is what migration templates are executed with
+type migrationData struct {
+	// Table is the quoted name of the sessions table
+	Table string
+	// TableLiteral is Table as a string literal, for casting to regclass
+	TableLiteral string
+	// RememberTable is the quoted name of the remember me tokens table
+	RememberTable string
+	// EpochTable is the quoted name of the account epochs table
+	EpochTable string
+}
+
+// sql returns the migration's statements for the given DBStore's table
+func (m migration) sql(store DBStore) (string, error) {
+	statements := strings.Builder{}
+	executeErr := m.template.Execute(&statements, migrationData{Table: store.table, TableLiteral: pq.QuoteLiteral(store.table), RememberTable: store.rememberTable, EpochTable: store.epochTable})
+	if executeErr != nil {
+		return "", fmt.Errorf("Failed to render migration %s: %w", m.name, executeErr)
+	}
+	return statements.String(), nil
+}
+
+// loadMigrations returns the embedded migrations in the order they are applied
+func loadMigrations() ([]migration, error) {
+	entries, readErr := fs.ReadDir(migrationFiles, "migrations")
+	if readErr != nil {
+		return nil, fmt.Errorf("Failed to read migrations: %w", readErr)
+	}
+
+	migrations := []migration{}
+	versions := map[int]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+
+		prefix, _, _ := strings.Cut(name, "_")
+		version, versionErr := strconv.Atoi(prefix)
+		if versionErr != nil {
+			return nil, fmt.Errorf("Migration %s does not start with a version: %w", name, versionErr)
+		}
+
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("Migrations %s and %s have the same version", other, name)
+		}
+		versions[version] = name
+
+		contents, fileErr := fs.ReadFile(migrationFiles, "migrations/"+name)
+		if fileErr != nil {
+			return nil, fmt.Errorf("Failed to read migration %s: %w", name, fileErr)
+		}
+
+		tmpl, parseErr := template.New(name).Option("missingkey=error").Parse(string(contents))
+		if parseErr != nil {
+			return nil, fmt.Errorf("Failed to parse migration %s: %w", name, parseErr)
+		}
+
+		migrations = append(migrations, migration{version, name, tmpl})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+// Migrate creates or upgrades the sessions table by applying every migration that hasn't been applied yet.
+// Applied versions are recorded in the sesh_schema_migrations table, separately for each sessions table.
+// Pass it the same options as NewDBStore so that it migrates the right table.
+// It holds an advisory lock while it runs, so every instance of an app can safely call it at startup.
+func Migrate(ctx context.Context, db *sqlx.DB, opts ...Option) error {
+	store := NewDBStore(db, opts...)
+
+	migrations, loadErr := loadMigrations()
+	if loadErr != nil {
+		return loadErr
+	}
+
+	// Advisory locks belong to a connection, so everything has to happen on the same one.
+	conn, connErr := db.Conn(ctx)
+	if connErr != nil {
+		return fmt.Errorf("Failed to connect to migrate: %w", connErr)
+	}
+	defer conn.Close()
+
+	_, lockErr := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID)
+	if lockErr != nil {
+		return fmt.Errorf("Failed to take the migration lock: %w", lockErr)
+	}
+	// The connection goes back to the pool, so the lock has to be released even if ctx is done.
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	createQuery := `CREATE TABLE IF NOT EXISTS sesh_schema_migrations(
+		sessions_table text NOT NULL,
+		version        integer NOT NULL,
+		applied_at     timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (sessions_table, version)
+	)`
+
+	_, createErr := conn.ExecContext(ctx, createQuery)
+	if createErr != nil {
+		return fmt.Errorf("Failed to create the migrations table: %w", createErr)
+	}
+
+	applied, appliedErr := appliedMigrations(ctx, conn, store.tableName)
+	if appliedErr != nil {
+		return fmt.Errorf("Failed to fetch applied migrations: %w", appliedErr)
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+
+		applyErr := applyMigration(ctx, conn, store, m)
+		if applyErr != nil {
+			return applyErr
+		}
+	}
+
+	return nil
+}
+
+// appliedMigrations returns the set of versions that have been applied to a sessions table
+func appliedMigrations(ctx context.Context, conn *sql.Conn, tableName string) (map[int]bool, error) {
+	rows, queryErr := conn.QueryContext(ctx, `SELECT version FROM sesh_schema_migrations WHERE sessions_table = $1`, tableName)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		scanErr := rows.Scan(&version)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+// applyMigration runs a migration and records it in a single transaction
+func applyMigration(ctx context.Context, conn *sql.Conn, store DBStore, m migration) error {
+	statements, renderErr := m.sql(store)
+	if renderErr != nil {
+		return renderErr
+	}
+
+	tx, beginErr := conn.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return fmt.Errorf("Failed to begin migration %s: %w", m.name, beginErr)
+	}
+	defer tx.Rollback()
+
+	_, migrateErr := tx.ExecContext(ctx, statements)
+	if migrateErr != nil {
+		return fmt.Errorf("Failed to apply migration %s: %w", m.name, migrateErr)
+	}
+
+	_, recordErr := tx.ExecContext(ctx, `INSERT INTO sesh_schema_migrations (sessions_table, version) VALUES ($1, $2)`, store.tableName, m.version)
+	if recordErr != nil {
+		return fmt.Errorf("Failed to record migration %s: %w", m.name, recordErr)
+	}
+
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		return fmt.Errorf("Failed to commit migration %s: %w", m.name, commitErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,6 @@
+-- IF NOT EXISTS so that databases set up by hand before there was a migration runner can adopt it.
+CREATE TABLE IF NOT EXISTS {{.Table}}(
+    session_key     text PRIMARY KEY,
+    account_id      text UNIQUE NOT NULL,
+    expiration_date timestamp NOT NULL
+);
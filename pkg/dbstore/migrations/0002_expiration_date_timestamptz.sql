@@ -0,0 +1,3 @@
+-- Expiration dates have always been written in UTC, so that is how the existing ones are read.
+-- From here on they are absolute instants, and the TimeZone of the connection no longer matters.
+ALTER TABLE {{.Table}} ALTER COLUMN expiration_date TYPE timestamptz USING expiration_date AT TIME ZONE 'UTC';
@@ -0,0 +1,2 @@
+-- Sessions created before fingerprinting, or without a fingerprint policy, are not bound to a client.
+ALTER TABLE {{.Table}} ADD COLUMN fingerprint text NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- Sessions created before authentication levels are password logins that have never been elevated.
+ALTER TABLE {{.Table}} ADD COLUMN auth_level integer NOT NULL DEFAULT 0;
+ALTER TABLE {{.Table}} ADD COLUMN elevated_at timestamptz NOT NULL DEFAULT 'epoch';
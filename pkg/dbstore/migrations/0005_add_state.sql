@@ -0,0 +1,2 @@
+-- Sessions created before there were pending sessions are all fully authenticated.
+ALTER TABLE {{.Table}} ADD COLUMN state text NOT NULL DEFAULT 'active';
@@ -0,0 +1,21 @@
+-- Impersonation sessions belong to the account being impersonated, but they must not replace the account's own
+-- session. So an account has one session of its own, with no actor, plus one per actor impersonating it.
+ALTER TABLE {{.Table}} ADD COLUMN actor_account_id text NOT NULL DEFAULT '';
+ALTER TABLE {{.Table}} ADD COLUMN actor_session_key text NOT NULL DEFAULT '';
+
+-- The unique constraint on account_id is named after the table, so look it up rather than guess.
+DO $$
+DECLARE
+    account_constraint text;
+BEGIN
+    SELECT conname INTO account_constraint FROM pg_constraint
+    WHERE conrelid = {{.TableLiteral}}::regclass
+        AND contype = 'u'
+        AND conkey = ARRAY[(SELECT attnum FROM pg_attribute WHERE attrelid = {{.TableLiteral}}::regclass AND attname = 'account_id')];
+
+    IF account_constraint IS NOT NULL THEN
+        EXECUTE format('ALTER TABLE %s DROP CONSTRAINT %I', {{.TableLiteral}}::regclass, account_constraint);
+    END IF;
+END $$;
+
+ALTER TABLE {{.Table}} ADD UNIQUE (account_id, actor_account_id);
@@ -0,0 +1,9 @@
+-- Remember me tokens live next to the sessions table, named after it.
+CREATE TABLE {{.RememberTable}}(
+    selector        text PRIMARY KEY,
+    validator_hash  text NOT NULL,
+    account_id      text NOT NULL,
+    expiration_date timestamptz NOT NULL
+);
+
+CREATE INDEX ON {{.RememberTable}} (account_id);
@@ -0,0 +1,3 @@
+-- The idle timeout of each session, in nanoseconds like a time.Duration.
+-- Sessions created before there were per session timeouts have none, and are extended by the service's timeout.
+ALTER TABLE {{.Table}} ADD COLUMN idle_timeout bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- Each account's session epoch, see DBStore.IncrementAccountEpoch. Accounts without a row are at epoch 0.
+CREATE TABLE {{.EpochTable}}(
+    account_id text PRIMARY KEY,
+    epoch      bigint NOT NULL
+);
+
+-- The epoch of its account when each session was created. Sessions created before there were epochs are at epoch 0.
+ALTER TABLE {{.Table}} ADD COLUMN epoch bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,20 @@
+-- A pending session must not replace the account's active session, or anyone who knows only the password could log
+-- the user out. So an account can have a pending session alongside each of its other sessions.
+DO $$
+DECLARE
+    account_constraint text;
+BEGIN
+    SELECT conname INTO account_constraint FROM pg_constraint
+    WHERE conrelid = {{.TableLiteral}}::regclass
+        AND contype = 'u'
+        AND conkey = ARRAY[
+            (SELECT attnum FROM pg_attribute WHERE attrelid = {{.TableLiteral}}::regclass AND attname = 'account_id'),
+            (SELECT attnum FROM pg_attribute WHERE attrelid = {{.TableLiteral}}::regclass AND attname = 'actor_account_id')
+        ]::int2[];
+
+    IF account_constraint IS NOT NULL THEN
+        EXECUTE format('ALTER TABLE %s DROP CONSTRAINT %I', {{.TableLiteral}}::regclass, account_constraint);
+    END IF;
+END $$;
+
+ALTER TABLE {{.Table}} ADD UNIQUE (account_id, actor_account_id, state);
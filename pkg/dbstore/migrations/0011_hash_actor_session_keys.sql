@@ -0,0 +1,8 @@
+-- Only the hash of the actor's session key is kept, see domain.HashSessionKey, so that reading the table doesn't give
+-- away the actor's session.
+ALTER TABLE {{.Table}} RENAME COLUMN actor_session_key TO actor_session_hash;
+UPDATE {{.Table}} SET actor_session_hash = left(encode(sha512(convert_to(actor_session_hash, 'UTF8')), 'hex'), 12)
+    WHERE actor_session_hash <> '';
+
+-- The epoch of the actor's account when an impersonation started, so that invalidating the actor's account ends it too.
+ALTER TABLE {{.Table}} ADD COLUMN actor_epoch bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- A replaced validator is still accepted for a short grace period, so that concurrent requests with the same token
+-- don't look like a theft.
+ALTER TABLE {{.RememberTable}} ADD COLUMN previous_validator_hash text NOT NULL DEFAULT '';
+ALTER TABLE {{.RememberTable}} ADD COLUMN rotated_at timestamptz NOT NULL DEFAULT 'epoch';
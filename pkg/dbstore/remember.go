@@ -0,0 +1,133 @@
+package dbstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/trussworks/sesh/internal/seshtrace"
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// rememberColumns are the columns that make up a domain.RememberToken
+const rememberColumns = "selector, validator_hash, account_id, expiration_date, previous_validator_hash, rotated_at"
+
+// startRememberQuerySpan starts a span for a single query on the remember me tokens table. End it with seshtrace.End.
+func (s DBStore) startRememberQuerySpan(ctx context.Context, operation string, query string) (context.Context, trace.Span) {
+	return s.startTableQuerySpan(ctx, s.tableName+RememberTableSuffix, operation, query)
+}
+
+// CreateRememberToken stores a new remember me token
+func (s DBStore) CreateRememberToken(ctx context.Context, token domain.RememberToken) error {
+	createQuery := fmt.Sprintf(`INSERT INTO %s (%s) VALUES ($1, $2, $3, $4, $5, $6)`, s.rememberTable, rememberColumns)
+
+	ctx, span := s.startRememberQuerySpan(ctx, "CreateRememberToken", createQuery)
+	_, createErr := s.db.ExecContext(ctx, createQuery, token.Selector, token.ValidatorHash, token.AccountID, token.ExpirationDate, token.PreviousValidatorHash, token.RotatedAt)
+	seshtrace.End(span, createErr)
+	if createErr != nil {
+		return fmt.Errorf("Failed to create a remember me token: %w", createErr)
+	}
+
+	return nil
+}
+
+// FetchRememberToken returns a remember me token by its selector, regardless of wether it is expired
+// On failure, it can return ErrRememberTokenInvalid or an unexpected error
+func (s DBStore) FetchRememberToken(ctx context.Context, selector string) (domain.RememberToken, error) {
+	fetchQuery := fmt.Sprintf(`SELECT %s FROM %s WHERE selector = $1`, rememberColumns, s.rememberTable)
+
+	ctx, span := s.startRememberQuerySpan(ctx, "FetchRememberToken", fetchQuery)
+	token := domain.RememberToken{}
+	selectErr := s.db.GetContext(ctx, &token, fetchQuery, selector)
+	if selectErr != nil {
+		if selectErr == sql.ErrNoRows {
+			seshtrace.End(span, domain.ErrRememberTokenInvalid)
+			return domain.RememberToken{}, domain.ErrRememberTokenInvalid
+		}
+		seshtrace.End(span, selectErr)
+		return domain.RememberToken{}, fmt.Errorf("Failed to fetch a remember me token: %w", selectErr)
+	}
+	seshtrace.End(span, nil)
+
+	token.ExpirationDate = token.ExpirationDate.UTC()
+	token.RotatedAt = token.RotatedAt.UTC()
+
+	return token, nil
+}
+
+// RotateRememberToken gives the token a new validator hash, previous validator hash, rotation date and expiration date
+// if its validator hash is still oldValidatorHash, and returns ErrRememberTokenInvalid otherwise
+func (s DBStore) RotateRememberToken(ctx context.Context, token domain.RememberToken, oldValidatorHash string) error {
+	rotateQuery := fmt.Sprintf(`UPDATE %s
+					SET validator_hash = $1, expiration_date = $2, previous_validator_hash = $3, rotated_at = $4
+				WHERE
+					selector = $5
+					AND validator_hash = $6`, s.rememberTable)
+
+	ctx, span := s.startRememberQuerySpan(ctx, "RotateRememberToken", rotateQuery)
+	result, rotateErr := s.db.ExecContext(ctx, rotateQuery, token.ValidatorHash, token.ExpirationDate, token.PreviousValidatorHash, token.RotatedAt, token.Selector, oldValidatorHash)
+	seshtrace.End(span, rotateErr)
+	if rotateErr != nil {
+		return fmt.Errorf("Failed to rotate a remember me token: %w", rotateErr)
+	}
+
+	rotated, rowsErr := result.RowsAffected()
+	if rowsErr != nil {
+		return fmt.Errorf("Failed to rotate a remember me token: %w", rowsErr)
+	}
+	if rotated == 0 {
+		return domain.ErrRememberTokenInvalid
+	}
+
+	return nil
+}
+
+// DeleteRememberToken removes a remember me token, it is not an error if it doesn't exist
+func (s DBStore) DeleteRememberToken(ctx context.Context, selector string) error {
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE selector = $1`, s.rememberTable)
+
+	ctx, span := s.startRememberQuerySpan(ctx, "DeleteRememberToken", deleteQuery)
+	_, deleteErr := s.db.ExecContext(ctx, deleteQuery, selector)
+	seshtrace.End(span, deleteErr)
+	if deleteErr != nil {
+		return fmt.Errorf("Failed to delete a remember me token: %w", deleteErr)
+	}
+
+	return nil
+}
+
+// DeleteAccountRememberTokens removes every remember me token of an account
+func (s DBStore) DeleteAccountRememberTokens(ctx context.Context, accountID string) error {
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE account_id = $1`, s.rememberTable)
+
+	ctx, span := s.startRememberQuerySpan(ctx, "DeleteAccountRememberTokens", deleteQuery)
+	_, deleteErr := s.db.ExecContext(ctx, deleteQuery, accountID)
+	seshtrace.End(span, deleteErr)
+	if deleteErr != nil {
+		return fmt.Errorf("Failed to delete the account's remember me tokens: %w", deleteErr)
+	}
+
+	return nil
+}
+
+// DeleteExpiredRememberTokens removes the remember me tokens that have expired. It returns how many were removed.
+func (s DBStore) DeleteExpiredRememberTokens(ctx context.Context) (int, error) {
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE expiration_date <= $1`, s.rememberTable)
+
+	ctx, span := s.startRememberQuerySpan(ctx, "DeleteExpiredRememberTokens", deleteQuery)
+	result, deleteErr := s.db.ExecContext(ctx, deleteQuery, time.Now().UTC())
+	seshtrace.End(span, deleteErr)
+	if deleteErr != nil {
+		return 0, fmt.Errorf("Failed to delete expired remember me tokens: %w", deleteErr)
+	}
+
+	deleted, rowsErr := result.RowsAffected()
+	if rowsErr != nil {
+		return 0, fmt.Errorf("Failed to count deleted remember me tokens: %w", rowsErr)
+	}
+
+	return int(deleted), nil
+}
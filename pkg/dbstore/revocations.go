@@ -0,0 +1,87 @@
+package dbstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/trussworks/sesh/internal/seshtrace"
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// RevocationChannel is the channel that revocations are sent on, as JSON encoded domain.Revocations.
+// They only hold hashes of session keys, so anyone who can listen on it can't use the sessions.
+const RevocationChannel = "sesh_revocations"
+
+// how long the listener waits before reconnecting, and how often it checks that its connection is alive
+const (
+	listenerMinReconnectInterval = 10 * time.Second
+	listenerMaxReconnectInterval = time.Minute
+	listenerPingInterval         = 90 * time.Second
+)
+
+// notifyRevocation sends a revocation on RevocationChannel. Postgres delivers it when tx commits.
+func (s DBStore) notifyRevocation(ctx context.Context, tx *sqlx.Tx, revocation domain.Revocation) error {
+	payload, encodeErr := json.Marshal(revocation)
+	if encodeErr != nil {
+		return fmt.Errorf("Failed to encode revocation: %w", encodeErr)
+	}
+
+	notifyQuery := `SELECT pg_notify($1, $2)`
+
+	ctx, span := s.startQuerySpan(ctx, "NotifyRevocation", notifyQuery)
+	_, notifyErr := tx.ExecContext(ctx, notifyQuery, RevocationChannel, string(payload))
+	seshtrace.End(span, notifyErr)
+	if notifyErr != nil {
+		return fmt.Errorf("Failed to notify revocation: %w", notifyErr)
+	}
+
+	return nil
+}
+
+// ListenForRevocations listens on RevocationChannel using its own connection to the db at connStr and passes every
+// revocation to handler. It blocks until ctx is done.
+// Notifications sent while the connection is down are lost, so handler is purged whenever it reconnects.
+func ListenForRevocations(ctx context.Context, connStr string, handler domain.RevocationHandler, log domain.LogService) error {
+	listener := pq.NewListener(connStr, listenerMinReconnectInterval, listenerMaxReconnectInterval, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.WarnError(domain.RevocationListenerFailed, err, domain.LogFields{})
+		}
+	})
+	defer listener.Close()
+
+	listenErr := listener.Listen(RevocationChannel)
+	if listenErr != nil {
+		return fmt.Errorf("Failed to listen for revocations: %w", listenErr)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case notification := <-listener.Notify:
+			// A nil notification means the connection was re-established.
+			if notification == nil {
+				handler.Purge()
+				continue
+			}
+
+			revocation := domain.Revocation{}
+			decodeErr := json.Unmarshal([]byte(notification.Extra), &revocation)
+			if decodeErr != nil {
+				log.WarnError(domain.RevocationNotificationMalformed, decodeErr, domain.LogFields{})
+				continue
+			}
+
+			handler.Revoke(revocation)
+
+		case <-time.After(listenerPingInterval):
+			go listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// SessionStats summarizes the sessions in a store
+type SessionStats struct {
+	// Active is the number of sessions that have not expired, including pending sessions and impersonations
+	Active int `db:"active" json:"active"`
+	// Pending is the number of active sessions that haven't finished logging in
+	Pending int `db:"pending" json:"pending"`
+	// Impersonations is the number of active sessions that impersonate their account
+	Impersonations int `db:"impersonations" json:"impersonations"`
+	// ExpiringSoon is the number of active sessions that expire within the window the stats were asked for
+	ExpiringSoon int `db:"expiring_soon" json:"expiring_soon"`
+	// Expired is the number of expired sessions that are still stored
+	Expired int `db:"expired" json:"expired"`
+	// TopAccounts are the accounts with the most active sessions, most first
+	TopAccounts []AccountSessionCount `json:"top_accounts"`
+}
+
+// AccountSessionCount is the number of active sessions of an account
+type AccountSessionCount struct {
+	AccountID string `db:"account_id" json:"account_id"`
+	Sessions  int    `db:"sessions" json:"sessions"`
+}
+
+// SessionAdminStorageService lets operators find and end sessions. Stores that keep sessions, like dbstore.DBStore,
+// implement it alongside SessionStorageService. Sessions are identified by HashSessionKey, so that their keys are never
+// handed out.
+type SessionAdminStorageService interface {
+	// ListAccountSessions returns every stored session of an account, expired or not, including impersonations of it and
+	// by it
+	ListAccountSessions(ctx context.Context, accountID string) ([]Session, error)
+
+	// FetchSessionByHash returns the stored session whose key has the given HashSessionKey, expired or not
+	// On failure, it can return ErrValidSessionNotFound or an unexpected error
+	FetchSessionByHash(ctx context.Context, sessionHash string) (Session, error)
+
+	// DeleteSession removes a session
+	DeleteSession(ctx context.Context, sessionKey string) error
+
+	// DeleteAccountSessions removes every session of an account, including its impersonations of other accounts.
+	// It is not an error if there are none.
+	DeleteAccountSessions(ctx context.Context, accountID string) error
+
+	// SessionStats summarizes the stored sessions, counting those that expire within expiringWithin as expiring soon
+	// and listing up to topAccounts accounts
+	SessionStats(ctx context.Context, expiringWithin time.Duration, topAccounts int) (SessionStats, error)
+}
@@ -0,0 +1,84 @@
+package domain
+
+// EventType identifies a session lifecycle event
+type EventType string
+
+// lifecycle events
+const (
+	// EventSessionCreated is emitted when a new session is created
+	EventSessionCreated EventType = "created"
+	// EventSessionDestroyed is emitted when a session is ended by logging out, or by an administrator, in which case the
+	// Reason is ReasonRevoked. When every session of an account is revoked at once, there is no SessionHash.
+	EventSessionDestroyed EventType = "destroyed"
+	// EventSessionReplaced is emitted when a valid session is ended because its account logged in again
+	EventSessionReplaced EventType = "replaced"
+	// EventAuthFailed is emitted when a request could not be authenticated, the Reason says why
+	EventAuthFailed EventType = "auth_failed"
+	// EventFingerprintMismatch is emitted when a session is used by a client other than the one that logged in,
+	// the Reason is what was done about it
+	EventFingerprintMismatch EventType = "fingerprint_mismatch"
+	// EventSessionElevated is emitted when a session is elevated, the Reason is the new AuthLevel
+	EventSessionElevated EventType = "elevated"
+	// EventSessionPending is emitted when a pending session is created for a user that has only completed the first
+	// step of logging in. Completing the login emits EventSessionCreated.
+	EventSessionPending EventType = "pending"
+	// EventImpersonationStarted is emitted when an actor starts impersonating an account
+	EventImpersonationStarted EventType = "impersonation_started"
+	// EventImpersonationStopped is emitted when an actor stops impersonating an account
+	EventImpersonationStopped EventType = "impersonation_stopped"
+	// EventRememberTokenStolen is emitted when a remember me token has been used by someone else, and every token
+	// of the account has been revoked
+	EventRememberTokenStolen EventType = "remember_token_stolen"
+	// EventAccountDenied is emitted when the AccountValidator doesn't allow an account to have sessions, and its
+	// sessions have been destroyed
+	EventAccountDenied EventType = "account_denied"
+)
+
+// reasons for EventAuthFailed
+const (
+	ReasonMissingCookie = "missing_cookie"
+	ReasonNotFound      = "not_found"
+	ReasonExpired       = "expired"
+	ReasonUnexpected    = "unexpected"
+	ReasonRateLimited   = "rate_limited"
+	ReasonPending       = "pending"
+	// ReasonInvalidated means that the session's account has moved on to a new epoch since the session was created.
+	// It is also the Reason of the EventSessionDestroyed emitted when that happens.
+	ReasonInvalidated = "invalidated"
+)
+
+// reasons for EventSessionDestroyed
+const (
+	// ReasonRevoked means that the session was ended by an administrator, or because the account's remember me token was
+	// stolen, rather than by logging out
+	ReasonRevoked = "revoked"
+	// ReasonActorEnded means that the session was an impersonation, and the actor's own session had ended
+	ReasonActorEnded = "actor_ended"
+)
+
+// Event describes something that happened to a session
+type Event struct {
+	Type EventType
+	// SessionHash is the hashed key of the session the event is about, if there is one
+	SessionHash string
+	// AccountID is the account the session belongs to, if it is known
+	AccountID string
+	// ActorAccountID is the account that is really using the session if it is an impersonation
+	ActorAccountID string
+	// Reason further describes some events, like EventAuthFailed
+	Reason string
+}
+
+// EventHandler is notified of session lifecycle events.
+// HandleEvent is called synchronously, in the middle of handling a request, so it should not block.
+type EventHandler interface {
+	HandleEvent(event Event)
+}
+
+// EventHandlerFunc lets an ordinary function be used as an EventHandler
+type EventHandlerFunc func(event Event)
+
+// HandleEvent calls f(event)
+func (f EventHandlerFunc) HandleEvent(event Event) {
+	f(event)
+}
@@ -12,6 +12,42 @@ var (
 
 	// ErrSessionExpired is returned when the requested session has expired
 	ErrSessionExpired = errors.New("Session is expired")
+
+	// ErrFingerprintMismatch is returned when a session is used by a client other than the one that logged in
+	ErrFingerprintMismatch = errors.New("Session fingerprint does not match the client")
+
+	// ErrRateLimited is returned when a client has made too many requests with invalid sessions
+	ErrRateLimited = errors.New("Too many requests with invalid sessions")
+
+	// ErrSessionPending is returned when a pending session is used for anything but completing the login
+	ErrSessionPending = errors.New("Session is pending")
+
+	// ErrNotImpersonating is returned when stopping an impersonation with a session that isn't impersonating anyone
+	ErrNotImpersonating = errors.New("Session is not an impersonation")
+
+	// ErrAlreadyImpersonating is returned when starting an impersonation with a session that is already impersonating someone
+	ErrAlreadyImpersonating = errors.New("Session is already an impersonation")
+
+	// ErrRememberTokenInvalid is returned when a remember me token doesn't exist or has expired
+	ErrRememberTokenInvalid = errors.New("Remember me token is invalid")
+
+	// ErrRememberTokenStolen is returned when a remember me token's validator doesn't match, which means that
+	// someone else has used it
+	ErrRememberTokenStolen = errors.New("Remember me token has been used by someone else")
+
+	// ErrSessionInvalidated is used internally for sessions from an earlier epoch than their account's.
+	// Callers of the SessionService get ErrValidSessionNotFound for them.
+	ErrSessionInvalidated = errors.New("Session was invalidated with every other session of its account")
+
+	// ErrAccountDenied is returned when the AccountValidator doesn't allow the account to have sessions
+	ErrAccountDenied = errors.New("Account is not allowed to have sessions")
+
+	// ErrAccountEpochsUnsupported is returned when invalidating an account's epoch without an AccountEpochStorageService
+	ErrAccountEpochsUnsupported = errors.New("Account epochs are not configured")
+
+	// ErrAccountSessionsNotStored is returned by stores that can't find an account's sessions, like those sealed in cookies,
+	// when deleting every session of an account
+	ErrAccountSessionsNotStored = errors.New("The store can't find an account's sessions")
 )
 
 // log messages
@@ -21,11 +57,47 @@ var (
 	SessionUnexpectedError        = "An unexpected error occured while checking the session."
 	SessionCreationFailed         = "An unexpected error occured creating a session"
 	RequestIsMissingSessionCookie = "Unauthorized: Request is missing a session cookie"
+	SessionCookieReissueFailed    = "Failed to re-issue the session cookie"
+	RequestRateLimited            = "Too Many Requests: Client has made too many requests with invalid sessions"
+	RateLimiterFailed             = "The rate limiter failed, letting the request through"
+	SessionFingerprintMismatch    = "The session is being used by a client other than the one that logged in"
+	SessionStepUpRequired         = "Forbidden: The session must be elevated to a higher authentication level"
+	SessionPending                = "Auth failed because the session has not completed logging in"
+	SessionInvalidated            = "Auth failed because every session of the account was invalidated"
+	AccountDenied                 = "The account is not allowed to have sessions, destroying them"
+	AccountSessionsNotFound       = "Only destroyed the presented session of a denied account, the store can't find the others"
+
+	RememberTokenInvalid  = "Ignoring an invalid remember me token"
+	RememberTokenStolen   = "A remember me token was used with the wrong validator, revoking all of the account's tokens"
+	RememberTokenFailed   = "An unexpected error occured exchanging a remember me token"
+	RememberTokenReissued = "Logged in again with a remember me token"
+
+	RevocationListenerFailed        = "The revocation listener lost its connection"
+	RevocationNotificationMalformed = "Ignoring a malformed revocation notification"
+
+	AdminRequestDenied     = "Forbidden: The request is not allowed to manage sessions"
+	SessionRevoked         = "Session was revoked by an administrator"
+	AccountSessionsRevoked = "Every session of the account was revoked by an administrator"
+	ExpiredSessionsPurged  = "Expired sessions and remember me tokens were purged"
+	SessionTablesMigrated  = "The session tables were migrated"
+
+	SessionStreamUnsupported = "Can't stream session events, the response writer doesn't support flushing"
+	SessionStreamFailed      = "An unexpected error occured checking on a streamed session, closing the stream"
+	SessionStreamEnded       = "Told the client that its session has ended"
 
-	SessionCreated         = "New Session Created"
-	SessionDestroyed       = "Session Was Destroyed"
-	SessionRefreshed       = "Session was refreshed with the refresh API"
-	SessionConcurrentLogin = "User logged in again with a concurrent active session"
+	SessionCreated           = "New Session Created"
+	SessionDestroyed         = "Session Was Destroyed"
+	SessionRefreshed         = "Session was refreshed with the refresh API"
+	SessionConcurrentLogin   = "User logged in again with a concurrent active session"
+	SessionElevated          = "Session was elevated to a higher authentication level"
+	SessionPendingCreated    = "New Pending Session Created"
+	SessionRememberedCreated = "New Session Created with a remember me token"
+	SessionPromoted          = "Pending session was promoted to a full session"
+	ImpersonationStarted     = "Actor started impersonating an account"
+	ImpersonationStopped     = "Actor stopped impersonating an account"
+	ImpersonationActorEnded  = "Ending an impersonation because the actor's own session has ended"
+	AccountEpochInvalidated  = "Every session of the account was invalidated by moving it on to a new epoch"
+	AccountSessionsEnded     = "Every session of the account was ended"
 )
 
 // Temporary logging stuff. we should turn this into a callback.
@@ -0,0 +1,34 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// RememberToken is a stored remember me token. The token handed to the client is its selector and a validator,
+// only a hash of the validator is stored so that a leaked table can't be used to log in.
+type RememberToken struct {
+	Selector       string    `db:"selector"`
+	ValidatorHash  string    `db:"validator_hash"`
+	AccountID      string    `db:"account_id"`
+	ExpirationDate time.Time `db:"expiration_date"`
+	// PreviousValidatorHash is the hash of the validator that was replaced at RotatedAt, which is still accepted for a
+	// short grace period so that concurrent requests with the same token don't look like a theft
+	PreviousValidatorHash string    `db:"previous_validator_hash"`
+	RotatedAt             time.Time `db:"rotated_at"`
+}
+
+// RememberService issues long lived tokens that log their account back in once its session has ended
+type RememberService interface {
+	// Remember issues a token for the account
+	Remember(ctx context.Context, accountID string) (token string, expirationDate time.Time, err error)
+	// Exchange checks a token and replaces its validator, returning the account it was issued to and the new token.
+	// The new token is empty if the token's validator was just replaced by a concurrent request, in which case the client
+	// keeps the token that request handed out.
+	// It returns ErrRememberTokenInvalid if the token doesn't exist or has expired, and ErrRememberTokenStolen
+	// along with the account if its validator has already been replaced, in which case every token of the account
+	// is revoked.
+	Exchange(ctx context.Context, token string) (accountID string, newToken string, expirationDate time.Time, err error)
+	// Forget revokes a token, it is not an error if the token doesn't exist
+	Forget(ctx context.Context, token string) error
+}
@@ -1,20 +1,179 @@
 package domain
 
-import "time"
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"time"
+)
 
 // Session contains all the information about a given user session
 type Session struct {
 	AccountID      string    `db:"account_id"`
 	SessionKey     string    `db:"session_key"`
 	ExpirationDate time.Time `db:"expiration_date"`
+	SessionMetadata
 }
 
+// AuthLevel is how strongly a user has proven who they are. Higher levels are stronger.
+type AuthLevel int
+
+// authentication levels
+const (
+	// AuthLevelPassword is a login with a password, it is the level of every new session unless WithAuthLevel says otherwise
+	AuthLevelPassword AuthLevel = iota
+	// AuthLevelMFA is a login with a second factor, like a one time code
+	AuthLevelMFA
+	// AuthLevelHardwareKey is a login with a hardware security key
+	AuthLevelHardwareKey
+)
+
+// String returns the name of the level
+func (l AuthLevel) String() string {
+	switch l {
+	case AuthLevelPassword:
+		return "password"
+	case AuthLevelMFA:
+		return "mfa"
+	case AuthLevelHardwareKey:
+		return "hardware_key"
+	default:
+		return "unknown"
+	}
+}
+
+// SessionState is what a session may be used for
+type SessionState string
+
+// session states
+const (
+	// SessionStateActive sessions are fully authenticated
+	SessionStateActive SessionState = "active"
+	// SessionStatePending sessions belong to users that are halfway through logging in, who have entered a password
+	// but not yet a second factor. They are only accepted by the endpoint that completes the login.
+	SessionStatePending SessionState = "pending"
+	// SessionStateRemembered sessions were started with a remember me token rather than a login. They are used like
+	// active sessions, but are kept alongside the account's active session rather than replacing it.
+	SessionStateRemembered SessionState = "remembered"
+)
+
+// SessionMetadata is recorded with a session when it is created
+type SessionMetadata struct {
+	// Fingerprint identifies the client that logged in, it is empty if the session isn't bound to a client
+	Fingerprint string `db:"fingerprint" json:"fingerprint,omitempty"`
+	// AuthLevel is how strongly the user has proven who they are
+	AuthLevel AuthLevel `db:"auth_level" json:"auth_level,omitempty"`
+	// ElevatedAt is when the user last proved it, at login or when the session was elevated
+	ElevatedAt time.Time `db:"elevated_at" json:"elevated_at"`
+	// State is what the session may be used for, sessions sealed before there were states are active
+	State SessionState `db:"state" json:"state,omitempty"`
+	// ActorAccountID is the account that is really using the session when it is impersonating AccountID,
+	// it is empty otherwise
+	ActorAccountID string `db:"actor_account_id" json:"actor_account_id,omitempty"`
+	// ActorSessionHash is the HashSessionKey of the actor's own session, which is kept alive while the impersonation is
+	// and restored when it stops. It is empty if the store can't find the actor's session, like the cookiestore.
+	// Only the hash is kept, so that the actor's session can't be taken from the impersonation.
+	ActorSessionHash string `db:"actor_session_hash" json:"-"`
+	// ActorEpoch is the epoch of the actor's account when the impersonation started, see AccountEpochStorageService
+	ActorEpoch int64 `db:"actor_epoch" json:"actor_epoch,omitempty"`
+	// IdleTimeout is how long the session lasts without being used. Sessions stored without one are extended by the
+	// service's timeout.
+	IdleTimeout time.Duration `db:"idle_timeout" json:"idle_timeout,omitempty"`
+	// Epoch is the epoch of the account when the session was created, see AccountEpochStorageService.
+	// It is set by the SessionService, not by a SessionOption.
+	Epoch int64 `db:"epoch" json:"epoch,omitempty"`
+}
+
+// IsImpersonation reports whether the session is an actor impersonating its account
+func (m SessionMetadata) IsImpersonation() bool {
+	return m.ActorAccountID != ""
+}
+
+// IsPending reports whether the session is waiting for the user to complete their login
+func (m SessionMetadata) IsPending() bool {
+	return m.State == SessionStatePending
+}
+
+// SessionOption sets metadata for a new session
+type SessionOption func(*SessionMetadata)
+
+// WithFingerprint binds a new session to the client with the given fingerprint
+func WithFingerprint(fingerprint string) SessionOption {
+	return func(m *SessionMetadata) {
+		m.Fingerprint = fingerprint
+	}
+}
+
+// WithAuthLevel sets the authentication level of a new session, for logins that already checked more than a password
+func WithAuthLevel(level AuthLevel) SessionOption {
+	return func(m *SessionMetadata) {
+		m.AuthLevel = level
+	}
+}
+
+// WithIdleTimeout sets how long a new session lasts without being used, instead of the service's timeout.
+// Use it to give some sessions, like those of admins or shared kiosks, a shorter timeout than the rest.
+func WithIdleTimeout(timeout time.Duration) SessionOption {
+	return func(m *SessionMetadata) {
+		m.IdleTimeout = timeout
+	}
+}
+
+// NewSessionMetadata returns the metadata set by opts
+func NewSessionMetadata(opts ...SessionOption) SessionMetadata {
+	metadata := SessionMetadata{State: SessionStateActive}
+	for _, opt := range opts {
+		opt(&metadata)
+	}
+	return metadata
+}
+
+// AccountValidator decides whether an account is still allowed to have sessions, for instance that it hasn't been
+// disabled, locked, or deleted. It only returns an error if it couldn't tell.
+type AccountValidator func(ctx context.Context, accountID string) (allowed bool, err error)
+
 // SessionService backs user authentication -- providing a way to verify & modify session status
 type SessionService interface {
-	// UserDidAuthenticate creates a session for a newly logged in user
-	UserDidAuthenticate(accountID string) (sessionKey string, err error)
-	// GetSessionIfValid returns a session if the session is valid, or ErrValidSessionNotFound otherwise
-	GetSessionIfValid(sessionKey string) (session Session, err error)
+	// UserDidAuthenticate creates a session for a newly logged in user, with metadata set by opts
+	UserDidAuthenticate(ctx context.Context, accountID string, opts ...SessionOption) (sessionKey string, err error)
+	// UserWasRemembered creates a session for a user that was logged back in with a remember me token. It is at the
+	// lowest authentication level and has never been elevated, since the user hasn't proven anything.
+	UserWasRemembered(ctx context.Context, accountID string, opts ...SessionOption) (sessionKey string, err error)
+	// GetSessionIfValid returns a session if the session is valid, ErrSessionPending if the user hasn't finished logging in,
+	// or ErrValidSessionNotFound otherwise
+	GetSessionIfValid(ctx context.Context, sessionKey string) (session Session, err error)
+	// PeekSessionIfValid returns a session like GetSessionIfValid, without extending it
+	PeekSessionIfValid(ctx context.Context, sessionKey string) (session Session, err error)
+	// UserDidPartiallyAuthenticate creates a pending session for a user that has only completed the first step of logging in
+	UserDidPartiallyAuthenticate(ctx context.Context, accountID string, opts ...SessionOption) (sessionKey string, err error)
+	// UserDidCompleteAuthentication promotes a pending session to an active one at the given level, under a new key
+	UserDidCompleteAuthentication(ctx context.Context, pendingSessionKey string, level AuthLevel) (sessionKey string, err error)
+	// GetPendingSessionIfValid returns a pending session without extending it, or ErrValidSessionNotFound if the session
+	// is not pending
+	GetPendingSessionIfValid(ctx context.Context, sessionKey string) (session Session, err error)
+	// StartImpersonation creates a session for targetAccountID that is really used by the account of the valid session
+	// actorSessionKey, which is left as it is so that StopImpersonation can go back to it.
+	StartImpersonation(ctx context.Context, actorSessionKey string, targetAccountID string, opts ...SessionOption) (sessionKey string, err error)
+	// StopImpersonation ends an impersonation session and returns the actor's own session key, which may have changed,
+	// or ErrValidSessionNotFound if the actor's session has ended in the meantime.
+	StopImpersonation(ctx context.Context, sessionKey string) (actorSessionKey string, err error)
 	// UserDidLogout invalidates a session for a newly logged out user
-	UserDidLogout(sessionKey string) error
+	UserDidLogout(ctx context.Context, sessionKey string) error
+	// Elevate sets the authentication level of a valid session, and records that the user has just proven it.
+	// If the returned SessionKey differs from the one passed in, the client must be given the new one.
+	Elevate(ctx context.Context, sessionKey string, level AuthLevel) (session Session, err error)
+	// InvalidateAccountEpoch ends every session of an account at once by moving it on to a new epoch, see
+	// AccountEpochStorageService
+	InvalidateAccountEpoch(ctx context.Context, accountID string) error
+	// RevokeAccountSessions ends every session of an account, for instance once its remember me token has been stolen.
+	// It returns ErrAccountSessionsNotStored if the store can't find them and there are no account epochs to end them.
+	RevokeAccountSessions(ctx context.Context, accountID string) error
+}
+
+// HashSessionKey returns a short hash of a session key that is safe to log, so that
+// log lines about the same session can be tied together without revealing the key.
+func HashSessionKey(sessionKey string) string {
+	hashed := sha512.Sum512([]byte(sessionKey))
+	hexEncoded := hex.EncodeToString(hashed[:])
+	return hexEncoded[:12]
 }
@@ -1,24 +1,102 @@
 package domain
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type SessionStorageService interface {
 	// Close closes the storage connection
 	Close() error
 
 	// CreateSession creates a new session. It errors if a valid session already exists.
-	CreateSession(accountID string, sessionKey string, expirationDuration time.Duration) error
+	// The returned session's SessionKey is the key to hand to the client, which is not necessarily the one passed in.
+	CreateSession(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration) (Session, error)
 
-	// FetchPossiblyExpiredSession returns a session row by account ID regardless of wether it is expired
+	// ReplaceSessionForAccount atomically creates a new session with the given metadata for an account, ending the account's
+	// current session if it has one, valid or expired. If the metadata has an ActorAccountID, only that actor's
+	// impersonation of the account is replaced, and a session only replaces one in the same state, so that starting a login
+	// or being remembered doesn't end the account's active session. It returns the new session and the one it replaced, or
+	// nil if there was none.
+	// The returned session's SessionKey is the key to hand to the client, which is not necessarily the one passed in.
+	ReplaceSessionForAccount(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration, metadata SessionMetadata) (session Session, replaced *Session, err error)
+
+	// FetchPossiblyExpiredSession returns the account's own session regardless of whether it is expired, ignoring
+	// sessions that impersonate the account
 	// This is potentially dangerous, it is only intended to be used during the new login flow, never to check
 	// on a valid session for authentication purposes.
-	FetchPossiblyExpiredSession(accountID string) (Session, error)
+	FetchPossiblyExpiredSession(ctx context.Context, accountID string) (Session, error)
 
 	// DeleteSession removes a session record from the db
-	DeleteSession(sessionKey string) error
+	DeleteSession(ctx context.Context, sessionKey string) error
+
+	// DeleteAccountSessions removes every session of an account, including its impersonations of other accounts.
+	// It is not an error if there are none. Stores that can't find an account's sessions return ErrAccountSessionsNotStored.
+	DeleteAccountSessions(ctx context.Context, accountID string) error
 
-	// ExtendAndFetchSession fetches session data from the db
-	// On success it returns the session
+	// FetchSession fetches a valid session without extending it
 	// On failure, it can return ErrValidSessionNotFound, ErrSessionExpired, or an unexpected error
-	ExtendAndFetchSession(sessionKey string, expirationDuration time.Duration) (Session, error)
+	FetchSession(ctx context.Context, sessionKey string) (Session, error)
+
+	// ExtendAndFetchSession fetches session data from the db. Sessions are extended by their own IdleTimeout, or by
+	// expirationDuration if they have none. Pending sessions are fetched but never extended.
+	// On success it returns the session. If the returned SessionKey differs from the one passed in,
+	// the client must be given the new one.
+	// On failure, it can return ErrValidSessionNotFound, ErrSessionExpired, or an unexpected error
+	ExtendAndFetchSession(ctx context.Context, sessionKey string, expirationDuration time.Duration) (Session, error)
+
+	// UpdateSessionMetadata replaces the metadata of a valid session without extending it
+	// On success it returns the updated session. If the returned SessionKey differs from the one passed in,
+	// the client must be given the new one.
+	// On failure, it can return ErrValidSessionNotFound or an unexpected error
+	UpdateSessionMetadata(ctx context.Context, sessionKey string, metadata SessionMetadata) (Session, error)
+}
+
+// AccountEpochStorageService keeps a counter for each account, its epoch, that is moved on to end every session of the
+// account at once. Sessions are stamped with their account's epoch when they are created, and are no longer valid once
+// it has moved on, wherever they are kept. Accounts start at epoch 0.
+type AccountEpochStorageService interface {
+	// FetchAccountEpoch returns the account's current epoch
+	FetchAccountEpoch(ctx context.Context, accountID string) (int64, error)
+
+	// IncrementAccountEpoch moves the account on to a new epoch and returns it
+	IncrementAccountEpoch(ctx context.Context, accountID string) (int64, error)
+}
+
+// RememberTokenStorageService stores remember me tokens
+type RememberTokenStorageService interface {
+	// CreateRememberToken stores a new token
+	CreateRememberToken(ctx context.Context, token RememberToken) error
+
+	// FetchRememberToken returns a token by its selector, regardless of whether it is expired
+	// On failure, it can return ErrRememberTokenInvalid or an unexpected error
+	FetchRememberToken(ctx context.Context, selector string) (RememberToken, error)
+
+	// RotateRememberToken atomically gives the token with the same selector a new validator hash, previous validator hash,
+	// rotation date and expiration date, as long as its validator hash is still oldValidatorHash. It returns ErrRememberTokenInvalid if it isn't,
+	// for instance because a concurrent request rotated it, or if the token is gone.
+	RotateRememberToken(ctx context.Context, token RememberToken, oldValidatorHash string) error
+
+	// DeleteRememberToken removes a token, it is not an error if it doesn't exist
+	DeleteRememberToken(ctx context.Context, selector string) error
+
+	// DeleteAccountRememberTokens removes every token of an account
+	DeleteAccountRememberTokens(ctx context.Context, accountID string) error
+}
+
+// Revocation describes sessions that were ended: a single session if SessionHash is set,
+// otherwise every session of the account, including its impersonations of other accounts. It only holds the hash of the session key, see HashSessionKey,
+// since revocations are sent to other instances.
+type Revocation struct {
+	SessionHash string `json:"session_hash,omitempty"`
+	AccountID   string `json:"account_id"`
+}
+
+// RevocationHandler is notified of sessions that were ended, on this instance or any other
+type RevocationHandler interface {
+	// Revoke forgets about the revoked sessions
+	Revoke(revocation Revocation)
+
+	// Purge forgets about every session. It is called when revocations may have been missed.
+	Purge()
 }
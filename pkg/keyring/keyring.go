@@ -0,0 +1,64 @@
+// Package keyring signs and encrypts values with an ordered list of secret keys so that the keys can be rotated
+// without invalidating everything that was encoded with the old ones.
+package keyring
+
+import (
+	"errors"
+
+	"github.com/gorilla/securecookie"
+)
+
+// ErrUnknownKey is returned when a value could not be decoded with any key on the keyring
+var ErrUnknownKey = errors.New("Value was not encoded with any key on the keyring")
+
+// Keyring encodes with its newest key and decodes with any of them.
+type Keyring struct {
+	codecs []securecookie.Codec
+}
+
+// New returns a Keyring for the given hash and block keys. keyPairs are given in the same order as
+// securecookie.CodecsFromPairs, newest first. The block key of a pair may be nil, in which case values are signed
+// but not encrypted.
+func New(keyPairs ...[]byte) Keyring {
+	codecs := []securecookie.Codec{}
+	for i := 0; i < len(keyPairs); i += 2 {
+		var blockKey []byte
+		if i+1 < len(keyPairs) {
+			blockKey = keyPairs[i+1]
+		}
+
+		// Anything we encode carries its own expiration, so turn off securecookie's max age.
+		codec := securecookie.New(keyPairs[i], blockKey).
+			MaxAge(0).
+			SetSerializer(securecookie.JSONEncoder{})
+		codecs = append(codecs, codec)
+	}
+
+	return Keyring{
+		codecs,
+	}
+}
+
+// IsEmpty reports whether the keyring has no keys
+func (k Keyring) IsEmpty() bool {
+	return len(k.codecs) == 0
+}
+
+// Encode encodes value with the newest key. name is bound into the encoded value and must be passed to Decode.
+func (k Keyring) Encode(name string, value interface{}) (string, error) {
+	return securecookie.EncodeMulti(name, value, k.codecs...)
+}
+
+// Decode decodes an encoded value into dst with the first key that can.
+// stale is true when that was not the newest key, meaning the value should be encoded again.
+// It returns ErrUnknownKey if none of the keys can decode the value.
+func (k Keyring) Decode(name string, encoded string, dst interface{}) (stale bool, err error) {
+	for i, codec := range k.codecs {
+		decodeErr := codec.Decode(name, encoded, dst)
+		if decodeErr == nil {
+			return i > 0, nil
+		}
+	}
+
+	return false, ErrUnknownKey
+}
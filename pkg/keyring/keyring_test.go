@@ -0,0 +1,105 @@
+package keyring
+
+import (
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func newTestKeyPair() [][]byte {
+	return [][]byte{securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	keys := New(newTestKeyPair()...)
+
+	encoded, encodeErr := keys.Encode("test", "value")
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+
+	if encoded == "value" {
+		t.Fatal("The value should have been encoded")
+	}
+
+	var decoded string
+	stale, decodeErr := keys.Decode("test", encoded, &decoded)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+
+	if decoded != "value" {
+		t.Fatal("Didn't decode the same value", decoded)
+	}
+
+	if stale {
+		t.Fatal("The newest key shouldn't be stale")
+	}
+
+	// The name is bound into the encoded value
+	_, wrongNameErr := keys.Decode("other", encoded, &decoded)
+	if wrongNameErr != ErrUnknownKey {
+		t.Fatal("Should not decode a value encoded under a different name", wrongNameErr)
+	}
+}
+
+func TestOldKeysDecodeAsStale(t *testing.T) {
+	oldKeyPair := newTestKeyPair()
+	oldKeys := New(oldKeyPair...)
+
+	encoded, encodeErr := oldKeys.Encode("test", "value")
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+
+	rotatedKeys := New(append(newTestKeyPair(), oldKeyPair...)...)
+
+	var decoded string
+	stale, decodeErr := rotatedKeys.Decode("test", encoded, &decoded)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+
+	if !stale {
+		t.Fatal("A value encoded with an old key should be stale")
+	}
+
+	if decoded != "value" {
+		t.Fatal("Didn't decode the same value", decoded)
+	}
+
+	reencoded, encodeErr := rotatedKeys.Encode("test", decoded)
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+
+	stale, decodeErr = rotatedKeys.Decode("test", reencoded, &decoded)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+
+	if stale {
+		t.Fatal("A value encoded with the newest key should not be stale")
+	}
+}
+
+func TestUnknownKeysDoNotDecode(t *testing.T) {
+	keys := New(newTestKeyPair()...)
+	otherKeys := New(newTestKeyPair()...)
+
+	encoded, encodeErr := otherKeys.Encode("test", "value")
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+
+	var decoded string
+	_, decodeErr := keys.Decode("test", encoded, &decoded)
+	if decodeErr != ErrUnknownKey {
+		t.Fatal("Should not decode a value from somebody else's keys", decodeErr)
+	}
+
+	_, decodeErr = keys.Decode("test", "GARBAGE", &decoded)
+	if decodeErr != ErrUnknownKey {
+		t.Fatal("Should not decode garbage", decodeErr)
+	}
+}
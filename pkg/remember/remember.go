@@ -0,0 +1,222 @@
+// Package remember implements remember me tokens, which log an account back in once its session has ended.
+// Tokens follow the split token pattern: a selector to look the token up by, and a validator that is only stored
+// hashed and compared in constant time. Every validator is used once: exchanging a token keeps its selector and gives
+// it a new validator. So if a token is stolen, whichever of the thief and the user comes second presents a validator
+// that has already been replaced, and every token of the account is revoked.
+//
+// A client whose session has ended may well send several requests with the same token at once. Only one of them can
+// replace the validator, so the validator it replaced is still accepted for a short grace period, without being
+// replaced again, rather than being taken for a theft.
+package remember
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// tokenSeparator separates the selector from the validator in a token
+const tokenSeparator = "."
+
+// DefaultGracePeriod is how long a replaced validator is still accepted unless WithGracePeriod says otherwise
+const DefaultGracePeriod = 30 * time.Second
+
+// Service represents a RememberService internally
+type Service struct {
+	duration    time.Duration
+	gracePeriod time.Duration
+	store       domain.RememberTokenStorageService
+	log         domain.LogService
+	events      []domain.EventHandler
+}
+
+// Option configures optional behavior of a Service
+type Option func(*Service)
+
+// WithEventHandler has the Service notify the given handler when a stolen token is detected.
+// It can be passed more than once to notify several handlers.
+func WithEventHandler(handler domain.EventHandler) Option {
+	return func(s *Service) {
+		s.events = append(s.events, handler)
+	}
+}
+
+// WithGracePeriod sets how long the validator of a token is still accepted once it has been replaced, so that
+// concurrent requests with the same token don't look like a theft. 0 never accepts a replaced validator.
+func WithGracePeriod(gracePeriod time.Duration) Option {
+	return func(s *Service) {
+		s.gracePeriod = gracePeriod
+	}
+}
+
+// NewRememberService returns a RememberService whose tokens last for duration from when they are issued or exchanged
+func NewRememberService(duration time.Duration, store domain.RememberTokenStorageService, log domain.LogService, opts ...Option) *Service {
+	service := &Service{
+		duration:    duration,
+		gracePeriod: DefaultGracePeriod,
+		store:       store,
+		log:         log,
+	}
+
+	for _, opt := range opts {
+		opt(service)
+	}
+
+	return service
+}
+
+// emit notifies all the event handlers of an event
+func (s Service) emit(event domain.Event) {
+	for _, handler := range s.events {
+		handler.HandleEvent(event)
+	}
+}
+
+// randomHex returns n cryptographically random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	secureBytes := securecookie.GenerateRandomKey(n)
+	if secureBytes == nil {
+		return "", errors.New("Failed to generate random data for a token")
+	}
+
+	return hex.EncodeToString(secureBytes), nil
+}
+
+// hashValidator hashes a validator for storage
+func hashValidator(validator string) string {
+	hashed := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(hashed[:])
+}
+
+// matchesValidator reports whether a validator hashes to validatorHash, in constant time
+func matchesValidator(validator string, validatorHash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashValidator(validator)), []byte(validatorHash)) == 1
+}
+
+// newToken generates a token for an account with the given selector, returning the stored token and the token to hand
+// to the client
+func (s Service) newToken(accountID string, selector string) (domain.RememberToken, string, error) {
+	validator, validatorErr := randomHex(32)
+	if validatorErr != nil {
+		return domain.RememberToken{}, "", validatorErr
+	}
+
+	stored := domain.RememberToken{
+		Selector:       selector,
+		ValidatorHash:  hashValidator(validator),
+		AccountID:      accountID,
+		ExpirationDate: time.Now().UTC().Add(s.duration),
+	}
+
+	return stored, selector + tokenSeparator + validator, nil
+}
+
+// parseToken splits a token into its selector and validator
+func parseToken(token string) (selector string, validator string, err error) {
+	selector, validator, found := strings.Cut(token, tokenSeparator)
+	if !found || selector == "" || validator == "" {
+		return "", "", domain.ErrRememberTokenInvalid
+	}
+	return selector, validator, nil
+}
+
+// Remember issues a new token for the account
+func (s Service) Remember(ctx context.Context, accountID string) (string, time.Time, error) {
+	selector, selectorErr := randomHex(16)
+	if selectorErr != nil {
+		return "", time.Time{}, selectorErr
+	}
+
+	stored, token, newErr := s.newToken(accountID, selector)
+	if newErr != nil {
+		return "", time.Time{}, newErr
+	}
+
+	createErr := s.store.CreateRememberToken(ctx, stored)
+	if createErr != nil {
+		return "", time.Time{}, createErr
+	}
+
+	return token, stored.ExpirationDate, nil
+}
+
+// Exchange checks a token and gives it a new validator, returning the account it was issued to along with the new token.
+// A validator that was replaced within the grace period is still accepted, but the new token is empty since the request
+// that replaced it has already handed out the new one.
+// A token whose selector exists but whose validator doesn't match has been stolen, so every token of the account is
+// revoked and ErrRememberTokenStolen is returned along with the account.
+func (s Service) Exchange(ctx context.Context, token string) (string, string, time.Time, error) {
+	selector, validator, parseErr := parseToken(token)
+	if parseErr != nil {
+		return "", "", time.Time{}, parseErr
+	}
+
+	stored, fetchErr := s.store.FetchRememberToken(ctx, selector)
+	if fetchErr != nil {
+		return "", "", time.Time{}, fetchErr
+	}
+
+	if matchesValidator(validator, stored.ValidatorHash) {
+		if !stored.ExpirationDate.After(time.Now().UTC()) {
+			deleteErr := s.store.DeleteRememberToken(ctx, selector)
+			if deleteErr != nil {
+				return "", "", time.Time{}, deleteErr
+			}
+			return "", "", time.Time{}, domain.ErrRememberTokenInvalid
+		}
+
+		rotated, newToken, newErr := s.newToken(stored.AccountID, selector)
+		if newErr != nil {
+			return "", "", time.Time{}, newErr
+		}
+		rotated.PreviousValidatorHash = stored.ValidatorHash
+		rotated.RotatedAt = time.Now().UTC()
+
+		rotateErr := s.store.RotateRememberToken(ctx, rotated, stored.ValidatorHash)
+		if rotateErr == nil {
+			return stored.AccountID, newToken, rotated.ExpirationDate, nil
+		}
+		if rotateErr != domain.ErrRememberTokenInvalid {
+			return "", "", time.Time{}, rotateErr
+		}
+
+		// A concurrent request has replaced the validator first, see if it left this one in its grace period.
+		stored, fetchErr = s.store.FetchRememberToken(ctx, selector)
+		if fetchErr != nil {
+			return "", "", time.Time{}, fetchErr
+		}
+	}
+
+	if stored.PreviousValidatorHash != "" && matchesValidator(validator, stored.PreviousValidatorHash) &&
+		stored.RotatedAt.Add(s.gracePeriod).After(time.Now().UTC()) {
+		return stored.AccountID, "", time.Time{}, nil
+	}
+
+	revokeErr := s.store.DeleteAccountRememberTokens(ctx, stored.AccountID)
+	if revokeErr != nil {
+		return "", "", time.Time{}, revokeErr
+	}
+
+	s.log.WarnError(domain.RememberTokenStolen, domain.ErrRememberTokenStolen, domain.LogFields{"account_id": stored.AccountID})
+	s.emit(domain.Event{Type: domain.EventRememberTokenStolen, AccountID: stored.AccountID})
+
+	return stored.AccountID, "", time.Time{}, domain.ErrRememberTokenStolen
+}
+
+// Forget revokes a token. Tokens that can't be parsed or don't exist are already as good as forgotten.
+func (s Service) Forget(ctx context.Context, token string) error {
+	selector, _, parseErr := parseToken(token)
+	if parseErr != nil {
+		return nil
+	}
+
+	return s.store.DeleteRememberToken(ctx, selector)
+}
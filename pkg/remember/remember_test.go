@@ -0,0 +1,283 @@
+package remember
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// memoryTokenStore is a RememberTokenStorageService that keeps tokens in a map
+type memoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]domain.RememberToken
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{
+		tokens: map[string]domain.RememberToken{},
+	}
+}
+
+func (s *memoryTokenStore) CreateRememberToken(ctx context.Context, token domain.RememberToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.Selector] = token
+	return nil
+}
+
+func (s *memoryTokenStore) FetchRememberToken(ctx context.Context, selector string) (domain.RememberToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[selector]
+	if !ok {
+		return domain.RememberToken{}, domain.ErrRememberTokenInvalid
+	}
+	return token, nil
+}
+
+func (s *memoryTokenStore) RotateRememberToken(ctx context.Context, token domain.RememberToken, oldValidatorHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.tokens[token.Selector]
+	if !ok || old.ValidatorHash != oldValidatorHash {
+		return domain.ErrRememberTokenInvalid
+	}
+	s.tokens[token.Selector] = token
+	return nil
+}
+
+func (s *memoryTokenStore) DeleteRememberToken(ctx context.Context, selector string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, selector)
+	return nil
+}
+
+func (s *memoryTokenStore) DeleteAccountRememberTokens(ctx context.Context, accountID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for selector, token := range s.tokens {
+		if token.AccountID == accountID {
+			delete(s.tokens, selector)
+		}
+	}
+	return nil
+}
+
+func TestTokensAreRotatedWhenExchanged(t *testing.T) {
+	store := newMemoryTokenStore()
+	service := NewRememberService(24*time.Hour, store, domain.FmtLogger(true))
+	ctx := context.Background()
+
+	token, expirationDate, rememberErr := service.Remember(ctx, "FOO")
+	if rememberErr != nil {
+		t.Fatal(rememberErr)
+	}
+
+	if !expirationDate.After(time.Now().Add(23 * time.Hour)) {
+		t.Fatal("The token should last for the whole duration", expirationDate)
+	}
+
+	selector, validator, _ := parseToken(token)
+	stored := store.tokens[selector]
+	if stored.ValidatorHash == validator || stored.ValidatorHash != hashValidator(validator) {
+		t.Fatal("Only the hash of the validator should be stored", stored)
+	}
+
+	accountID, newToken, _, exchangeErr := service.Exchange(ctx, token)
+	if exchangeErr != nil {
+		t.Fatal(exchangeErr)
+	}
+
+	if accountID != "FOO" {
+		t.Fatal("Should have returned the account the token was issued to", accountID)
+	}
+
+	if newToken == token || !strings.HasPrefix(newToken, selector+tokenSeparator) {
+		t.Fatal("The token should have kept its selector and gotten a new validator", token, newToken)
+	}
+
+	accountID, _, _, exchangeErr = service.Exchange(ctx, newToken)
+	if exchangeErr != nil || accountID != "FOO" {
+		t.Fatal("The new token should be good", accountID, exchangeErr)
+	}
+}
+
+func TestReusedTokenRevokesTheAccountsTokens(t *testing.T) {
+	store := newMemoryTokenStore()
+
+	events := []domain.Event{}
+	recordEvent := domain.EventHandlerFunc(func(event domain.Event) {
+		events = append(events, event)
+	})
+
+	service := NewRememberService(24*time.Hour, store, domain.FmtLogger(true), WithEventHandler(recordEvent))
+	ctx := context.Background()
+
+	stolenToken, _, rememberErr := service.Remember(ctx, "FOO")
+	if rememberErr != nil {
+		t.Fatal(rememberErr)
+	}
+
+	otherDeviceToken, _, rememberErr := service.Remember(ctx, "FOO")
+	if rememberErr != nil {
+		t.Fatal(rememberErr)
+	}
+
+	otherAccountToken, _, rememberErr := service.Remember(ctx, "BAR")
+	if rememberErr != nil {
+		t.Fatal(rememberErr)
+	}
+
+	// The thief uses the token first
+	_, thiefToken, _, exchangeErr := service.Exchange(ctx, stolenToken)
+	if exchangeErr != nil {
+		t.Fatal(exchangeErr)
+	}
+
+	// and then the user does, once the grace period for concurrent requests is over
+	selector, _, _ := parseToken(stolenToken)
+	stored := store.tokens[selector]
+	stored.RotatedAt = time.Now().UTC().Add(-DefaultGracePeriod)
+	store.tokens[selector] = stored
+
+	accountID, _, _, stolenErr := service.Exchange(ctx, stolenToken)
+	if stolenErr != domain.ErrRememberTokenStolen || accountID != "FOO" {
+		t.Fatal("Should have detected the stolen token", accountID, stolenErr)
+	}
+
+	if len(events) != 1 || events[0].Type != domain.EventRememberTokenStolen || events[0].AccountID != "FOO" {
+		t.Fatal("Should have emitted a stolen token event", events)
+	}
+
+	for _, revoked := range []string{thiefToken, otherDeviceToken} {
+		_, _, _, revokedErr := service.Exchange(ctx, revoked)
+		if revokedErr != domain.ErrRememberTokenInvalid {
+			t.Fatal("Every token of the account should have been revoked", revokedErr)
+		}
+	}
+
+	_, _, _, otherErr := service.Exchange(ctx, otherAccountToken)
+	if otherErr != nil {
+		t.Fatal("Other accounts' tokens should be left alone", otherErr)
+	}
+}
+
+// racingTokenStore is a memoryTokenStore that runs beforeRotate once, just before the first rotation, to stand in for a
+// concurrent request that gets there first
+type racingTokenStore struct {
+	*memoryTokenStore
+	beforeRotate func()
+}
+
+func (s *racingTokenStore) RotateRememberToken(ctx context.Context, token domain.RememberToken, oldValidatorHash string) error {
+	if s.beforeRotate != nil {
+		beforeRotate := s.beforeRotate
+		s.beforeRotate = nil
+		beforeRotate()
+	}
+	return s.memoryTokenStore.RotateRememberToken(ctx, token, oldValidatorHash)
+}
+
+func TestConcurrentExchangesAreNotATheft(t *testing.T) {
+	store := &racingTokenStore{memoryTokenStore: newMemoryTokenStore()}
+	service := NewRememberService(24*time.Hour, store, domain.FmtLogger(true))
+	ctx := context.Background()
+
+	token, _, rememberErr := service.Remember(ctx, "FOO")
+	if rememberErr != nil {
+		t.Fatal(rememberErr)
+	}
+
+	winnerToken := ""
+	store.beforeRotate = func() {
+		_, newToken, _, winnerErr := service.Exchange(ctx, token)
+		if winnerErr != nil {
+			t.Fatal(winnerErr)
+		}
+		winnerToken = newToken
+	}
+
+	// This exchange loses the race to replace the validator
+	accountID, newToken, _, loserErr := service.Exchange(ctx, token)
+	if loserErr != nil || accountID != "FOO" {
+		t.Fatal("The request that lost the race should still be logged in", accountID, loserErr)
+	}
+	if newToken != "" {
+		t.Fatal("Only the request that won the race should hand out a new token", newToken)
+	}
+
+	// and so does one that comes in just after it with the same token
+	accountID, newToken, _, lateErr := service.Exchange(ctx, token)
+	if lateErr != nil || accountID != "FOO" || newToken != "" {
+		t.Fatal("The replaced validator should be accepted for the grace period", accountID, newToken, lateErr)
+	}
+
+	selector, _, _ := parseToken(token)
+	_, winnerValidator, _ := parseToken(winnerToken)
+	stored := store.tokens[selector]
+	if stored.ValidatorHash != hashValidator(winnerValidator) {
+		t.Fatal("The validator should only have been replaced once", stored)
+	}
+
+	// Once the grace period is over, the replaced validator is taken for a theft.
+	stored.RotatedAt = time.Now().UTC().Add(-DefaultGracePeriod)
+	store.tokens[selector] = stored
+
+	_, _, _, stolenErr := service.Exchange(ctx, token)
+	if stolenErr != domain.ErrRememberTokenStolen {
+		t.Fatal("A validator replaced before the grace period should be taken for a theft", stolenErr)
+	}
+}
+
+func TestExpiredTokensAreInvalid(t *testing.T) {
+	store := newMemoryTokenStore()
+	service := NewRememberService(-time.Minute, store, domain.FmtLogger(true))
+	ctx := context.Background()
+
+	token, _, rememberErr := service.Remember(ctx, "FOO")
+	if rememberErr != nil {
+		t.Fatal(rememberErr)
+	}
+
+	_, _, _, exchangeErr := service.Exchange(ctx, token)
+	if exchangeErr != domain.ErrRememberTokenInvalid {
+		t.Fatal("An expired token should be invalid", exchangeErr)
+	}
+
+	if len(store.tokens) != 0 {
+		t.Fatal("The expired token should have been deleted", store.tokens)
+	}
+}
+
+func TestForgottenTokensAreInvalid(t *testing.T) {
+	store := newMemoryTokenStore()
+	service := NewRememberService(24*time.Hour, store, domain.FmtLogger(true))
+	ctx := context.Background()
+
+	token, _, rememberErr := service.Remember(ctx, "FOO")
+	if rememberErr != nil {
+		t.Fatal(rememberErr)
+	}
+
+	forgetErr := service.Forget(ctx, token)
+	if forgetErr != nil {
+		t.Fatal(forgetErr)
+	}
+
+	_, _, _, exchangeErr := service.Exchange(ctx, token)
+	if exchangeErr != domain.ErrRememberTokenInvalid {
+		t.Fatal("A forgotten token should be invalid", exchangeErr)
+	}
+
+	for _, garbage := range []string{"", "nodot", ".validator", "selector."} {
+		_, _, _, garbageErr := service.Exchange(ctx, garbage)
+		if garbageErr != domain.ErrRememberTokenInvalid {
+			t.Fatal("A malformed token should be invalid", garbage, garbageErr)
+		}
+	}
+}
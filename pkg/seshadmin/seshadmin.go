@@ -0,0 +1,287 @@
+// Package seshadmin is an HTTP API for operators to find and end sessions, like those of a compromised account.
+package seshadmin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/seshttp"
+)
+
+// defaults for a Handler
+const (
+	DefaultExpiringWithin = 5 * time.Minute
+	DefaultTopAccounts    = 10
+)
+
+// Authorizer decides whether a request may manage sessions. It is called before every request to the Handler, which
+// is usually behind the AuthenticationMiddleware, so the Authorizer can look at the session of the admin making it.
+type Authorizer func(r *http.Request) bool
+
+// SessionInfo describes a session without giving away its key
+type SessionInfo struct {
+	// ID is the domain.HashSessionKey of the session, which identifies it in the API and in the logs
+	ID                 string              `json:"id"`
+	AccountID          string              `json:"account_id"`
+	ExpiresAt          time.Time           `json:"expires_at"`
+	Expired            bool                `json:"expired"`
+	State              domain.SessionState `json:"state"`
+	AuthLevel          string              `json:"auth_level"`
+	ElevatedAt         time.Time           `json:"elevated_at"`
+	ActorAccountID     string              `json:"actor_account_id,omitempty"`
+	IdleTimeoutSeconds int                 `json:"idle_timeout_seconds,omitempty"`
+	Fingerprinted      bool                `json:"fingerprinted"`
+}
+
+// NewSessionInfo describes a session
+func NewSessionInfo(session domain.Session) SessionInfo {
+	state := session.State
+	if state == "" {
+		state = domain.SessionStateActive
+	}
+
+	return SessionInfo{
+		ID:                 domain.HashSessionKey(session.SessionKey),
+		AccountID:          session.AccountID,
+		ExpiresAt:          session.ExpirationDate.UTC(),
+		Expired:            !session.ExpirationDate.After(time.Now()),
+		State:              state,
+		AuthLevel:          session.AuthLevel.String(),
+		ElevatedAt:         session.ElevatedAt.UTC(),
+		ActorAccountID:     session.ActorAccountID,
+		IdleTimeoutSeconds: int(session.IdleTimeout.Seconds()),
+		Fingerprinted:      session.Fingerprint != "",
+	}
+}
+
+// Handler serves a JSON API to manage sessions. Mount it under a prefix with http.StripPrefix. Its endpoints are:
+//
+//	GET    /accounts/{accountID}/sessions  lists the sessions of an account
+//	DELETE /accounts/{accountID}/sessions  revokes every session of an account
+//	GET    /sessions/{id}                  describes a session
+//	DELETE /sessions/{id}                  revokes a session
+//	GET    /stats                          counts the sessions, see domain.SessionStats
+//
+// Sessions are described with SessionInfo, and identified by its ID. Requests the Authorizer rejects are turned away
+// with 403 Forbidden. Revoking a session is logged and emits domain.EventSessionDestroyed with domain.ReasonRevoked.
+type Handler struct {
+	log            domain.LogService
+	store          domain.SessionAdminStorageService
+	authorize      Authorizer
+	events         []domain.EventHandler
+	revocations    []domain.RevocationHandler
+	tokens         domain.RememberTokenStorageService
+	expiringWithin time.Duration
+	topAccounts    int
+	mux            *http.ServeMux
+}
+
+// Option configures optional behavior of a Handler
+type Option func(*Handler)
+
+// WithEventHandler has the Handler notify the given handler of the sessions it revokes.
+// It can be passed more than once to notify several handlers.
+func WithEventHandler(handler domain.EventHandler) Option {
+	return func(h *Handler) {
+		h.events = append(h.events, handler)
+	}
+}
+
+// WithRevocationHandler has the Handler tell the given handler about the sessions it revokes, so that a cache in
+// front of the store can drop them. It can be passed more than once to tell several handlers.
+func WithRevocationHandler(handler domain.RevocationHandler) Option {
+	return func(h *Handler) {
+		h.revocations = append(h.revocations, handler)
+	}
+}
+
+// WithRememberTokens has the Handler also delete the remember me tokens of accounts whose sessions it revokes, so that
+// they can't log right back in
+func WithRememberTokens(tokens domain.RememberTokenStorageService) Option {
+	return func(h *Handler) {
+		h.tokens = tokens
+	}
+}
+
+// WithStats sets the window sessions are counted as expiring soon in, and how many of the accounts with the most
+// sessions are listed by the stats endpoint. They default to DefaultExpiringWithin and DefaultTopAccounts.
+func WithStats(expiringWithin time.Duration, topAccounts int) Option {
+	return func(h *Handler) {
+		h.expiringWithin = expiringWithin
+		h.topAccounts = topAccounts
+	}
+}
+
+// NewHandler returns a Handler that manages the sessions in store, for requests that authorize allows
+func NewHandler(log domain.LogService, store domain.SessionAdminStorageService, authorize Authorizer, opts ...Option) *Handler {
+	handler := &Handler{
+		log:            log,
+		store:          store,
+		authorize:      authorize,
+		expiringWithin: DefaultExpiringWithin,
+		topAccounts:    DefaultTopAccounts,
+		mux:            http.NewServeMux(),
+	}
+
+	for _, opt := range opts {
+		opt(handler)
+	}
+
+	handler.mux.HandleFunc("GET /accounts/{accountID}/sessions", handler.listAccountSessions)
+	handler.mux.HandleFunc("DELETE /accounts/{accountID}/sessions", handler.revokeAccountSessions)
+	handler.mux.HandleFunc("GET /sessions/{id}", handler.inspectSession)
+	handler.mux.HandleFunc("DELETE /sessions/{id}", handler.revokeSession)
+	handler.mux.HandleFunc("GET /stats", handler.stats)
+
+	return handler
+}
+
+// emit notifies all the event handlers of an event
+func (h *Handler) emit(event domain.Event) {
+	for _, handler := range h.events {
+		handler.HandleEvent(event)
+	}
+}
+
+// revoke tells all the revocation handlers about a revocation
+func (h *Handler) revoke(revocation domain.Revocation) {
+	for _, handler := range h.revocations {
+		handler.Revoke(revocation)
+	}
+}
+
+// ServeHTTP routes authorized requests to their endpoint
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.authorize == nil || !h.authorize(r) {
+		h.log.Info(domain.AdminRequestDenied, domain.LogFields{"method": r.Method, "path": r.URL.Path})
+		seshttp.RespondWithStructuredError(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+// respond writes body as JSON
+func (h *Handler) respond(w http.ResponseWriter, body interface{}) {
+	bodyJSON, encodeErr := json.Marshal(body)
+	if encodeErr != nil {
+		h.fail(w, encodeErr, domain.LogFields{})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(bodyJSON)
+}
+
+// fail logs an unexpected error and responds with 500 Internal Server Error
+func (h *Handler) fail(w http.ResponseWriter, err error, fields domain.LogFields) {
+	h.log.WarnError(domain.SessionUnexpectedError, err, fields)
+	seshttp.RespondWithStructuredError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// fetchSession returns the session identified in the path, or responds with an error and returns false
+func (h *Handler) fetchSession(w http.ResponseWriter, r *http.Request) (domain.Session, bool) {
+	sessionHash := r.PathValue("id")
+
+	session, fetchErr := h.store.FetchSessionByHash(r.Context(), sessionHash)
+	if fetchErr != nil {
+		if fetchErr == domain.ErrValidSessionNotFound {
+			seshttp.RespondWithStructuredError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return domain.Session{}, false
+		}
+		h.fail(w, fetchErr, domain.LogFields{"session_hash": sessionHash})
+		return domain.Session{}, false
+	}
+
+	return session, true
+}
+
+func (h *Handler) listAccountSessions(w http.ResponseWriter, r *http.Request) {
+	accountID := r.PathValue("accountID")
+
+	sessions, listErr := h.store.ListAccountSessions(r.Context(), accountID)
+	if listErr != nil {
+		h.fail(w, listErr, domain.LogFields{"account_id": accountID})
+		return
+	}
+
+	infos := []SessionInfo{}
+	for _, session := range sessions {
+		infos = append(infos, NewSessionInfo(session))
+	}
+
+	h.respond(w, infos)
+}
+
+func (h *Handler) revokeAccountSessions(w http.ResponseWriter, r *http.Request) {
+	accountID := r.PathValue("accountID")
+
+	deleteErr := h.store.DeleteAccountSessions(r.Context(), accountID)
+	if deleteErr != nil {
+		h.fail(w, deleteErr, domain.LogFields{"account_id": accountID})
+		return
+	}
+
+	if h.tokens != nil {
+		forgetErr := h.tokens.DeleteAccountRememberTokens(r.Context(), accountID)
+		if forgetErr != nil {
+			h.fail(w, forgetErr, domain.LogFields{"account_id": accountID})
+			return
+		}
+	}
+
+	h.revoke(domain.Revocation{AccountID: accountID})
+	h.log.Info(domain.AccountSessionsRevoked, domain.LogFields{"account_id": accountID})
+	h.emit(domain.Event{Type: domain.EventSessionDestroyed, AccountID: accountID, Reason: domain.ReasonRevoked})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) inspectSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.fetchSession(w, r)
+	if !ok {
+		return
+	}
+
+	h.respond(w, NewSessionInfo(session))
+}
+
+func (h *Handler) revokeSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.fetchSession(w, r)
+	if !ok {
+		return
+	}
+
+	sessionHash := domain.HashSessionKey(session.SessionKey)
+	deleteErr := h.store.DeleteSession(r.Context(), session.SessionKey)
+	// It is fine if the session went away on its own in the meantime.
+	if deleteErr != nil && deleteErr != domain.ErrValidSessionNotFound {
+		h.fail(w, deleteErr, domain.LogFields{"session_hash": sessionHash})
+		return
+	}
+
+	h.revoke(domain.Revocation{SessionHash: sessionHash, AccountID: session.AccountID})
+	h.log.Info(domain.SessionRevoked, domain.LogFields{"session_hash": sessionHash, "account_id": session.AccountID})
+	h.emit(domain.Event{
+		Type:           domain.EventSessionDestroyed,
+		SessionHash:    sessionHash,
+		AccountID:      session.AccountID,
+		ActorAccountID: session.ActorAccountID,
+		Reason:         domain.ReasonRevoked,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	stats, statsErr := h.store.SessionStats(r.Context(), h.expiringWithin, h.topAccounts)
+	if statsErr != nil {
+		h.fail(w, statsErr, domain.LogFields{})
+		return
+	}
+
+	h.respond(w, stats)
+}
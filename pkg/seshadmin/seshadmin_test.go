@@ -0,0 +1,200 @@
+package seshadmin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// memoryStore is a SessionAdminStorageService that keeps sessions in a map
+type memoryStore struct {
+	domain.SessionAdminStorageService
+	sessions map[string]domain.Session
+}
+
+func (s *memoryStore) ListAccountSessions(ctx context.Context, accountID string) ([]domain.Session, error) {
+	sessions := []domain.Session{}
+	for _, session := range s.sessions {
+		if session.AccountID == accountID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *memoryStore) FetchSessionByHash(ctx context.Context, sessionHash string) (domain.Session, error) {
+	for key, session := range s.sessions {
+		if domain.HashSessionKey(key) == sessionHash {
+			return session, nil
+		}
+	}
+	return domain.Session{}, domain.ErrValidSessionNotFound
+}
+
+func (s *memoryStore) DeleteSession(ctx context.Context, sessionKey string) error {
+	delete(s.sessions, sessionKey)
+	return nil
+}
+
+func (s *memoryStore) DeleteAccountSessions(ctx context.Context, accountID string) error {
+	for key, session := range s.sessions {
+		if session.AccountID == accountID {
+			delete(s.sessions, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SessionStats(ctx context.Context, expiringWithin time.Duration, topAccounts int) (domain.SessionStats, error) {
+	return domain.SessionStats{Active: len(s.sessions)}, nil
+}
+
+// recordedRevocations is a RevocationHandler that remembers what it was told
+type recordedRevocations struct {
+	domain.RevocationHandler
+	revocations []domain.Revocation
+}
+
+func (r *recordedRevocations) Revoke(revocation domain.Revocation) {
+	r.revocations = append(r.revocations, revocation)
+}
+
+// getTestObjects returns a Handler that allows every request, managing a store with two sessions of "alice" and one
+// of "bob"
+func getTestObjects(t *testing.T, opts ...Option) (*Handler, *memoryStore) {
+	t.Helper()
+
+	expiration := time.Now().Add(time.Hour)
+	store := &memoryStore{sessions: map[string]domain.Session{
+		"ALICE_1": {AccountID: "alice", SessionKey: "ALICE_1", ExpirationDate: expiration},
+		"ALICE_2": {AccountID: "alice", SessionKey: "ALICE_2", ExpirationDate: expiration},
+		"BOB":     {AccountID: "bob", SessionKey: "BOB", ExpirationDate: expiration},
+	}}
+	allowAll := func(r *http.Request) bool { return true }
+
+	return NewHandler(domain.FmtLogger(true), store, allowAll, opts...), store
+}
+
+func serve(handler http.Handler, method string, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestRequestsMustBeAuthorized(t *testing.T) {
+	store := &memoryStore{sessions: map[string]domain.Session{}}
+
+	denyAll := NewHandler(domain.FmtLogger(true), store, func(r *http.Request) bool { return false })
+	if w := serve(denyAll, "GET", "/stats"); w.Code != http.StatusForbidden {
+		t.Fatal("Requests the authorizer rejects should be forbidden", w.Code)
+	}
+
+	unconfigured := NewHandler(domain.FmtLogger(true), store, nil)
+	if w := serve(unconfigured, "GET", "/stats"); w.Code != http.StatusForbidden {
+		t.Fatal("Every request should be forbidden without an authorizer", w.Code)
+	}
+}
+
+func TestSessionsAreListedWithoutTheirKeys(t *testing.T) {
+	handler, _ := getTestObjects(t)
+
+	w := serve(handler, "GET", "/accounts/alice/sessions")
+	if w.Code != http.StatusOK {
+		t.Fatal("Should have listed the sessions", w.Code)
+	}
+
+	infos := []SessionInfo{}
+	decodeErr := json.Unmarshal(w.Body.Bytes(), &infos)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if len(infos) != 2 {
+		t.Fatal("Should have listed both of alice's sessions", infos)
+	}
+	for _, info := range infos {
+		if info.AccountID != "alice" || info.Expired || info.State != domain.SessionStateActive {
+			t.Fatal("Should have described the session", info)
+		}
+		if info.ID != domain.HashSessionKey("ALICE_1") && info.ID != domain.HashSessionKey("ALICE_2") {
+			t.Fatal("Sessions should be identified by their hash", info.ID)
+		}
+	}
+
+	inspected := serve(handler, "GET", "/sessions/"+domain.HashSessionKey("BOB"))
+	info := SessionInfo{}
+	decodeErr = json.Unmarshal(inspected.Body.Bytes(), &info)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if info.AccountID != "bob" {
+		t.Fatal("Should have described bob's session", info)
+	}
+
+	if w := serve(handler, "GET", "/sessions/nope"); w.Code != http.StatusNotFound {
+		t.Fatal("Unknown sessions should not be found", w.Code)
+	}
+}
+
+func TestSessionsCanBeRevoked(t *testing.T) {
+	events := []domain.Event{}
+	revocations := &recordedRevocations{}
+	handler, store := getTestObjects(t,
+		WithEventHandler(domain.EventHandlerFunc(func(event domain.Event) { events = append(events, event) })),
+		WithRevocationHandler(revocations),
+	)
+
+	if w := serve(handler, "DELETE", "/sessions/"+domain.HashSessionKey("BOB")); w.Code != http.StatusNoContent {
+		t.Fatal("Should have revoked the session", w.Code)
+	}
+	if _, ok := store.sessions["BOB"]; ok {
+		t.Fatal("The session should have been deleted")
+	}
+	if len(revocations.revocations) != 1 || revocations.revocations[0].SessionHash != domain.HashSessionKey("BOB") {
+		t.Fatal("Should have told the revocation handler about the session", revocations.revocations)
+	}
+
+	if w := serve(handler, "DELETE", "/accounts/alice/sessions"); w.Code != http.StatusNoContent {
+		t.Fatal("Should have revoked the account's sessions", w.Code)
+	}
+	if len(store.sessions) != 0 {
+		t.Fatal("Every session of the account should have been deleted", store.sessions)
+	}
+	if len(revocations.revocations) != 2 || revocations.revocations[1] != (domain.Revocation{AccountID: "alice"}) {
+		t.Fatal("Should have told the revocation handler about the account", revocations.revocations)
+	}
+
+	if len(events) != 2 {
+		t.Fatal("Should have emitted an event for each revocation", events)
+	}
+	for _, event := range events {
+		if event.Type != domain.EventSessionDestroyed || event.Reason != domain.ReasonRevoked {
+			t.Fatal("Should have emitted a revocation", event)
+		}
+	}
+	if events[0].SessionHash != domain.HashSessionKey("BOB") || events[1].AccountID != "alice" {
+		t.Fatal("The events should say what was revoked", events)
+	}
+}
+
+func TestStatsAreCounted(t *testing.T) {
+	handler, _ := getTestObjects(t)
+
+	w := serve(handler, "GET", "/stats")
+	if w.Code != http.StatusOK {
+		t.Fatal("Should have counted the sessions", w.Code)
+	}
+
+	stats := domain.SessionStats{}
+	decodeErr := json.Unmarshal(w.Body.Bytes(), &stats)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if stats.Active != 3 {
+		t.Fatal("Should have returned the store's stats", stats)
+	}
+}
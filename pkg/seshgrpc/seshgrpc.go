@@ -0,0 +1,295 @@
+// Package seshgrpc authenticates gRPC calls with sesh sessions, so that gRPC services can honor the same sessions as
+// the HTTP handlers behind the AuthenticationMiddleware.
+package seshgrpc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/seshttp"
+)
+
+// metadata keys the session is read from
+const (
+	// AuthorizationMetadata holds "Bearer " and a session token, see seshttp.SessionCookieService.SessionToken
+	AuthorizationMetadata = "authorization"
+	// CookieMetadata holds the Cookie header of an HTTP request, forwarded by a gateway
+	CookieMetadata = "cookie"
+	// GatewayCookieMetadata is how grpc-gateway forwards the Cookie header
+	GatewayCookieMetadata = "grpcgateway-cookie"
+	// GatewayUserAgentMetadata is how grpc-gateway forwards the User-Agent header, which fingerprints use instead of
+	// the gateway's own user-agent metadata
+	GatewayUserAgentMetadata = "grpcgateway-user-agent"
+)
+
+// bearerPrefix starts authorization metadata holding a token
+const bearerPrefix = "Bearer "
+
+// Interceptor authenticates gRPC calls. Its interceptors put the session in the context of every call they let through,
+// where seshttp.SessionFromContext and sesh.SessionFromContext find it. Calls without a valid session fail with
+// codes.Unauthenticated, and so do calls from a client that doesn't match the session's fingerprint, see
+// WithFingerprintPolicy.
+//
+// Sessions are extended by every call, but a new session key can't be handed back, so the stateless cookiestore's
+// sessions are only extended by HTTP requests.
+type Interceptor struct {
+	log         domain.LogService
+	session     domain.SessionService
+	cookie      seshttp.SessionCookieService
+	events      []domain.EventHandler
+	public      map[string]bool
+	limiter     seshttp.RateLimiter
+	clientKey   func(r *http.Request) string
+	fingerprint *seshttp.FingerprintPolicy
+}
+
+// Option configures optional behavior of an Interceptor
+type Option func(*Interceptor)
+
+// WithEventHandler has the Interceptor notify the given handler of calls it turns away before they reach the
+// SessionService. It can be passed more than once to notify several handlers.
+func WithEventHandler(handler domain.EventHandler) Option {
+	return func(i *Interceptor) {
+		i.events = append(i.events, handler)
+	}
+}
+
+// WithPublicMethods lets calls to the given methods through without a session, like the one that logs in.
+// Methods are named in full, like "/package.Service/Method".
+func WithPublicMethods(fullMethods ...string) Option {
+	return func(i *Interceptor) {
+		for _, method := range fullMethods {
+			i.public[method] = true
+		}
+	}
+}
+
+// WithRateLimiter has the Interceptor count calls with invalid sessions against their client, like
+// seshttp.WithRateLimiter does for requests. Once a client has used up its limit, its calls fail with
+// codes.ResourceExhausted before their session is even looked up. If the limiter fails, calls are let through.
+// Pass the same limiter as the HTTP middleware's, so that a client can't get around its limit by switching protocols.
+func WithRateLimiter(limiter seshttp.RateLimiter) Option {
+	return func(i *Interceptor) {
+		i.limiter = limiter
+	}
+}
+
+// WithClientKey sets how clients are told apart for rate limiting. It defaults to seshttp.RemoteIP, which is the peer's
+// address. It is given the call as a request, see callRequest.
+func WithClientKey(clientKey func(r *http.Request) string) Option {
+	return func(i *Interceptor) {
+		i.clientKey = clientKey
+	}
+}
+
+// WithFingerprintPolicy has the Interceptor check that sessions are used by the client that logged in, like
+// seshttp.WithFingerprintPolicy does for requests. Pass the same policy as the HTTP middleware's. Its Fingerprinter is
+// given the call as a request, see callRequest, so calls through a gateway are fingerprinted by the user agent it
+// forwards, but by the gateway's address.
+func WithFingerprintPolicy(policy seshttp.FingerprintPolicy) Option {
+	return func(i *Interceptor) {
+		i.fingerprint = &policy
+	}
+}
+
+// NewInterceptor returns an Interceptor that checks sessions with the given SessionService. cookie verifies session
+// cookies and tokens, it must have the same keys as the one that issued them.
+func NewInterceptor(log domain.LogService, session domain.SessionService, cookie seshttp.SessionCookieService, opts ...Option) *Interceptor {
+	interceptor := &Interceptor{
+		log:       log,
+		session:   session,
+		cookie:    cookie,
+		public:    map[string]bool{},
+		clientKey: seshttp.RemoteIP,
+	}
+
+	for _, opt := range opts {
+		opt(interceptor)
+	}
+
+	return interceptor
+}
+
+// emit notifies all the event handlers of an event
+func (i *Interceptor) emit(event domain.Event) {
+	for _, handler := range i.events {
+		handler.HandleEvent(event)
+	}
+}
+
+// callRequest describes a call as an HTTP request, so that fingerprints and client keys written for requests work on
+// calls too. Its RemoteAddr is the peer's address and its headers are the call's metadata, with the user agent
+// forwarded by a gateway in place of the gateway's own.
+func callRequest(ctx context.Context, md metadata.MD) *http.Request {
+	r := &http.Request{Header: http.Header{}}
+	for key, values := range md {
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+
+	if gatewayUserAgent := md.Get(GatewayUserAgentMetadata); len(gatewayUserAgent) > 0 {
+		r.Header.Set("User-Agent", gatewayUserAgent[0])
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	return r
+}
+
+// rateLimited returns a status error if the client has made too many calls with invalid sessions
+func (i *Interceptor) rateLimited(ctx context.Context, clientKey string) error {
+	retryAfter := seshttp.RateLimitClient(ctx, i.limiter, clientKey, i.log, domain.EventHandlerFunc(i.emit))
+	if retryAfter <= 0 {
+		return nil
+	}
+
+	return status.Error(codes.ResourceExhausted, domain.RequestRateLimited)
+}
+
+// failed counts a call with an invalid session against its client
+func (i *Interceptor) failed(ctx context.Context, clientKey string) {
+	seshttp.CountClientFailure(ctx, i.limiter, clientKey, i.log)
+}
+
+// fingerprintMatches checks that a session bound to a client is being used by that client. If it isn't, it takes the
+// policy's action, returning a status error unless the action is to log.
+func (i *Interceptor) fingerprintMatches(ctx context.Context, r *http.Request, session domain.Session) error {
+	if i.fingerprint == nil {
+		return nil
+	}
+
+	action, mismatched := i.fingerprint.Enforce(ctx, r, session, i.session, i.log, domain.EventHandlerFunc(i.emit))
+	if !mismatched || action == seshttp.FingerprintLog {
+		return nil
+	}
+
+	return status.Error(codes.Unauthenticated, domain.SessionFingerprintMismatch)
+}
+
+// sessionKey reads the session key out of the metadata of a call. It returns http.ErrNoCookie if there is none.
+func (i *Interceptor) sessionKey(md metadata.MD) (string, error) {
+	for _, authorization := range md.Get(AuthorizationMetadata) {
+		if strings.HasPrefix(authorization, bearerPrefix) {
+			sessionKey, _, tokenErr := i.cookie.SessionKeyFromToken(strings.TrimPrefix(authorization, bearerPrefix))
+			return sessionKey, tokenErr
+		}
+	}
+
+	cookies := append(md.Get(CookieMetadata), md.Get(GatewayCookieMetadata)...)
+	if len(cookies) == 0 {
+		return "", http.ErrNoCookie
+	}
+
+	sessionKey, _, cookieErr := i.cookie.SessionKeyFromRequest(&http.Request{Header: http.Header{"Cookie": cookies}})
+	return sessionKey, cookieErr
+}
+
+// authenticate verifies the session of a call, returning its context with the session in it, or a status error
+func (i *Interceptor) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	if i.public[fullMethod] {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	r := callRequest(ctx, md)
+
+	clientKey := ""
+	if i.limiter != nil {
+		clientKey = i.clientKey(r)
+	}
+
+	limitedErr := i.rateLimited(ctx, clientKey)
+	if limitedErr != nil {
+		return nil, limitedErr
+	}
+
+	sessionKey, keyErr := i.sessionKey(md)
+	if keyErr != nil {
+		if keyErr == http.ErrNoCookie {
+			i.log.WarnError(domain.RequestIsMissingSessionCookie, keyErr, domain.LogFields{"method": fullMethod})
+			i.emit(domain.Event{Type: domain.EventAuthFailed, Reason: domain.ReasonMissingCookie})
+			return nil, status.Error(codes.Unauthenticated, domain.RequestIsMissingSessionCookie)
+		}
+		// A token we can't verify is treated just like a session we can't find.
+		i.failed(ctx, clientKey)
+		i.log.WarnError(domain.SessionDoesNotExist, keyErr, domain.LogFields{"method": fullMethod})
+		i.emit(domain.Event{Type: domain.EventAuthFailed, Reason: domain.ReasonNotFound})
+		return nil, status.Error(codes.Unauthenticated, domain.SessionDoesNotExist)
+	}
+
+	session, sessionErr := i.session.GetSessionIfValid(ctx, sessionKey)
+	if sessionErr != nil {
+		switch sessionErr {
+		case domain.ErrValidSessionNotFound:
+			i.failed(ctx, clientKey)
+			i.log.WarnError(domain.SessionDoesNotExist, sessionErr, domain.LogFields{"method": fullMethod})
+			return nil, status.Error(codes.Unauthenticated, domain.SessionDoesNotExist)
+		case domain.ErrSessionExpired:
+			i.failed(ctx, clientKey)
+			i.log.WarnError(domain.SessionExpired, sessionErr, domain.LogFields{"method": fullMethod})
+			return nil, status.Error(codes.Unauthenticated, domain.SessionExpired)
+		case domain.ErrSessionPending:
+			i.log.WarnError(domain.SessionPending, sessionErr, domain.LogFields{"method": fullMethod})
+			return nil, status.Error(codes.Unauthenticated, domain.SessionPending)
+		case domain.ErrAccountDenied:
+			i.log.WarnError(domain.AccountDenied, sessionErr, domain.LogFields{"method": fullMethod})
+			return nil, status.Error(codes.PermissionDenied, domain.AccountDenied)
+		default:
+			i.log.WarnError(domain.SessionUnexpectedError, sessionErr, domain.LogFields{"method": fullMethod})
+			return nil, status.Error(codes.Internal, domain.SessionUnexpectedError)
+		}
+	}
+
+	fingerprintErr := i.fingerprintMatches(ctx, r, session)
+	if fingerprintErr != nil {
+		return nil, fingerprintErr
+	}
+
+	return seshttp.SetSessionInContext(ctx, session), nil
+}
+
+// Unary returns a unary server interceptor that authenticates every call
+func (i *Interceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, authErr := i.authenticate(ctx, info.FullMethod)
+		if authErr != nil {
+			return nil, authErr
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// Stream returns a stream server interceptor that authenticates every stream when it is opened
+func (i *Interceptor) Stream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, authErr := i.authenticate(ss.Context(), info.FullMethod)
+		if authErr != nil {
+			return authErr
+		}
+
+		return handler(srv, authenticatedStream{ss, ctx})
+	}
+}
+
+// authenticatedStream is a ServerStream whose context holds its session
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context with the session in it
+func (s authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,265 @@
+package seshgrpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/trussworks/sesh/pkg/cookiestore"
+	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/seshttp"
+	"github.com/trussworks/sesh/pkg/session"
+)
+
+// getTestObjects starts a health server behind the interceptors on an in-memory listener. Every session that makes it
+// through the interceptors is sent to the returned channel.
+func getTestObjects(t *testing.T, opts ...Option) (healthpb.HealthClient, *session.Service, seshttp.SessionCookieService, chan domain.Session) {
+	t.Helper()
+
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := seshttp.NewSessionCookieService(false, securecookie.GenerateRandomKey(32))
+	interceptor := NewInterceptor(logger, sessionService, cookieService, opts...)
+
+	sessions := make(chan domain.Session, 10)
+	recordUnary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		sessions <- sessionFromContext(ctx)
+		return handler(ctx, req)
+	}
+	recordStream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		sessions <- sessionFromContext(ss.Context())
+		return handler(srv, ss)
+	}
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(interceptor.Unary(), recordUnary),
+		grpc.ChainStreamInterceptor(interceptor.Stream(), recordStream),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+
+	listener := bufconn.Listen(1024 * 1024)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, dialErr := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if dialErr != nil {
+		t.Fatal(dialErr)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return healthpb.NewHealthClient(conn), sessionService, cookieService, sessions
+}
+
+// sessionFromContext returns the session in the context, or an empty one if there is none
+func sessionFromContext(ctx context.Context) (session domain.Session) {
+	defer func() {
+		if recover() != nil {
+			session = domain.Session{}
+		}
+	}()
+	return seshttp.SessionFromContext(ctx)
+}
+
+func TestUnaryCallsNeedASession(t *testing.T) {
+	client, sessionService, cookieService, sessions := getTestObjects(t)
+
+	_, missingErr := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if status.Code(missingErr) != codes.Unauthenticated {
+		t.Fatal("A call without a session should be unauthenticated", missingErr)
+	}
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	token, tokenErr := cookieService.SessionToken(sessionKey)
+	if tokenErr != nil {
+		t.Fatal(tokenErr)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), AuthorizationMetadata, "Bearer "+token)
+	_, checkErr := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if checkErr != nil {
+		t.Fatal(checkErr)
+	}
+
+	if session := <-sessions; session.AccountID != "FOO" {
+		t.Fatal("Should have put the session in the context", session)
+	}
+
+	// A gateway forwards the browser's cookie instead.
+	cookieCtx := metadata.AppendToOutgoingContext(context.Background(), GatewayCookieMetadata, seshttp.SessionCookieName+"="+token)
+	_, cookieErr := client.Check(cookieCtx, &healthpb.HealthCheckRequest{})
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	if session := <-sessions; session.AccountID != "FOO" {
+		t.Fatal("Should have read the session from the forwarded cookie", session)
+	}
+
+	logoutErr := sessionService.UserDidLogout(context.Background(), sessionKey)
+	if logoutErr != nil {
+		t.Fatal(logoutErr)
+	}
+
+	_, endedErr := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(endedErr) != codes.Unauthenticated {
+		t.Fatal("A call with an ended session should be unauthenticated", endedErr)
+	}
+
+	_, forgedErr := client.Check(metadata.AppendToOutgoingContext(context.Background(), AuthorizationMetadata, "Bearer "+sessionKey), &healthpb.HealthCheckRequest{})
+	if status.Code(forgedErr) != codes.Unauthenticated {
+		t.Fatal("A token that isn't signed should be unauthenticated", forgedErr)
+	}
+}
+
+func TestStreamsNeedASession(t *testing.T) {
+	client, sessionService, cookieService, sessions := getTestObjects(t)
+
+	missing, watchErr := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if watchErr != nil {
+		t.Fatal(watchErr)
+	}
+	_, missingErr := missing.Recv()
+	if status.Code(missingErr) != codes.Unauthenticated {
+		t.Fatal("A stream without a session should be unauthenticated", missingErr)
+	}
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	token, tokenErr := cookieService.SessionToken(sessionKey)
+	if tokenErr != nil {
+		t.Fatal(tokenErr)
+	}
+
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), AuthorizationMetadata, "Bearer "+token))
+	defer cancel()
+
+	stream, watchErr := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if watchErr != nil {
+		t.Fatal(watchErr)
+	}
+	_, recvErr := stream.Recv()
+	if recvErr != nil {
+		t.Fatal(recvErr)
+	}
+
+	if session := <-sessions; session.AccountID != "FOO" {
+		t.Fatal("Should have put the session in the stream's context", session)
+	}
+}
+
+func TestPublicMethodsDoNotNeedASession(t *testing.T) {
+	client, _, _, sessions := getTestObjects(t, WithPublicMethods("/grpc.health.v1.Health/Check"))
+
+	_, checkErr := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if checkErr != nil {
+		t.Fatal("A public method should not need a session", checkErr)
+	}
+
+	if session := <-sessions; session.AccountID != "" {
+		t.Fatal("There should be no session in the context", session)
+	}
+}
+
+func TestCallsWithInvalidSessionsAreRateLimited(t *testing.T) {
+	limiter := seshttp.NewMemoryRateLimiter(2, time.Minute)
+	client, sessionService, cookieService, _ := getTestObjects(t, WithRateLimiter(limiter))
+
+	forgedCtx := metadata.AppendToOutgoingContext(context.Background(), AuthorizationMetadata, "Bearer NOT_A_TOKEN")
+	for i := 0; i < 2; i++ {
+		_, forgedErr := client.Check(forgedCtx, &healthpb.HealthCheckRequest{})
+		if status.Code(forgedErr) != codes.Unauthenticated {
+			t.Fatal("A call with a bad token should be unauthenticated until the limit", forgedErr)
+		}
+	}
+
+	_, limitedErr := client.Check(forgedCtx, &healthpb.HealthCheckRequest{})
+	if status.Code(limitedErr) != codes.ResourceExhausted {
+		t.Fatal("The client should have used up its limit", limitedErr)
+	}
+
+	// The limit applies to the client, whatever session it sends.
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+	token, tokenErr := cookieService.SessionToken(sessionKey)
+	if tokenErr != nil {
+		t.Fatal(tokenErr)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), AuthorizationMetadata, "Bearer "+token)
+	_, stillLimitedErr := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(stillLimitedErr) != codes.ResourceExhausted {
+		t.Fatal("A limited client should be turned away before its session is looked up", stillLimitedErr)
+	}
+}
+
+func TestCallsMustMatchTheSessionsFingerprint(t *testing.T) {
+	for _, action := range []seshttp.FingerprintAction{seshttp.FingerprintReject, seshttp.FingerprintReauthenticate, seshttp.FingerprintLog} {
+		policy := seshttp.FingerprintPolicy{Fingerprinter: seshttp.UserAgentFingerprint, Action: action}
+		client, sessionService, cookieService, sessions := getTestObjects(t, WithFingerprintPolicy(policy))
+
+		loginR := &http.Request{Header: http.Header{"User-Agent": []string{"Firefox"}}}
+		sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO", domain.WithFingerprint(policy.Fingerprint(loginR)))
+		if authErr != nil {
+			t.Fatal(authErr)
+		}
+		token, tokenErr := cookieService.SessionToken(sessionKey)
+		if tokenErr != nil {
+			t.Fatal(tokenErr)
+		}
+
+		// A gateway forwards the browser's user agent.
+		ctx := metadata.AppendToOutgoingContext(context.Background(), AuthorizationMetadata, "Bearer "+token, GatewayUserAgentMetadata, "Firefox")
+		_, checkErr := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		if checkErr != nil {
+			t.Fatal("The client that logged in should be let through", action, checkErr)
+		}
+		<-sessions
+
+		otherCtx := metadata.AppendToOutgoingContext(context.Background(), AuthorizationMetadata, "Bearer "+token, GatewayUserAgentMetadata, "Chrome")
+		_, otherErr := client.Check(otherCtx, &healthpb.HealthCheckRequest{})
+
+		_, peekErr := sessionService.PeekSessionIfValid(context.Background(), sessionKey)
+		switch action {
+		case seshttp.FingerprintLog:
+			if otherErr != nil {
+				t.Fatal("A mismatch should only be logged", otherErr)
+			}
+			<-sessions
+		case seshttp.FingerprintReject:
+			if status.Code(otherErr) != codes.Unauthenticated || peekErr != nil {
+				t.Fatal("A mismatch should be turned away, leaving the session alone", otherErr, peekErr)
+			}
+		case seshttp.FingerprintReauthenticate:
+			if status.Code(otherErr) != codes.Unauthenticated || peekErr != domain.ErrValidSessionNotFound {
+				t.Fatal("A mismatch should end the session", otherErr, peekErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Package seshmetrics exposes Prometheus metrics for the session lifecycle.
+// A Metrics is a prometheus.Collector: register it with your registry, pass it to sesh as an event handler, and
+// wrap your session store with InstrumentStore to time store operations.
+package seshmetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+const namespace = "sesh"
+
+// ActiveSessionCounter counts the sessions that have not yet expired. dbstore.DBStore is one.
+type ActiveSessionCounter interface {
+	CountActiveSessions() (int, error)
+}
+
+// reasonAccountDenied is the auth failure reason that requests of accounts the AccountValidator denies are counted under
+const reasonAccountDenied = string(domain.EventAccountDenied)
+
+// failureReasons are every reason an auth failure is counted under
+var failureReasons = []string{
+	domain.ReasonMissingCookie,
+	domain.ReasonNotFound,
+	domain.ReasonExpired,
+	domain.ReasonUnexpected,
+	domain.ReasonRateLimited,
+	domain.ReasonPending,
+	domain.ReasonInvalidated,
+	reasonAccountDenied,
+}
+
+// Metrics collects session lifecycle metrics
+type Metrics struct {
+	created       prometheus.Counter
+	destroyed     *prometheus.CounterVec
+	authFailures  *prometheus.CounterVec
+	storeDuration *prometheus.HistogramVec
+
+	activeDesc *prometheus.Desc
+	counter    ActiveSessionCounter
+}
+
+// NewMetrics returns a new Metrics.
+// The active session gauge is only reported if counter is not nil. It is counted every time the metrics are scraped.
+func NewMetrics(counter ActiveSessionCounter) *Metrics {
+	m := &Metrics{
+		created: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_created_total",
+			Help:      "Number of sessions created.",
+		}),
+		destroyed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_destroyed_total",
+			Help:      "Number of sessions ended, by whether they were logged out or replaced by a new login.",
+		}, []string{"reason"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_failures_total",
+			Help:      "Number of requests that failed to authenticate, by reason.",
+		}, []string{"reason"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "store_operation_duration_seconds",
+			Help:      "Latency of session store operations, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+
+		activeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "active_sessions"),
+			"Number of sessions that have not expired.",
+			nil, nil,
+		),
+		counter: counter,
+	}
+
+	// Start every reason at zero so that rates work from the first failure.
+	for _, reason := range failureReasons {
+		m.authFailures.WithLabelValues(reason)
+	}
+	for _, eventType := range []domain.EventType{domain.EventSessionDestroyed, domain.EventSessionReplaced} {
+		m.destroyed.WithLabelValues(string(eventType))
+	}
+
+	return m
+}
+
+// HandleEvent counts session lifecycle events
+func (m *Metrics) HandleEvent(event domain.Event) {
+	switch event.Type {
+	case domain.EventSessionCreated:
+		m.created.Inc()
+	case domain.EventSessionDestroyed, domain.EventSessionReplaced:
+		m.destroyed.WithLabelValues(string(event.Type)).Inc()
+	case domain.EventAuthFailed:
+		m.authFailures.WithLabelValues(event.Reason).Inc()
+	case domain.EventAccountDenied:
+		m.authFailures.WithLabelValues(reasonAccountDenied).Inc()
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.created.Describe(ch)
+	m.destroyed.Describe(ch)
+	m.authFailures.Describe(ch)
+	m.storeDuration.Describe(ch)
+	if m.counter != nil {
+		ch <- m.activeDesc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.created.Collect(ch)
+	m.destroyed.Collect(ch)
+	m.authFailures.Collect(ch)
+	m.storeDuration.Collect(ch)
+
+	if m.counter != nil {
+		count, countErr := m.counter.CountActiveSessions()
+		if countErr != nil {
+			ch <- prometheus.NewInvalidMetric(m.activeDesc, countErr)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(m.activeDesc, prometheus.GaugeValue, float64(count))
+	}
+}
+
+// observeStore records how long a store operation took
+func (m *Metrics) observeStore(method string, start time.Time) {
+	m.storeDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
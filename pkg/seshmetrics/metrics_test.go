@@ -0,0 +1,140 @@
+package seshmetrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/securecookie"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/trussworks/sesh/pkg/cookiestore"
+	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/session"
+)
+
+type staticCounter struct {
+	count int
+	err   error
+}
+
+func (c staticCounter) CountActiveSessions() (int, error) {
+	return c.count, c.err
+}
+
+func getTestStore() domain.SessionStorageService {
+	return cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+}
+
+func TestLifecycleEventsAreCounted(t *testing.T) {
+	metrics := NewMetrics(nil)
+	sessionService := session.NewSessionService(5*time.Minute, getTestStore(), domain.FmtLogger(true), session.WithEventHandler(metrics))
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), uuid.New().String())
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	_, getErr := sessionService.GetSessionIfValid(context.Background(), "GARBAGE")
+	if getErr != domain.ErrValidSessionNotFound {
+		t.Fatal(getErr)
+	}
+
+	logoutErr := sessionService.UserDidLogout(context.Background(), sessionKey)
+	if logoutErr != nil {
+		t.Fatal(logoutErr)
+	}
+
+	if created := testutil.ToFloat64(metrics.created); created != 1 {
+		t.Fatal("Should have counted one created session", created)
+	}
+
+	if destroyed := testutil.ToFloat64(metrics.destroyed.WithLabelValues(string(domain.EventSessionDestroyed))); destroyed != 1 {
+		t.Fatal("Should have counted one destroyed session", destroyed)
+	}
+
+	if notFound := testutil.ToFloat64(metrics.authFailures.WithLabelValues(domain.ReasonNotFound)); notFound != 1 {
+		t.Fatal("Should have counted one session that wasn't found", notFound)
+	}
+
+	if expired := testutil.ToFloat64(metrics.authFailures.WithLabelValues(domain.ReasonExpired)); expired != 0 {
+		t.Fatal("Should not have counted any expired sessions", expired)
+	}
+}
+
+func TestEveryFailureReasonStartsAtZero(t *testing.T) {
+	metrics := NewMetrics(nil)
+
+	// Looking a reason up would create it, so count what is collected instead.
+	if count := testutil.CollectAndCount(metrics.authFailures); count != len(failureReasons) {
+		t.Fatal("Every reason should have been reported before any failure", count)
+	}
+
+	metrics.HandleEvent(domain.Event{Type: domain.EventAuthFailed, Reason: domain.ReasonInvalidated})
+	metrics.HandleEvent(domain.Event{Type: domain.EventAccountDenied, AccountID: "FOO"})
+
+	if count := testutil.CollectAndCount(metrics.authFailures); count != len(failureReasons) {
+		t.Fatal("Later requests' reasons should have been reported from the start", count)
+	}
+
+	if denied := testutil.ToFloat64(metrics.authFailures.WithLabelValues(reasonAccountDenied)); denied != 1 {
+		t.Fatal("Should have counted the denied account", denied)
+	}
+}
+
+func TestStoreOperationsAreTimed(t *testing.T) {
+	metrics := NewMetrics(nil)
+	store := metrics.InstrumentStore(getTestStore())
+
+	created, createErr := store.CreateSession(context.Background(), uuid.New().String(), uuid.New().String(), 5*time.Minute)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, fetchErr := store.ExtendAndFetchSession(context.Background(), created.SessionKey, 5*time.Minute)
+		if fetchErr != nil {
+			t.Fatal(fetchErr)
+		}
+	}
+
+	// We can't know the latencies, so just check the counts.
+	if count := testutil.CollectAndCount(metrics.storeDuration); count != 2 {
+		t.Fatal("Should have a histogram for each method called", count)
+	}
+
+	lintProblems, lintErr := testutil.CollectAndLint(metrics)
+	if lintErr != nil {
+		t.Fatal(lintErr)
+	}
+	if len(lintProblems) != 0 {
+		t.Fatal("Metrics have lint problems", lintProblems)
+	}
+}
+
+func TestActiveSessionsAreCountedOnScrape(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(NewMetrics(staticCounter{count: 7}))
+
+	expected := `
+		# HELP sesh_active_sessions Number of sessions that have not expired.
+		# TYPE sesh_active_sessions gauge
+		sesh_active_sessions 7
+	`
+	compareErr := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sesh_active_sessions")
+	if compareErr != nil {
+		t.Fatal(compareErr)
+	}
+
+	failingRegistry := prometheus.NewPedanticRegistry()
+	failingRegistry.MustRegister(NewMetrics(staticCounter{err: errors.New("no db")}))
+
+	_, gatherErr := failingRegistry.Gather()
+	if gatherErr == nil {
+		t.Fatal("A failure to count sessions should be reported")
+	}
+}
@@ -0,0 +1,66 @@
+package seshmetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// instrumentedStore times every call to the SessionStorageService it wraps
+type instrumentedStore struct {
+	store   domain.SessionStorageService
+	metrics *Metrics
+}
+
+// InstrumentStore wraps a SessionStorageService so that the latency of each of its methods is recorded.
+func (m *Metrics) InstrumentStore(store domain.SessionStorageService) domain.SessionStorageService {
+	return instrumentedStore{
+		store,
+		m,
+	}
+}
+
+func (s instrumentedStore) Close() error {
+	return s.store.Close()
+}
+
+func (s instrumentedStore) CreateSession(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	defer s.metrics.observeStore("CreateSession", time.Now())
+	return s.store.CreateSession(ctx, accountID, sessionKey, expirationDuration)
+}
+
+func (s instrumentedStore) ReplaceSessionForAccount(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration, metadata domain.SessionMetadata) (domain.Session, *domain.Session, error) {
+	defer s.metrics.observeStore("ReplaceSessionForAccount", time.Now())
+	return s.store.ReplaceSessionForAccount(ctx, accountID, sessionKey, expirationDuration, metadata)
+}
+
+func (s instrumentedStore) FetchPossiblyExpiredSession(ctx context.Context, accountID string) (domain.Session, error) {
+	defer s.metrics.observeStore("FetchPossiblyExpiredSession", time.Now())
+	return s.store.FetchPossiblyExpiredSession(ctx, accountID)
+}
+
+func (s instrumentedStore) DeleteSession(ctx context.Context, sessionKey string) error {
+	defer s.metrics.observeStore("DeleteSession", time.Now())
+	return s.store.DeleteSession(ctx, sessionKey)
+}
+
+func (s instrumentedStore) DeleteAccountSessions(ctx context.Context, accountID string) error {
+	defer s.metrics.observeStore("DeleteAccountSessions", time.Now())
+	return s.store.DeleteAccountSessions(ctx, accountID)
+}
+
+func (s instrumentedStore) FetchSession(ctx context.Context, sessionKey string) (domain.Session, error) {
+	defer s.metrics.observeStore("FetchSession", time.Now())
+	return s.store.FetchSession(ctx, sessionKey)
+}
+
+func (s instrumentedStore) ExtendAndFetchSession(ctx context.Context, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	defer s.metrics.observeStore("ExtendAndFetchSession", time.Now())
+	return s.store.ExtendAndFetchSession(ctx, sessionKey, expirationDuration)
+}
+
+func (s instrumentedStore) UpdateSessionMetadata(ctx context.Context, sessionKey string, metadata domain.SessionMetadata) (domain.Session, error) {
+	defer s.metrics.observeStore("UpdateSessionMetadata", time.Now())
+	return s.store.UpdateSessionMetadata(ctx, sessionKey, metadata)
+}
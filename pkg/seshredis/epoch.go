@@ -0,0 +1,47 @@
+package seshredis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// EpochPrefix is prepended to account IDs to make the keys of the EpochStore's counters
+const EpochPrefix = "sesh:epoch:"
+
+// EpochStore is a domain.AccountEpochStorageService that keeps a counter per account in Redis.
+// The counters never expire, since an account going back to an earlier epoch would bring its old sessions back.
+type EpochStore struct {
+	client redis.UniversalClient
+}
+
+// NewEpochStore returns an EpochStore that keeps epochs with the given client
+func NewEpochStore(client redis.UniversalClient) EpochStore {
+	return EpochStore{
+		client,
+	}
+}
+
+// FetchAccountEpoch returns the account's current epoch, 0 if it has never been incremented
+func (s EpochStore) FetchAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	epoch, getErr := s.client.Get(ctx, EpochPrefix+accountID).Int64()
+	if getErr != nil {
+		if getErr == redis.Nil {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Failed to get the account's epoch: %w", getErr)
+	}
+
+	return epoch, nil
+}
+
+// IncrementAccountEpoch moves the account on to a new epoch and returns it
+func (s EpochStore) IncrementAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	epoch, incrErr := s.client.Incr(ctx, EpochPrefix+accountID).Result()
+	if incrErr != nil {
+		return 0, fmt.Errorf("Failed to increment the account's epoch: %w", incrErr)
+	}
+
+	return epoch, nil
+}
@@ -0,0 +1,50 @@
+package seshredis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestAccountEpochsAreIncremented(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	epochs := NewEpochStore(client)
+	ctx := context.Background()
+
+	epoch, fetchErr := epochs.FetchAccountEpoch(ctx, "alice")
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+	if epoch != 0 {
+		t.Fatal("Accounts should start at epoch 0", epoch)
+	}
+
+	incremented, incrementErr := epochs.IncrementAccountEpoch(ctx, "alice")
+	if incrementErr != nil {
+		t.Fatal(incrementErr)
+	}
+	if incremented != 1 {
+		t.Fatal("Should have moved the account on to the next epoch", incremented)
+	}
+
+	epoch, fetchErr = epochs.FetchAccountEpoch(ctx, "alice")
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+	if epoch != 1 {
+		t.Fatal("Should have fetched the new epoch", epoch)
+	}
+
+	other, otherErr := epochs.FetchAccountEpoch(ctx, "bob")
+	if otherErr != nil {
+		t.Fatal(otherErr)
+	}
+	if other != 0 {
+		t.Fatal("Other accounts should be left alone", other)
+	}
+}
@@ -0,0 +1,79 @@
+// Package seshredis implements sesh extension points with Redis, so that they can be shared by every instance of an app.
+package seshredis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitPrefix is prepended to client keys to make the keys of the RateLimiter's counters
+const RateLimitPrefix = "sesh:rate_limit:"
+
+// countFailure increments a counter, starting its window when it is created, and returns the new count.
+// It runs as a script so that a counter can never be left without an expiration.
+var countFailure = redis.NewScript(`
+local failures = redis.call("INCR", KEYS[1])
+if failures == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return failures
+`)
+
+// RateLimiter is a seshttp.RateLimiter that counts failures in fixed windows in Redis
+type RateLimiter struct {
+	client redis.UniversalClient
+	limit  int
+	window time.Duration
+}
+
+// NewRateLimiter returns a RateLimiter that lets each client make limit requests with invalid
+// sessions per window. The window starts at a client's first failure.
+func NewRateLimiter(client redis.UniversalClient, limit int, window time.Duration) RateLimiter {
+	return RateLimiter{
+		client,
+		limit,
+		window,
+	}
+}
+
+// Limited returns how long until the client's window resets if it has used up its failures
+func (l RateLimiter) Limited(ctx context.Context, clientKey string) (time.Duration, error) {
+	key := RateLimitPrefix + clientKey
+
+	failures, getErr := l.client.Get(ctx, key).Int()
+	if getErr != nil {
+		if getErr == redis.Nil {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Failed to get the client's failures: %w", getErr)
+	}
+
+	if failures < l.limit {
+		return 0, nil
+	}
+
+	retryAfter, ttlErr := l.client.PTTL(ctx, key).Result()
+	if ttlErr != nil {
+		return 0, fmt.Errorf("Failed to get the client's window: %w", ttlErr)
+	}
+
+	// The window lapsed between the two calls
+	if retryAfter < 0 {
+		return 0, nil
+	}
+
+	return retryAfter, nil
+}
+
+// Failed counts a failure against the client
+func (l RateLimiter) Failed(ctx context.Context, clientKey string) error {
+	countErr := countFailure.Run(ctx, l.client, []string{RateLimitPrefix + clientKey}, l.window.Milliseconds()).Err()
+	if countErr != nil {
+		return fmt.Errorf("Failed to count the client's failure: %w", countErr)
+	}
+
+	return nil
+}
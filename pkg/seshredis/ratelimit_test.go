@@ -0,0 +1,87 @@
+package seshredis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func getTestObjects(t *testing.T, limit int, window time.Duration) (RateLimiter, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRateLimiter(client, limit, window), server
+}
+
+func TestClientsAreLimitedAfterTooManyFailures(t *testing.T) {
+	limiter, server := getTestObjects(t, 3, time.Minute)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		retryAfter, limitErr := limiter.Limited(ctx, "10.0.0.1")
+		if limitErr != nil {
+			t.Fatal(limitErr)
+		}
+		if retryAfter != 0 {
+			t.Fatal("The client should not be limited yet", i, retryAfter)
+		}
+
+		failErr := limiter.Failed(ctx, "10.0.0.1")
+		if failErr != nil {
+			t.Fatal(failErr)
+		}
+	}
+
+	retryAfter, limitErr := limiter.Limited(ctx, "10.0.0.1")
+	if limitErr != nil {
+		t.Fatal(limitErr)
+	}
+	if retryAfter <= 0 || retryAfter > time.Minute {
+		t.Fatal("The client should be limited until the end of its window", retryAfter)
+	}
+
+	otherRetryAfter, otherLimitErr := limiter.Limited(ctx, "10.0.0.2")
+	if otherLimitErr != nil {
+		t.Fatal(otherLimitErr)
+	}
+	if otherRetryAfter != 0 {
+		t.Fatal("Other clients should not be limited", otherRetryAfter)
+	}
+
+	server.FastForward(time.Minute)
+
+	retryAfter, limitErr = limiter.Limited(ctx, "10.0.0.1")
+	if limitErr != nil {
+		t.Fatal(limitErr)
+	}
+	if retryAfter != 0 {
+		t.Fatal("The client should be let through once its window is over", retryAfter)
+	}
+}
+
+func TestFailuresDoNotExtendTheWindow(t *testing.T) {
+	limiter, server := getTestObjects(t, 100, time.Minute)
+	ctx := context.Background()
+
+	failErr := limiter.Failed(ctx, "10.0.0.1")
+	if failErr != nil {
+		t.Fatal(failErr)
+	}
+
+	server.FastForward(30 * time.Second)
+
+	failErr = limiter.Failed(ctx, "10.0.0.1")
+	if failErr != nil {
+		t.Fatal(failErr)
+	}
+
+	if ttl := server.TTL(RateLimitPrefix + "10.0.0.1"); ttl != 30*time.Second {
+		t.Fatal("The window should start at the first failure", ttl)
+	}
+}
@@ -0,0 +1,119 @@
+package seshttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// Fingerprinter describes the client making a request. A session can be bound to the fingerprint of the
+// client that logged in, so that its cookie is no good to a client that doesn't look the same.
+type Fingerprinter func(r *http.Request) string
+
+// UserAgentFingerprint fingerprints clients by their User-Agent header
+func UserAgentFingerprint(r *http.Request) string {
+	return r.UserAgent()
+}
+
+// IPPrefixFingerprint fingerprints clients by the network their address is in, keeping the first ipv4Bits of IPv4
+// addresses and the first ipv6Bits of IPv6 addresses. Like RemoteIP it uses the address the request came from,
+// which is wrong behind a proxy.
+func IPPrefixFingerprint(ipv4Bits int, ipv6Bits int) Fingerprinter {
+	return func(r *http.Request) string {
+		ip := net.ParseIP(RemoteIP(r))
+		if ip == nil {
+			return ""
+		}
+
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(ipv4Bits, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(ipv6Bits, 128)).String()
+	}
+}
+
+// HeaderFingerprint fingerprints clients by a header they send, like a device ID
+func HeaderFingerprint(name string) Fingerprinter {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// CombineFingerprints fingerprints clients by all of the given fingerprints, so that they must all match
+func CombineFingerprints(fingerprinters ...Fingerprinter) Fingerprinter {
+	return func(r *http.Request) string {
+		parts := make([]string, len(fingerprinters))
+		for i, fingerprinter := range fingerprinters {
+			parts[i] = fingerprinter(r)
+		}
+		return strings.Join(parts, "\x00")
+	}
+}
+
+// FingerprintAction is what the middleware does when a session is used by a client with a different fingerprint
+type FingerprintAction int
+
+// fingerprint actions
+const (
+	// FingerprintReject responds with 401 Unauthorized, but leaves the session alone for the client that logged in
+	FingerprintReject FingerprintAction = iota
+	// FingerprintReauthenticate ends the session and responds with 401 Unauthorized, so that whoever has it has to log in again
+	FingerprintReauthenticate
+	// FingerprintLog lets the request through, only logging the mismatch and emitting an event about it
+	FingerprintLog
+)
+
+// String returns the name of the action, which is the Reason of the EventFingerprintMismatch event
+func (a FingerprintAction) String() string {
+	switch a {
+	case FingerprintReject:
+		return "reject"
+	case FingerprintReauthenticate:
+		return "reauthenticate"
+	case FingerprintLog:
+		return "log"
+	default:
+		return "unknown"
+	}
+}
+
+// FingerprintPolicy binds sessions to the client that logged in
+type FingerprintPolicy struct {
+	// Fingerprinter fingerprints the client at login and on every authenticated request
+	Fingerprinter Fingerprinter
+	// Action is what to do when the fingerprints don't match
+	Action FingerprintAction
+}
+
+// Fingerprint returns the fingerprint of the client making a request. It is hashed so that it's safe to store.
+func (p FingerprintPolicy) Fingerprint(r *http.Request) string {
+	hashed := sha256.Sum256([]byte(p.Fingerprinter(r)))
+	return hex.EncodeToString(hashed[:])
+}
+
+// Enforce checks that a session bound to a client is being used by that client. If it isn't, it logs the mismatch,
+// notifies events and, if the action is FingerprintReauthenticate, ends the session. It returns the action and whether
+// the fingerprints mismatched, leaving it to the caller to turn the client away unless the action is FingerprintLog.
+func (p FingerprintPolicy) Enforce(ctx context.Context, r *http.Request, session domain.Session, sessions domain.SessionService, log domain.LogService, events domain.EventHandler) (FingerprintAction, bool) {
+	if session.Fingerprint == "" || p.Fingerprint(r) == session.Fingerprint {
+		return p.Action, false
+	}
+
+	sessionHash := domain.HashSessionKey(session.SessionKey)
+	log.WarnError(domain.SessionFingerprintMismatch, domain.ErrFingerprintMismatch, domain.LogFields{"session_hash": sessionHash, "action": p.Action.String()})
+	events.HandleEvent(domain.Event{Type: domain.EventFingerprintMismatch, SessionHash: sessionHash, AccountID: session.AccountID, ActorAccountID: session.ActorAccountID, Reason: p.Action.String()})
+
+	if p.Action == FingerprintReauthenticate {
+		logoutErr := sessions.UserDidLogout(ctx, session.SessionKey)
+		if logoutErr != nil {
+			log.WarnError(domain.SessionUnexpectedError, logoutErr, domain.LogFields{"session_hash": sessionHash})
+		}
+	}
+
+	return p.Action, true
+}
@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/trussworks/sesh/internal/seshtrace"
 	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/keyring"
 )
 
 // SessionCookieName is the name of the cookie that is used to store the session
@@ -15,44 +17,149 @@ const SessionCookieName = "sesh-session-key"
 
 // SessionMiddleware is the session handler.
 type SessionMiddleware struct {
-	log     domain.LogService
-	session domain.SessionService
+	log           domain.LogService
+	session       domain.SessionService
+	cookie        SessionCookieService
+	events        []domain.EventHandler
+	limiter       RateLimiter
+	clientKey     func(r *http.Request) string
+	fingerprint   *FingerprintPolicy
+	remember      domain.RememberService
+	expiryHeaders bool
+}
+
+// Option configures optional behavior of a SessionMiddleware
+type Option func(*SessionMiddleware)
+
+// WithEventHandler has the middleware notify the given handler of requests it turns away before they reach the
+// SessionService. It can be passed more than once to notify several handlers.
+func WithEventHandler(handler domain.EventHandler) Option {
+	return func(m *SessionMiddleware) {
+		m.events = append(m.events, handler)
+	}
+}
+
+// WithRateLimiter has the middleware count requests with invalid sessions against their client. Once a client has used
+// up its limit, its requests are turned away with 429 Too Many Requests, before its session is even looked up.
+// If the limiter fails, requests are let through.
+func WithRateLimiter(limiter RateLimiter) Option {
+	return func(m *SessionMiddleware) {
+		m.limiter = limiter
+	}
+}
+
+// WithClientKey sets how clients are told apart for rate limiting. It defaults to RemoteIP.
+func WithClientKey(clientKey func(r *http.Request) string) Option {
+	return func(m *SessionMiddleware) {
+		m.clientKey = clientKey
+	}
+}
+
+// WithFingerprintPolicy has the middleware check that sessions are used by the client that logged in.
+// Sessions are only bound to a client if they were created with its fingerprint, see FingerprintPolicy.Fingerprint.
+func WithFingerprintPolicy(policy FingerprintPolicy) Option {
+	return func(m *SessionMiddleware) {
+		m.fingerprint = &policy
+	}
+}
+
+// WithRememberService has the middleware log clients back in with their remember me cookie when their session cookie
+// is missing or their session has ended. A new session is started and both cookies are replaced.
+func WithRememberService(remember domain.RememberService) Option {
+	return func(m *SessionMiddleware) {
+		m.remember = remember
+	}
 }
 
 // NewSessionMiddleware returns a configured SessionMiddleware
-func NewSessionMiddleware(log domain.LogService, session domain.SessionService) *SessionMiddleware {
-	return &SessionMiddleware{
-		log,
-		session,
+func NewSessionMiddleware(log domain.LogService, session domain.SessionService, cookie SessionCookieService, opts ...Option) *SessionMiddleware {
+	middleware := &SessionMiddleware{
+		log:       log,
+		session:   session,
+		cookie:    cookie,
+		clientKey: RemoteIP,
+	}
+
+	for _, opt := range opts {
+		opt(middleware)
+	}
+
+	return middleware
+}
+
+// emit notifies all the event handlers of an event
+func (service SessionMiddleware) emit(event domain.Event) {
+	for _, handler := range service.events {
+		handler.HandleEvent(event)
+	}
+}
+
+// rateLimited responds with 429 and returns true if the client has made too many requests with invalid sessions
+func (service SessionMiddleware) rateLimited(ctx context.Context, w http.ResponseWriter, clientKey string) bool {
+	retryAfter := RateLimitClient(ctx, service.limiter, clientKey, service.log, domain.EventHandlerFunc(service.emit))
+	if retryAfter <= 0 {
+		return false
+	}
+
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	RespondWithStructuredError(w, domain.RequestRateLimited, http.StatusTooManyRequests)
+	return true
+}
+
+// failed counts a request with an invalid session against its client
+func (service SessionMiddleware) failed(ctx context.Context, clientKey string) {
+	CountClientFailure(ctx, service.limiter, clientKey, service.log)
+}
+
+// fingerprintMatches checks that a session bound to a client is being used by that client.
+// If it isn't, it takes the policy's action, responding with an error and returning false unless the action is to log.
+func (service SessionMiddleware) fingerprintMatches(ctx context.Context, w http.ResponseWriter, r *http.Request, session domain.Session) bool {
+	if service.fingerprint == nil {
+		return true
+	}
+
+	action, mismatched := service.fingerprint.Enforce(ctx, r, session, service.session, service.log, domain.EventHandlerFunc(service.emit))
+	if !mismatched {
+		return true
+	}
+
+	switch action {
+	case FingerprintLog:
+		return true
+	case FingerprintReauthenticate:
+		DeleteSessionCookie(w)
+		RespondWithCodedError(w, domain.SessionFingerprintMismatch, ErrorCodeReauthenticate, http.StatusUnauthorized)
+		return false
+	default:
+		RespondWithStructuredError(w, domain.SessionFingerprintMismatch, http.StatusUnauthorized)
+		return false
 	}
 }
 
 // Middleware for verifying session
 func (service SessionMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		sessionCookie, cookieErr := r.Cookie(SessionCookieName)
-		if cookieErr != nil {
-			service.log.WarnError(domain.RequestIsMissingSessionCookie, cookieErr, domain.LogFields{})
-			RespondWithStructuredError(w, domain.RequestIsMissingSessionCookie, http.StatusUnauthorized)
+		session, ok := service.authenticate(w, r, "sesh.SessionMiddleware.Middleware", service.cookie.SessionKeyFromRequest, service.session.GetSessionIfValid, true)
+		if !ok {
 			return
 		}
 
-		sessionKey := sessionCookie.Value
-		session, err := service.session.GetSessionIfValid(sessionKey)
-		if err != nil {
-			if err == domain.ErrValidSessionNotFound {
-				service.log.WarnError(domain.SessionDoesNotExist, err, domain.LogFields{})
-				RespondWithStructuredError(w, domain.SessionDoesNotExist, http.StatusUnauthorized)
-				return
-			}
-			if err == domain.ErrSessionExpired {
-				service.log.WarnError(domain.SessionExpired, err, domain.LogFields{})
-				RespondWithStructuredError(w, domain.SessionExpired, http.StatusUnauthorized)
-				return
-			}
-			service.log.WarnError(domain.SessionUnexpectedError, err, domain.LogFields{})
-			RespondWithStructuredError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if service.expiryHeaders {
+			setExpiryHeaders(w, session)
+		}
+
+		newContext := SetSessionInRequestContext(r, session)
+		next.ServeHTTP(w, r.WithContext(newContext))
+	})
+}
+
+// RequirePending is middleware for the endpoint that completes a login, like the one that checks a one time code.
+// It only accepts pending sessions, which Middleware rejects, and puts the session in the context like Middleware does.
+// Pending sessions are not extended.
+func (service SessionMiddleware) RequirePending(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := service.authenticate(w, r, "sesh.SessionMiddleware.RequirePending", service.cookie.SessionKeyFromRequest, service.session.GetPendingSessionIfValid, false)
+		if !ok {
 			return
 		}
 
@@ -61,15 +168,140 @@ func (service SessionMiddleware) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-// SessionCookieService writes session cookies to a response
+// RequireAuthLevel returns middleware that only lets a request through if its session has been elevated to at least
+// the given level within maxAge, or at any time if maxAge is 0. Otherwise it responds with 403 Forbidden and the error
+// code ErrorCodeStepUpRequired, so that the client can have the user prove themselves again and retry.
+// It must be wrapped by Middleware, which puts the session in the context.
+func (service SessionMiddleware) RequireAuthLevel(level domain.AuthLevel, maxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session := SessionFromRequestContext(r)
+
+			tooLow := session.AuthLevel < level
+			tooOld := maxAge > 0 && time.Since(session.ElevatedAt) > maxAge
+			if tooLow || tooOld {
+				service.log.Info(domain.SessionStepUpRequired, domain.LogFields{
+					"session_hash":        domain.HashSessionKey(session.SessionKey),
+					"auth_level":          session.AuthLevel.String(),
+					"required_auth_level": level.String(),
+				})
+				RespondWithCodedError(w, domain.SessionStepUpRequired, ErrorCodeStepUpRequired, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authenticate verifies the session whose key readKey finds in a request with getSession, in its own span, which ends
+// before the next handler is called. If the session is not valid it responds with an error and returns false, unless
+// remember is set and the client can be logged back in with its remember me cookie.
+func (service SessionMiddleware) authenticate(w http.ResponseWriter, r *http.Request, spanName string, readKey func(r *http.Request) (string, bool, error), getSession func(ctx context.Context, sessionKey string) (domain.Session, error), remember bool) (domain.Session, bool) {
+	ctx, span := seshtrace.Start(r.Context(), spanName)
+	var err error
+	defer func() { seshtrace.End(span, err) }()
+
+	clientKey := ""
+	if service.limiter != nil {
+		clientKey = service.clientKey(r)
+	}
+
+	if service.rateLimited(ctx, w, clientKey) {
+		err = domain.ErrRateLimited
+		return domain.Session{}, false
+	}
+
+	sessionKey, staleKey, err := readKey(r)
+	if err != nil {
+		if remember {
+			if session, ok := service.remembered(ctx, w, r); ok {
+				err = nil
+				return session, true
+			}
+		}
+		if err == http.ErrNoCookie {
+			service.log.WarnError(domain.RequestIsMissingSessionCookie, err, domain.LogFields{})
+			service.emit(domain.Event{Type: domain.EventAuthFailed, Reason: domain.ReasonMissingCookie})
+			RespondWithStructuredError(w, domain.RequestIsMissingSessionCookie, http.StatusUnauthorized)
+			return domain.Session{}, false
+		}
+		// A cookie we can't verify is treated just like a session we can't find.
+		service.failed(ctx, clientKey)
+		service.log.WarnError(domain.SessionDoesNotExist, err, domain.LogFields{})
+		service.emit(domain.Event{Type: domain.EventAuthFailed, Reason: domain.ReasonNotFound})
+		RespondWithStructuredError(w, domain.SessionDoesNotExist, http.StatusUnauthorized)
+		return domain.Session{}, false
+	}
+	span.SetAttributes(seshtrace.SessionHash(sessionKey))
+
+	session, err := getSession(ctx, sessionKey)
+	if err != nil && remember && (err == domain.ErrValidSessionNotFound || err == domain.ErrSessionExpired) {
+		if rememberedSession, ok := service.remembered(ctx, w, r); ok {
+			err = nil
+			return rememberedSession, true
+		}
+	}
+	if err != nil {
+		if err == domain.ErrValidSessionNotFound {
+			service.failed(ctx, clientKey)
+			service.log.WarnError(domain.SessionDoesNotExist, err, domain.LogFields{})
+			RespondWithStructuredError(w, domain.SessionDoesNotExist, http.StatusUnauthorized)
+			return domain.Session{}, false
+		}
+		if err == domain.ErrSessionExpired {
+			service.failed(ctx, clientKey)
+			service.log.WarnError(domain.SessionExpired, err, domain.LogFields{})
+			RespondWithStructuredError(w, domain.SessionExpired, http.StatusUnauthorized)
+			return domain.Session{}, false
+		}
+		if err == domain.ErrSessionPending {
+			service.log.WarnError(domain.SessionPending, err, domain.LogFields{})
+			RespondWithCodedError(w, domain.SessionPending, ErrorCodeLoginIncomplete, http.StatusUnauthorized)
+			return domain.Session{}, false
+		}
+		if err == domain.ErrAccountDenied {
+			service.log.WarnError(domain.AccountDenied, err, domain.LogFields{})
+			RespondWithCodedError(w, domain.AccountDenied, ErrorCodeAccountDenied, http.StatusForbidden)
+			return domain.Session{}, false
+		}
+		service.log.WarnError(domain.SessionUnexpectedError, err, domain.LogFields{})
+		RespondWithStructuredError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return domain.Session{}, false
+	}
+
+	if !service.fingerprintMatches(ctx, w, r, session) {
+		err = domain.ErrFingerprintMismatch
+		return domain.Session{}, false
+	}
+
+	// Re-issue the cookie if it was signed with a key that has since been rotated out, or if the store handed back
+	// a new key when it extended the session, like the stateless cookie store does.
+	if staleKey || session.SessionKey != sessionKey {
+		reissueErr := service.cookie.AddSessionKeyToResponse(w, session.SessionKey)
+		if reissueErr != nil {
+			// The session is still valid, so carry on. The client will keep using its current cookie.
+			service.log.WarnError(domain.SessionCookieReissueFailed, reissueErr, domain.LogFields{})
+		}
+	}
+
+	return session, true
+}
+
+// SessionCookieService reads and writes session cookies
 type SessionCookieService struct {
 	secure bool
+	keys   keyring.Keyring
 }
 
 // NewSessionCookieService returns a SessionCookieService
-func NewSessionCookieService(secure bool) SessionCookieService {
+// If any keyPairs are given, cookie values are signed (and encrypted, if the pair has a block key) with them.
+// They are ordered newest first, see keyring.New: the newest key signs and all of them verify.
+// Without keys, the cookie holds the bare session key.
+func NewSessionCookieService(secure bool, keyPairs ...[]byte) SessionCookieService {
 	return SessionCookieService{
 		secure,
+		keyring.New(keyPairs...),
 	}
 }
 
@@ -91,30 +323,83 @@ func sessionCookie(sessionKey string, secure bool) *http.Cookie {
 	}
 }
 
+// encodeSessionKey signs the session key with the newest key, if we have any
+func (s SessionCookieService) encodeSessionKey(sessionKey string) (string, error) {
+	if s.keys.IsEmpty() {
+		return sessionKey, nil
+	}
+
+	encoded, encodeErr := s.keys.Encode(SessionCookieName, sessionKey)
+	if encodeErr != nil {
+		return "", fmt.Errorf("Failed to sign the session cookie: %w", encodeErr)
+	}
+
+	return encoded, nil
+}
+
 // AddSessionKeyToResponse adds the session cookie to a response given a valid sessionKey
-func (s SessionCookieService) AddSessionKeyToResponse(w http.ResponseWriter, sessionKey string) {
+func (s SessionCookieService) AddSessionKeyToResponse(w http.ResponseWriter, sessionKey string) error {
+	cookieValue, encodeErr := s.encodeSessionKey(sessionKey)
+	if encodeErr != nil {
+		return encodeErr
+	}
 
-	cookie := sessionCookie(sessionKey, s.secure)
+	cookie := sessionCookie(cookieValue, s.secure)
 
 	http.SetCookie(w, cookie)
+
+	return nil
 }
 
 // AddSessionKeyToRequest adds the session cookie to a request given a valid sessionKey
-func (s SessionCookieService) AddSessionKeyToRequest(r *http.Request, sessionKey string) {
+func (s SessionCookieService) AddSessionKeyToRequest(r *http.Request, sessionKey string) error {
+	cookieValue, encodeErr := s.encodeSessionKey(sessionKey)
+	if encodeErr != nil {
+		return encodeErr
+	}
 
-	cookie := sessionCookie(sessionKey, s.secure)
+	cookie := sessionCookie(cookieValue, s.secure)
 
 	r.AddCookie(cookie)
+
+	return nil
+}
+
+// SessionKeyFromRequest reads the session key out of the request's session cookie.
+// It returns http.ErrNoCookie if there is no session cookie, and keyring.ErrUnknownKey if the cookie wasn't
+// signed by any of our keys. staleKey is true when the cookie was signed by a key other than the newest, in which case
+// it should be re-issued.
+func (s SessionCookieService) SessionKeyFromRequest(r *http.Request) (sessionKey string, staleKey bool, err error) {
+	cookie, cookieErr := r.Cookie(SessionCookieName)
+	if cookieErr != nil {
+		return "", false, cookieErr
+	}
+
+	return s.decodeSessionKey(cookie.Value)
+}
+
+// decodeSessionKey verifies a session cookie value, if we have any keys
+func (s SessionCookieService) decodeSessionKey(value string) (sessionKey string, staleKey bool, err error) {
+	if s.keys.IsEmpty() {
+		return value, false, nil
+	}
+
+	staleKey, decodeErr := s.keys.Decode(SessionCookieName, value, &sessionKey)
+	if decodeErr != nil {
+		return "", false, decodeErr
+	}
+
+	return sessionKey, staleKey, nil
 }
 
 // DeleteSessionCookie removes the session cookie
 func DeleteSessionCookie(w http.ResponseWriter) {
 	cookie := &http.Cookie{
-		Name:   SessionCookieName,
-		Value: "",
-		Path: "/",
-		MaxAge: -1,
-		Expires: time.Unix(1, 0),
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Expires:  time.Unix(1, 0),
 		HttpOnly: true,
 	}
 	http.SetCookie(w, cookie)
@@ -152,7 +437,10 @@ func SessionFromContext(ctx context.Context) domain.Session {
 
 // RespondWithStructuredError writes an error code and a json error response
 func RespondWithStructuredError(w http.ResponseWriter, errorMessage string, code int) {
-	errorStruct := newStructuredErrors(newStructuredError(errorMessage))
+	writeStructuredErrors(w, newStructuredErrors(newStructuredError(errorMessage)), code)
+}
+
+func writeStructuredErrors(w http.ResponseWriter, errorStruct structuredErrors, code int) {
 	// It's a little ugly to not just have json write directly to the the Writer, but I don't see another way
 	// to return 500 correctly in the case of an error.
 	jsonString, err := json.Marshal(errorStruct)
@@ -166,6 +454,27 @@ func RespondWithStructuredError(w http.ResponseWriter, errorMessage string, code
 	http.Error(w, string(jsonString), code)
 }
 
+// error codes, for clients that need to tell errors apart
+const (
+	// ErrorCodeReauthenticate means that the session has been ended and the user has to log in again
+	ErrorCodeReauthenticate = "reauthentication_required"
+	// ErrorCodeStepUpRequired means that the session is valid, but the user has to prove themselves again at a higher level
+	ErrorCodeStepUpRequired = "step_up_required"
+	// ErrorCodeLoginIncomplete means that the user has started logging in but has to complete the login, for instance
+	// by entering a one time code
+	ErrorCodeLoginIncomplete = "login_incomplete"
+	// ErrorCodeAccountDenied means that the account isn't allowed to have sessions, for instance because it has been
+	// disabled, and logging in again won't help
+	ErrorCodeAccountDenied = "account_denied"
+)
+
+// RespondWithCodedError writes a json error response like RespondWithStructuredError, including an error code
+func RespondWithCodedError(w http.ResponseWriter, errorMessage string, errorCode string, code int) {
+	structured := newStructuredError(errorMessage)
+	structured.Code = errorCode
+	writeStructuredErrors(w, newStructuredErrors(structured), code)
+}
+
 type structuredError struct {
 	Message string `json:"message"`
 	Code    string `json:"code,omitempty"`
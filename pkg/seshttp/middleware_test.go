@@ -1,25 +1,38 @@
 package seshttp
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
+	"github.com/trussworks/sesh/pkg/cookiestore"
 	"github.com/trussworks/sesh/pkg/dbstore"
 	"github.com/trussworks/sesh/pkg/domain"
 	"github.com/trussworks/sesh/pkg/session"
 )
 
 func makeAuthenticatedFormRequest(logger domain.LogService, sessionService *session.Service, sessionKey string) *http.Response {
-	sessionMiddleware := NewSessionMiddleware(logger, sessionService)
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, NewSessionCookieService(false))
 
 	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Before")
@@ -72,6 +85,11 @@ func getTestStore(t *testing.T) domain.SessionStorageService {
 		return nil
 	}
 
+	migrateErr := dbstore.Migrate(context.Background(), connection)
+	if migrateErr != nil {
+		t.Fatal(migrateErr)
+	}
+
 	return dbstore.NewDBStore(connection)
 }
 
@@ -112,13 +130,17 @@ func (h testLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	accountID := "FOO"
 
-	sessionKey, authErr := h.session.UserDidAuthenticate(accountID)
+	sessionKey, authErr := h.session.UserDidAuthenticate(r.Context(), accountID)
 	if authErr != nil {
 		RespondWithStructuredError(w, "bad session get", http.StatusInternalServerError)
 		return
 	}
 
-	h.cookie.AddSessionKeyToResponse(w, sessionKey)
+	cookieErr := h.cookie.AddSessionKeyToResponse(w, sessionKey)
+	if cookieErr != nil {
+		RespondWithStructuredError(w, "bad cookie", http.StatusInternalServerError)
+		return
+	}
 }
 
 type testAuthenticatedHandler struct{}
@@ -140,7 +162,7 @@ func (h testLogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	session := SessionFromRequestContext(r)
 
-	logoutErr := h.session.UserDidLogout(session.SessionKey)
+	logoutErr := h.session.UserDidLogout(r.Context(), session.SessionKey)
 	if logoutErr != nil {
 		RespondWithStructuredError(w, "Logout Failed", http.StatusInternalServerError)
 		return
@@ -198,7 +220,7 @@ func TestFullSessionHTTPFlow(t *testing.T) {
 	// Make an authenticated request by passing that cookie back in the next request
 	authenticatedHandler := testAuthenticatedHandler{}
 
-	sessionMiddleware := NewSessionMiddleware(logger, sessionService)
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
 	wrappedHandler := sessionMiddleware.Middleware(authenticatedHandler)
 
 	authedW := httptest.NewRecorder()
@@ -272,3 +294,1346 @@ func TestFullSessionHTTPFlow(t *testing.T) {
 		t.Fatal("should be invalid, now")
 	}
 }
+
+func TestStatelessSessionIsReissuedWhenExtended(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false)
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
+	wrappedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+
+	authedW := httptest.NewRecorder()
+	authedR := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr := cookieService.AddSessionKeyToRequest(authedR, sessionKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	wrappedHandler.ServeHTTP(authedW, authedR)
+
+	authedResponse := authedW.Result()
+	if authedResponse.StatusCode != 200 {
+		t.Fatal("should be a valid session", authedResponse.StatusCode)
+	}
+
+	var reissuedCookie *http.Cookie
+	for _, cookie := range authedResponse.Cookies() {
+		if cookie.Name == SessionCookieName {
+			reissuedCookie = cookie
+			break
+		}
+	}
+
+	if reissuedCookie == nil || reissuedCookie.Value == sessionKey {
+		t.Fatal("The extended session should have been written back to the cookie")
+	}
+
+	// logout with the reissued cookie, which should also end the original one.
+	logoutHandler := sessionMiddleware.Middleware(testLogoutHandler{sessionService})
+
+	logoutW := httptest.NewRecorder()
+	logoutR := httptest.NewRequest("POST", "/me/logout", nil)
+	logoutR.AddCookie(reissuedCookie)
+
+	logoutHandler.ServeHTTP(logoutW, logoutR)
+
+	if logoutW.Result().StatusCode != 200 {
+		t.Fatal("should be a valid logout", logoutW.Result().StatusCode)
+	}
+
+	authedAgainW := httptest.NewRecorder()
+	authedAgainR := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr = cookieService.AddSessionKeyToRequest(authedAgainR, sessionKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	wrappedHandler.ServeHTTP(authedAgainW, authedAgainR)
+
+	if authedAgainW.Result().StatusCode != 401 {
+		t.Fatal("should be invalid, now", authedAgainW.Result().StatusCode)
+	}
+}
+
+// staticSessionService is a SessionService that knows about exactly one session
+type staticSessionService struct {
+	domain.SessionService
+	session domain.Session
+}
+
+func (s staticSessionService) GetSessionIfValid(ctx context.Context, sessionKey string) (domain.Session, error) {
+	if sessionKey != s.session.SessionKey {
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	}
+	return s.session, nil
+}
+
+func TestRotatedCookieKeyIsReissued(t *testing.T) {
+	logger := domain.FmtLogger(true)
+	sessionService := staticSessionService{
+		session: domain.Session{
+			AccountID:      "FOO",
+			SessionKey:     "SESSION",
+			ExpirationDate: time.Now().Add(5 * time.Minute),
+		},
+	}
+
+	oldKeys := [][]byte{securecookie.GenerateRandomKey(32), nil}
+	newKeys := [][]byte{securecookie.GenerateRandomKey(32), nil}
+
+	oldCookieService := NewSessionCookieService(false, oldKeys...)
+	rotatedCookieService := NewSessionCookieService(false, append(newKeys, oldKeys...)...)
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, rotatedCookieService)
+	wrappedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+
+	// An unsigned cookie is rejected
+	unsignedW := httptest.NewRecorder()
+	unsignedR := httptest.NewRequest("GET", "/me/save", nil)
+	NewSessionCookieService(false).AddSessionKeyToRequest(unsignedR, "SESSION")
+
+	wrappedHandler.ServeHTTP(unsignedW, unsignedR)
+
+	if unsignedW.Result().StatusCode != 401 {
+		t.Fatal("An unsigned cookie should not be accepted", unsignedW.Result().StatusCode)
+	}
+
+	// A cookie signed with the old key is accepted and re-issued
+	authedW := httptest.NewRecorder()
+	authedR := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr := oldCookieService.AddSessionKeyToRequest(authedR, "SESSION")
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	wrappedHandler.ServeHTTP(authedW, authedR)
+
+	authedResponse := authedW.Result()
+	if authedResponse.StatusCode != 200 {
+		t.Fatal("A cookie signed with an old key should be accepted", authedResponse.StatusCode)
+	}
+
+	var reissuedCookie *http.Cookie
+	for _, cookie := range authedResponse.Cookies() {
+		if cookie.Name == SessionCookieName {
+			reissuedCookie = cookie
+			break
+		}
+	}
+
+	if reissuedCookie == nil {
+		t.Fatal("The cookie should have been re-issued with the newest key")
+	}
+
+	// The re-issued cookie is signed with the new key, and is not re-issued again.
+	newOnlyCookieService := NewSessionCookieService(false, newKeys...)
+
+	reissuedR := httptest.NewRequest("GET", "/me/save", nil)
+	reissuedR.AddCookie(reissuedCookie)
+
+	sessionKey, stale, readErr := newOnlyCookieService.SessionKeyFromRequest(reissuedR)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	if sessionKey != "SESSION" || stale {
+		t.Fatal("The re-issued cookie should be signed with the newest key", sessionKey, stale)
+	}
+
+	reissuedW := httptest.NewRecorder()
+	wrappedHandler.ServeHTTP(reissuedW, reissuedR)
+
+	if reissuedW.Result().StatusCode != 200 || len(reissuedW.Result().Cookies()) != 0 {
+		t.Fatal("A cookie signed with the newest key should be accepted as is")
+	}
+}
+
+func TestMissingCookieEmitsAuthFailedEvent(t *testing.T) {
+	events := []domain.Event{}
+	recordEvent := domain.EventHandlerFunc(func(event domain.Event) {
+		events = append(events, event)
+	})
+
+	sessionMiddleware := NewSessionMiddleware(domain.FmtLogger(true), staticSessionService{}, NewSessionCookieService(false), WithEventHandler(recordEvent))
+	wrappedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/me/save", nil)
+
+	wrappedHandler.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 401 {
+		t.Fatal("Session middleware should have returned 401 unauthorized response")
+	}
+
+	if len(events) != 1 || events[0].Type != domain.EventAuthFailed || events[0].Reason != domain.ReasonMissingCookie {
+		t.Fatal("Should have emitted a single missing cookie event", events)
+	}
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestMiddlewareIsTraced(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previousProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(previousProvider)
+
+	store := cookiestore.NewCookieStore(nil, securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false)
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
+	wrappedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+
+	authedW := httptest.NewRecorder()
+	authedR := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr := cookieService.AddSessionKeyToRequest(authedR, sessionKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	wrappedHandler.ServeHTTP(authedW, authedR)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatal("Should have traced the middleware and the session service", spans.Snapshots())
+	}
+
+	// Spans are exported as they end, so the inner one comes first.
+	serviceSpan, middlewareSpan := spans[0], spans[1]
+	if middlewareSpan.Name != "sesh.SessionMiddleware.Middleware" || serviceSpan.Name != "sesh.Service.GetSessionIfValid" {
+		t.Fatal("Got unexpected spans", middlewareSpan.Name, serviceSpan.Name)
+	}
+
+	if serviceSpan.Parent.SpanID() != middlewareSpan.SpanContext.SpanID() {
+		t.Fatal("The service span should be a child of the middleware span")
+	}
+
+	if spanAttribute(middlewareSpan, "sesh.session_hash") != domain.HashSessionKey(sessionKey) {
+		t.Fatal("The middleware span should have the hashed session key", middlewareSpan.Attributes)
+	}
+
+	if spanAttribute(middlewareSpan, "sesh.outcome") != "ok" {
+		t.Fatal("The middleware span should have succeeded", middlewareSpan.Attributes)
+	}
+
+	exporter.Reset()
+
+	response := makeAuthenticatedFormRequest(logger, sessionService, "GARBAGE")
+	if response.StatusCode != 401 {
+		t.Fatal("Session middleware should have returned 401 unauthorized response")
+	}
+
+	spans = exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatal("Should have traced the middleware and the session service", spans.Snapshots())
+	}
+
+	for _, span := range spans {
+		if spanAttribute(span, "sesh.outcome") != domain.ReasonNotFound || spanAttribute(span, "error.type") != domain.ReasonNotFound {
+			t.Fatal("The span should record that the session was not found", span.Name, span.Attributes)
+		}
+		if span.Status.Code == codes.Error {
+			t.Fatal("A session that isn't found is not a failure of the span", span.Name)
+		}
+	}
+}
+
+func TestInvalidSessionsAreRateLimited(t *testing.T) {
+	store := cookiestore.NewCookieStore(nil, securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false)
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	events := []domain.Event{}
+	recordEvent := domain.EventHandlerFunc(func(event domain.Event) {
+		events = append(events, event)
+	})
+
+	limiter := NewMemoryRateLimiter(2, time.Minute)
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService, WithRateLimiter(limiter), WithEventHandler(recordEvent))
+	wrappedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+
+	makeRequest := func(remoteAddr string, sessionKey string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/me/save", nil)
+		r.RemoteAddr = remoteAddr
+		cookieErr := cookieService.AddSessionKeyToRequest(r, sessionKey)
+		if cookieErr != nil {
+			t.Fatal(cookieErr)
+		}
+		wrappedHandler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	for i := 0; i < 2; i++ {
+		response := makeRequest("192.0.2.1:1234", "GARBAGE")
+		if response.StatusCode != 401 {
+			t.Fatal("Invalid sessions under the limit should be unauthorized", response.StatusCode)
+		}
+	}
+
+	// Once the client is limited, even its valid sessions are turned away
+	response := makeRequest("192.0.2.1:5678", sessionKey)
+	if response.StatusCode != 429 {
+		t.Fatal("The client should have been rate limited", response.StatusCode)
+	}
+
+	retryAfter, parseErr := strconv.Atoi(response.Header.Get("Retry-After"))
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	if retryAfter <= 0 || retryAfter > 60 {
+		t.Fatal("Retry-After should be the rest of the window", retryAfter)
+	}
+
+	lastEvent := events[len(events)-1]
+	if lastEvent.Type != domain.EventAuthFailed || lastEvent.Reason != domain.ReasonRateLimited {
+		t.Fatal("Should have emitted a rate limited event", lastEvent)
+	}
+
+	response = makeRequest("198.51.100.1:1234", sessionKey)
+	if response.StatusCode != 200 {
+		t.Fatal("Other clients should not be limited", response.StatusCode)
+	}
+
+	// Move past the window
+	limiter.now = func() time.Time { return time.Now().Add(time.Minute) }
+
+	response = makeRequest("192.0.2.1:1234", sessionKey)
+	if response.StatusCode != 200 {
+		t.Fatal("The client should be let through once its window is over", response.StatusCode)
+	}
+}
+
+func TestFingerprintMismatch(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false)
+
+	makeRequest := func(handler http.Handler, userAgent string, sessionKey string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/me/save", nil)
+		r.Header.Set("User-Agent", userAgent)
+		cookieErr := cookieService.AddSessionKeyToRequest(r, sessionKey)
+		if cookieErr != nil {
+			t.Fatal(cookieErr)
+		}
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	for _, action := range []FingerprintAction{FingerprintReject, FingerprintReauthenticate, FingerprintLog} {
+		events := []domain.Event{}
+		recordEvent := domain.EventHandlerFunc(func(event domain.Event) {
+			events = append(events, event)
+		})
+
+		policy := FingerprintPolicy{Fingerprinter: UserAgentFingerprint, Action: action}
+		sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService, WithFingerprintPolicy(policy), WithEventHandler(recordEvent))
+		wrappedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+
+		loginR := httptest.NewRequest("POST", "/login", nil)
+		loginR.Header.Set("User-Agent", "Firefox")
+		sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO", domain.WithFingerprint(policy.Fingerprint(loginR)))
+		if authErr != nil {
+			t.Fatal(authErr)
+		}
+
+		response := makeRequest(wrappedHandler, "Firefox", sessionKey)
+		if response.StatusCode != 200 || len(events) != 0 {
+			t.Fatal("The client that logged in should be let through", action, response.StatusCode, events)
+		}
+
+		response = makeRequest(wrappedHandler, "curl", sessionKey)
+		if len(events) != 1 || events[0].Type != domain.EventFingerprintMismatch || events[0].Reason != action.String() {
+			t.Fatal("Should have emitted a fingerprint mismatch event", action, events)
+		}
+
+		switch action {
+		case FingerprintLog:
+			if response.StatusCode != 200 {
+				t.Fatal("Mismatches should only be logged", response.StatusCode)
+			}
+		case FingerprintReject:
+			if response.StatusCode != 401 {
+				t.Fatal("Mismatches should be rejected", response.StatusCode)
+			}
+			if makeRequest(wrappedHandler, "Firefox", sessionKey).StatusCode != 200 {
+				t.Fatal("Rejecting a mismatch should leave the session alone")
+			}
+		case FingerprintReauthenticate:
+			if response.StatusCode != 401 {
+				t.Fatal("Mismatches should be rejected", response.StatusCode)
+			}
+
+			var errors structuredErrors
+			decodeErr := json.NewDecoder(response.Body).Decode(&errors)
+			if decodeErr != nil {
+				t.Fatal(decodeErr)
+			}
+			if len(errors.Errors) != 1 || errors.Errors[0].Code != ErrorCodeReauthenticate {
+				t.Fatal("Should have told the client to log in again", errors)
+			}
+
+			if makeRequest(wrappedHandler, "Firefox", sessionKey).StatusCode != 401 {
+				t.Fatal("The session should have been ended")
+			}
+		}
+	}
+}
+
+func TestUnboundSessionsAreNotFingerprinted(t *testing.T) {
+	store := cookiestore.NewCookieStore(nil, securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false)
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	policy := FingerprintPolicy{Fingerprinter: UserAgentFingerprint, Action: FingerprintReject}
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService, WithFingerprintPolicy(policy))
+	wrappedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/me/save", nil)
+	r.Header.Set("User-Agent", "curl")
+	cookieErr := cookieService.AddSessionKeyToRequest(r, sessionKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	wrappedHandler.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatal("A session created without a fingerprint should not be checked", w.Result().StatusCode)
+	}
+}
+
+func TestIPPrefixFingerprint(t *testing.T) {
+	fingerprint := IPPrefixFingerprint(24, 64)
+
+	fingerprintOf := func(remoteAddr string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		return fingerprint(r)
+	}
+
+	if fingerprintOf("192.0.2.1:1234") != fingerprintOf("192.0.2.200:5678") {
+		t.Fatal("Addresses in the same IPv4 network should match")
+	}
+	if fingerprintOf("192.0.2.1:1234") == fingerprintOf("192.0.3.1:1234") {
+		t.Fatal("Addresses in different IPv4 networks should not match")
+	}
+	if fingerprintOf("[2001:db8::1]:1234") != fingerprintOf("[2001:db8::ffff]:1234") {
+		t.Fatal("Addresses in the same IPv6 network should match")
+	}
+	if fingerprintOf("[2001:db8::1]:1234") == fingerprintOf("[2001:db8:0:1::1]:1234") {
+		t.Fatal("Addresses in different IPv6 networks should not match")
+	}
+}
+
+func TestStepUpIsRequired(t *testing.T) {
+	store := cookiestore.NewCookieStore(nil, securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false)
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
+	requireMFA := sessionMiddleware.Middleware(sessionMiddleware.RequireAuthLevel(domain.AuthLevelMFA, time.Minute)(testAuthenticatedHandler{}))
+	requireRecentLogin := sessionMiddleware.Middleware(sessionMiddleware.RequireAuthLevel(domain.AuthLevelPassword, time.Minute)(testAuthenticatedHandler{}))
+
+	makeRequest := func(handler http.Handler, sessionKey string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/me/payment", nil)
+		cookieErr := cookieService.AddSessionKeyToRequest(r, sessionKey)
+		if cookieErr != nil {
+			t.Fatal(cookieErr)
+		}
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	if response := makeRequest(requireRecentLogin, sessionKey); response.StatusCode != 200 {
+		t.Fatal("A session that just logged in should be let through", response.StatusCode)
+	}
+
+	response := makeRequest(requireMFA, sessionKey)
+	if response.StatusCode != 403 {
+		t.Fatal("A password session should have to step up", response.StatusCode)
+	}
+
+	var errors structuredErrors
+	decodeErr := json.NewDecoder(response.Body).Decode(&errors)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if len(errors.Errors) != 1 || errors.Errors[0].Code != ErrorCodeStepUpRequired {
+		t.Fatal("Should have told the client to step up", errors)
+	}
+
+	elevated, elevateErr := sessionService.Elevate(context.Background(), sessionKey, domain.AuthLevelMFA)
+	if elevateErr != nil {
+		t.Fatal(elevateErr)
+	}
+
+	if elevated.AuthLevel != domain.AuthLevelMFA {
+		t.Fatal("The session should have been elevated", elevated.AuthLevel)
+	}
+
+	if response := makeRequest(requireMFA, elevated.SessionKey); response.StatusCode != 200 {
+		t.Fatal("An elevated session should be let through", response.StatusCode)
+	}
+
+	// Elevating long enough ago is no better than never having elevated
+	staleSession := elevated
+	staleSession.ElevatedAt = time.Now().Add(-2 * time.Minute)
+	staleService := staticSessionService{session: staleSession}
+	staleMiddleware := NewSessionMiddleware(logger, staleService, cookieService)
+	requireStaleMFA := staleMiddleware.Middleware(staleMiddleware.RequireAuthLevel(domain.AuthLevelMFA, time.Minute)(testAuthenticatedHandler{}))
+
+	if response := makeRequest(requireStaleMFA, staleSession.SessionKey); response.StatusCode != 403 {
+		t.Fatal("A session elevated too long ago should have to step up again", response.StatusCode)
+	}
+}
+
+func TestPendingSessionsOnlyCompleteTheLogin(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger, session.WithPendingTimeout(time.Minute))
+	cookieService := NewSessionCookieService(false)
+
+	pendingKey, authErr := sessionService.UserDidPartiallyAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
+	authenticatedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+	pendingHandler := sessionMiddleware.RequirePending(testAuthenticatedHandler{})
+
+	makeRequest := func(handler http.Handler, sessionKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/me/save", nil)
+		cookieErr := cookieService.AddSessionKeyToRequest(r, sessionKey)
+		if cookieErr != nil {
+			t.Fatal(cookieErr)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	pendingW := makeRequest(authenticatedHandler, pendingKey)
+	if pendingW.Code != 401 {
+		t.Fatal("A pending session should not be authenticated", pendingW.Code)
+	}
+
+	var errors structuredErrors
+	decodeErr := json.NewDecoder(pendingW.Body).Decode(&errors)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if len(errors.Errors) != 1 || errors.Errors[0].Code != ErrorCodeLoginIncomplete {
+		t.Fatal("Should have told the client to complete the login", errors)
+	}
+
+	if len(pendingW.Result().Cookies()) != 0 {
+		t.Fatal("A pending session should not have been extended")
+	}
+
+	if code := makeRequest(pendingHandler, pendingKey).Code; code != 200 {
+		t.Fatal("A pending session should be accepted by RequirePending", code)
+	}
+
+	pending, fetchErr := sessionService.GetPendingSessionIfValid(context.Background(), pendingKey)
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+	if pending.ExpirationDate.After(time.Now().Add(time.Minute)) {
+		t.Fatal("A pending session should last for the pending timeout", pending.ExpirationDate)
+	}
+
+	sessionKey, completeErr := sessionService.UserDidCompleteAuthentication(context.Background(), pendingKey, domain.AuthLevelMFA)
+	if completeErr != nil {
+		t.Fatal(completeErr)
+	}
+
+	if sessionKey == pendingKey {
+		t.Fatal("Completing the login should rotate the session key")
+	}
+
+	if code := makeRequest(authenticatedHandler, sessionKey).Code; code != 200 {
+		t.Fatal("A completed login should be authenticated", code)
+	}
+
+	if code := makeRequest(pendingHandler, sessionKey).Code; code != 401 {
+		t.Fatal("A full session should not be accepted by RequirePending", code)
+	}
+
+	if code := makeRequest(pendingHandler, pendingKey).Code; code != 401 {
+		t.Fatal("The pending session should have ended with the login", code)
+	}
+}
+
+func TestDeniedAccountsAreForbidden(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	disabled := false
+	validator := func(ctx context.Context, accountID string) (bool, error) {
+		return !disabled, nil
+	}
+	sessionService := session.NewSessionService(5*time.Minute, store, logger,
+		session.WithAccountValidator(validator), session.WithRequestAccountValidation(0))
+	cookieService := NewSessionCookieService(false)
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
+	wrappedHandler := sessionMiddleware.Middleware(testAuthenticatedHandler{})
+
+	makeRequest := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/me/save", nil)
+		cookieErr := cookieService.AddSessionKeyToRequest(r, sessionKey)
+		if cookieErr != nil {
+			t.Fatal(cookieErr)
+		}
+		wrappedHandler.ServeHTTP(w, r)
+		return w
+	}
+
+	if code := makeRequest().Code; code != 200 {
+		t.Fatal("An allowed account should be authenticated", code)
+	}
+
+	disabled = true
+	deniedW := makeRequest()
+	if deniedW.Code != 403 {
+		t.Fatal("A disabled account should be forbidden", deniedW.Code)
+	}
+
+	var errors structuredErrors
+	decodeErr := json.NewDecoder(deniedW.Body).Decode(&errors)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if len(errors.Errors) != 1 || errors.Errors[0].Code != ErrorCodeAccountDenied {
+		t.Fatal("Should have told the client that the account was denied", errors)
+	}
+
+	disabled = false
+	if code := makeRequest().Code; code != 401 {
+		t.Fatal("The session of the disabled account should have been destroyed", code)
+	}
+}
+
+func TestImpersonationRecordsTheActor(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+
+	events := []domain.Event{}
+	recordEvent := domain.EventHandlerFunc(func(event domain.Event) {
+		events = append(events, event)
+	})
+
+	sessionService := session.NewSessionService(5*time.Minute, store, logger, session.WithEventHandler(recordEvent))
+	cookieService := NewSessionCookieService(false)
+
+	adminKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "ADMIN")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	impersonationKey, startErr := sessionService.StartImpersonation(context.Background(), adminKey, "CUSTOMER")
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+
+	startEvent := events[len(events)-1]
+	if startEvent.Type != domain.EventImpersonationStarted || startEvent.AccountID != "CUSTOMER" || startEvent.ActorAccountID != "ADMIN" {
+		t.Fatal("Should have emitted an event with both accounts", startEvent)
+	}
+
+	var impersonated domain.Session
+	recordSession := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		impersonated = SessionFromRequestContext(r)
+	})
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr := cookieService.AddSessionKeyToRequest(r, impersonationKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	sessionMiddleware.Middleware(recordSession).ServeHTTP(w, r)
+
+	if w.Code != 200 || impersonated.AccountID != "CUSTOMER" || impersonated.ActorAccountID != "ADMIN" {
+		t.Fatal("The impersonation session should be for the customer, used by the admin", w.Code, impersonated)
+	}
+
+	_, nestedErr := sessionService.StartImpersonation(context.Background(), impersonationKey, "OTHER_CUSTOMER")
+	if nestedErr != domain.ErrAlreadyImpersonating {
+		t.Fatal("Should not be able to impersonate someone while impersonating someone", nestedErr)
+	}
+
+	// The cookie store can't find the admin's session again, so they have to log in again.
+	_, stopErr := sessionService.StopImpersonation(context.Background(), impersonated.SessionKey)
+	if stopErr != domain.ErrValidSessionNotFound {
+		t.Fatal("Should not have restored a session the store can't find", stopErr)
+	}
+
+	stopEvent := events[len(events)-1]
+	if stopEvent.Type != domain.EventImpersonationStopped || stopEvent.AccountID != "CUSTOMER" || stopEvent.ActorAccountID != "ADMIN" {
+		t.Fatal("Should have emitted an event with both accounts", stopEvent)
+	}
+
+	_, endedErr := sessionService.GetSessionIfValid(context.Background(), impersonationKey)
+	if endedErr != domain.ErrValidSessionNotFound {
+		t.Fatal("The impersonation session should have ended", endedErr)
+	}
+
+	_, notImpersonatingErr := sessionService.StopImpersonation(context.Background(), adminKey)
+	if notImpersonatingErr != domain.ErrNotImpersonating {
+		t.Fatal("Should not be able to stop impersonating without impersonating", notImpersonatingErr)
+	}
+}
+
+// staticRememberService is a RememberService that knows about exactly one token, which it rotates to newToken
+type staticRememberService struct {
+	domain.RememberService
+	token     string
+	newToken  string
+	accountID string
+	err       error
+}
+
+func (s staticRememberService) Exchange(ctx context.Context, token string) (string, string, time.Time, error) {
+	if s.err != nil {
+		return s.accountID, "", time.Time{}, s.err
+	}
+	if token != s.token {
+		return "", "", time.Time{}, domain.ErrRememberTokenInvalid
+	}
+	return s.accountID, s.newToken, time.Now().Add(24 * time.Hour), nil
+}
+
+func TestRememberTokenStartsANewSession(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false, securecookie.GenerateRandomKey(32))
+	remember := staticRememberService{token: "SELECTOR.OLD", newToken: "SELECTOR.NEW", accountID: "FOO"}
+
+	var remembered domain.Session
+	recordSession := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remembered = SessionFromRequestContext(r)
+	})
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService, WithRememberService(remember))
+	wrappedHandler := sessionMiddleware.Middleware(recordSession)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr := cookieService.AddRememberTokenToRequest(r, remember.token, time.Now().Add(time.Hour))
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	wrappedHandler.ServeHTTP(w, r)
+
+	if w.Code != 200 || remembered.AccountID != "FOO" {
+		t.Fatal("Should have logged the account back in", w.Code, remembered)
+	}
+
+	if remembered.State != domain.SessionStateRemembered || remembered.AuthLevel != domain.AuthLevelPassword || !remembered.ElevatedAt.IsZero() {
+		t.Fatal("A remembered session should not count as a fresh login", remembered.SessionMetadata)
+	}
+
+	cookieR := &http.Request{Header: http.Header{"Cookie": w.Header()["Set-Cookie"]}}
+	sessionKey, _, sessionErr := cookieService.SessionKeyFromRequest(cookieR)
+	if sessionErr != nil || sessionKey != remembered.SessionKey {
+		t.Fatal("Should have written the new session to the cookie", sessionErr)
+	}
+
+	token, tokenErr := cookieService.RememberTokenFromRequest(cookieR)
+	if tokenErr != nil || token != remember.newToken {
+		t.Fatal("Should have written the rotated token to the cookie", token, tokenErr)
+	}
+
+	// An expired session is replaced too, but a bad token just gets its cookie removed.
+	badW := httptest.NewRecorder()
+	badR := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr = cookieService.AddSessionKeyToRequest(badR, "NOT_A_SESSION")
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+	cookieErr = cookieService.AddRememberTokenToRequest(badR, "SELECTOR.STALE", time.Now().Add(time.Hour))
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	wrappedHandler.ServeHTTP(badW, badR)
+
+	if badW.Code != 401 {
+		t.Fatal("A bad token should not log anyone in", badW.Code)
+	}
+
+	deleted := false
+	for _, cookie := range badW.Result().Cookies() {
+		if cookie.Name == RememberCookieName && cookie.MaxAge < 0 {
+			deleted = true
+		}
+	}
+	if !deleted {
+		t.Fatal("The bad token's cookie should have been removed")
+	}
+}
+
+func TestRememberCookieIsKeptForConcurrentRequests(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false, securecookie.GenerateRandomKey(32))
+
+	rememberCookies := func(remember domain.RememberService) (int, []*http.Cookie) {
+		sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService, WithRememberService(remember))
+		wrappedHandler := sessionMiddleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/me/save", nil)
+		cookieErr := cookieService.AddRememberTokenToRequest(r, "SELECTOR.OLD", time.Now().Add(time.Hour))
+		if cookieErr != nil {
+			t.Fatal(cookieErr)
+		}
+
+		wrappedHandler.ServeHTTP(w, r)
+
+		cookies := []*http.Cookie{}
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == RememberCookieName {
+				cookies = append(cookies, cookie)
+			}
+		}
+		return w.Code, cookies
+	}
+
+	// A concurrent request has already exchanged the token and handed out the new one.
+	code, cookies := rememberCookies(staticRememberService{token: "SELECTOR.OLD", accountID: "FOO"})
+	if code != 200 {
+		t.Fatal("Should have logged the account back in", code)
+	}
+	if len(cookies) != 0 {
+		t.Fatal("Should have left the remember me cookie for the concurrent request to replace", cookies)
+	}
+
+	code, cookies = rememberCookies(staticRememberService{err: errors.New("the database is down")})
+	if code != 401 {
+		t.Fatal("Should not have logged anyone in", code)
+	}
+	if len(cookies) != 0 {
+		t.Fatal("Should have kept the remember me cookie, the token may well still be good", cookies)
+	}
+}
+
+// revokingSessionService is a SessionService that records the accounts whose sessions it revokes
+type revokingSessionService struct {
+	domain.SessionService
+	revoked []string
+}
+
+func (s *revokingSessionService) RevokeAccountSessions(ctx context.Context, accountID string) error {
+	s.revoked = append(s.revoked, accountID)
+	return nil
+}
+
+func TestStolenRememberTokenRevokesTheAccountsSessions(t *testing.T) {
+	logger := domain.FmtLogger(true)
+	sessionService := &revokingSessionService{}
+	cookieService := NewSessionCookieService(false, securecookie.GenerateRandomKey(32))
+	remember := staticRememberService{accountID: "FOO", err: domain.ErrRememberTokenStolen}
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService, WithRememberService(remember))
+	wrappedHandler := sessionMiddleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr := cookieService.AddRememberTokenToRequest(r, "SELECTOR.STOLEN", time.Now().Add(time.Hour))
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	wrappedHandler.ServeHTTP(w, r)
+
+	if w.Code != 401 {
+		t.Fatal("A stolen token should not log anyone in", w.Code)
+	}
+
+	if len(sessionService.revoked) != 1 || sessionService.revoked[0] != "FOO" {
+		t.Fatal("Should have revoked the sessions the thief may have started", sessionService.revoked)
+	}
+}
+
+func TestStatusDoesNotExtendTheSession(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+	sessionService := session.NewSessionService(5*time.Minute, store, logger)
+	cookieService := NewSessionCookieService(false)
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	created, peekErr := sessionService.PeekSessionIfValid(context.Background(), sessionKey)
+	if peekErr != nil {
+		t.Fatal(peekErr)
+	}
+
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService, WithExpiryHeaders())
+
+	statusW := httptest.NewRecorder()
+	statusR := httptest.NewRequest("GET", "/session", nil)
+	cookieErr := cookieService.AddSessionKeyToRequest(statusR, sessionKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	sessionMiddleware.StatusHandler().ServeHTTP(statusW, statusR)
+
+	if statusW.Code != 200 {
+		t.Fatal("should be a valid session", statusW.Code)
+	}
+
+	if len(statusW.Result().Cookies()) != 0 {
+		t.Fatal("Checking the status should not have extended the session")
+	}
+
+	status := SessionStatus{}
+	decodeErr := json.NewDecoder(statusW.Body).Decode(&status)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+
+	if !status.ExpiresAt.Equal(created.ExpirationDate) || status.IdleTimeoutSeconds != 300 {
+		t.Fatal("Should have reported the session's expiration date and timeout", status)
+	}
+	if status.ExpiresInSeconds <= 290 || status.ExpiresInSeconds > 300 {
+		t.Fatal("Should have reported how long the session has left", status.ExpiresInSeconds)
+	}
+
+	authedW := httptest.NewRecorder()
+	authedR := httptest.NewRequest("GET", "/me/save", nil)
+	cookieErr = cookieService.AddSessionKeyToRequest(authedR, sessionKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	sessionMiddleware.Middleware(testAuthenticatedHandler{}).ServeHTTP(authedW, authedR)
+
+	if authedW.Code != 200 {
+		t.Fatal("should be a valid session", authedW.Code)
+	}
+
+	expiresAt, parseErr := time.Parse(time.RFC3339, authedW.Header().Get(ExpiresAtHeader))
+	if parseErr != nil {
+		t.Fatal("Should have set the expiration date header", parseErr)
+	}
+	if expiresAt.Before(created.ExpirationDate.Truncate(time.Second)) {
+		t.Fatal("Should have reported the extended expiration date", expiresAt)
+	}
+	if authedW.Header().Get(IdleTimeoutHeader) != "300" {
+		t.Fatal("Should have set the idle timeout header", authedW.Header().Get(IdleTimeoutHeader))
+	}
+
+	logoutErr := sessionService.UserDidLogout(context.Background(), sessionKey)
+	if logoutErr != nil {
+		t.Fatal(logoutErr)
+	}
+
+	endedW := httptest.NewRecorder()
+	endedR := httptest.NewRequest("GET", "/session", nil)
+	cookieErr = cookieService.AddSessionKeyToRequest(endedR, sessionKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	sessionMiddleware.StatusHandler().ServeHTTP(endedW, endedR)
+
+	if endedW.Code != 401 {
+		t.Fatal("An ended session should have no status", endedW.Code)
+	}
+}
+
+// readStreamEvent reads the next event from a Server-Sent Events stream, skipping comments
+func readStreamEvent(t *testing.T, stream *bufio.Reader) (string, string) {
+	t.Helper()
+
+	streamEvent, data := "", ""
+	for {
+		line, readErr := stream.ReadString('\n')
+		if readErr != nil {
+			t.Fatal("The stream ended before an event", readErr)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && streamEvent != "":
+			return streamEvent, data
+		case strings.HasPrefix(line, "event: "):
+			streamEvent = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestSessionStreamPushesTheEndOfTheSession(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+
+	var stream *SessionStream
+	streamEvents := domain.EventHandlerFunc(func(event domain.Event) {
+		stream.HandleEvent(event)
+	})
+
+	sessionService := session.NewSessionService(5*time.Minute, store, logger, session.WithEventHandler(streamEvents))
+	stream = NewSessionStream(logger, sessionService, WithExpiryWarning(10*time.Minute))
+	cookieService := NewSessionCookieService(false)
+	remember := staticRememberService{token: "SELECTOR.OLD", newToken: "SELECTOR.NEW", accountID: "FOO"}
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService, WithRememberService(remember))
+
+	server := httptest.NewServer(sessionMiddleware.EventStream(stream))
+	defer server.Close()
+
+	// Connecting to the stream must not log the client back in.
+	rememberedReq, reqErr := http.NewRequest("GET", server.URL, nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	cookieErr := cookieService.AddRememberTokenToRequest(rememberedReq, remember.token, time.Now().Add(time.Hour))
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	rememberedResp, getErr := server.Client().Do(rememberedReq)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	rememberedResp.Body.Close()
+
+	if rememberedResp.StatusCode != 401 {
+		t.Fatal("A remember me cookie should not open a stream", rememberedResp.StatusCode)
+	}
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	created, peekErr := sessionService.PeekSessionIfValid(context.Background(), sessionKey)
+	if peekErr != nil {
+		t.Fatal(peekErr)
+	}
+
+	// Let the clock move on, so that extending the session would change its expiration date.
+	time.Sleep(10 * time.Millisecond)
+
+	req, reqErr := http.NewRequest("GET", server.URL, nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	cookieErr = cookieService.AddSessionKeyToRequest(req, sessionKey)
+	if cookieErr != nil {
+		t.Fatal(cookieErr)
+	}
+
+	resp, getErr := server.Client().Do(req)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Should have opened a stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	if len(resp.Header["Set-Cookie"]) != 0 {
+		t.Fatal("Opening the stream should not have touched the session cookie", resp.Header["Set-Cookie"])
+	}
+
+	events := bufio.NewReader(resp.Body)
+
+	streamEvent, data := readStreamEvent(t, events)
+	if streamEvent != StreamEventExpiringSoon {
+		t.Fatal("A session within the warning should be expiring soon", streamEvent)
+	}
+
+	status := SessionStatus{}
+	decodeErr := json.Unmarshal([]byte(data), &status)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if status.ExpiresInSeconds <= 0 || status.IdleTimeoutSeconds != 300 {
+		t.Fatal("Should have sent the session's status", status)
+	}
+	if !status.ExpiresAt.Equal(created.ExpirationDate.UTC()) {
+		t.Fatal("Opening the stream should not have extended the session", status.ExpiresAt, created.ExpirationDate)
+	}
+
+	logoutErr := sessionService.UserDidLogout(context.Background(), sessionKey)
+	if logoutErr != nil {
+		t.Fatal(logoutErr)
+	}
+
+	streamEvent, _ = readStreamEvent(t, events)
+	if streamEvent != StreamEventRevoked {
+		t.Fatal("Should have pushed the logout", streamEvent)
+	}
+
+	_, readErr := events.ReadString('\n')
+	if readErr == nil {
+		t.Fatal("The stream should have been closed")
+	}
+}
+
+// memoryEpochs is an AccountEpochStorageService that keeps epochs in a map
+type memoryEpochs map[string]int64
+
+func (e memoryEpochs) FetchAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	return e[accountID], nil
+}
+
+func (e memoryEpochs) IncrementAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	e[accountID]++
+	return e[accountID], nil
+}
+
+func TestSessionStreamPushesTheEndOfEveryAccountSession(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+
+	var stream *SessionStream
+	streamEvents := domain.EventHandlerFunc(func(event domain.Event) {
+		stream.HandleEvent(event)
+	})
+
+	disabled := false
+	validator := func(ctx context.Context, accountID string) (bool, error) {
+		return !disabled, nil
+	}
+	sessionService := session.NewSessionService(5*time.Minute, store, logger, session.WithEventHandler(streamEvents),
+		session.WithAccountEpochs(memoryEpochs{}), session.WithAccountEpochCache(0),
+		session.WithAccountValidator(validator), session.WithRequestAccountValidation(0))
+	stream = NewSessionStream(logger, sessionService)
+	cookieService := NewSessionCookieService(false)
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
+
+	server := httptest.NewServer(sessionMiddleware.EventStream(stream))
+	defer server.Close()
+	// Without being woken, the streams would only check on their sessions once they are about to time out.
+	client := server.Client()
+	client.Timeout = 5 * time.Second
+
+	openStream := func(accountID string) *bufio.Reader {
+		sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), accountID)
+		if authErr != nil {
+			t.Fatal(authErr)
+		}
+
+		req, reqErr := http.NewRequest("GET", server.URL, nil)
+		if reqErr != nil {
+			t.Fatal(reqErr)
+		}
+		cookieErr := cookieService.AddSessionKeyToRequest(req, sessionKey)
+		if cookieErr != nil {
+			t.Fatal(cookieErr)
+		}
+
+		resp, getErr := client.Do(req)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		if resp.StatusCode != 200 {
+			t.Fatal("Should have opened a stream", resp.StatusCode)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+
+	revoked := openStream("FOO")
+
+	revokeErr := sessionService.RevokeAccountSessions(context.Background(), "FOO")
+	if revokeErr != nil {
+		t.Fatal(revokeErr)
+	}
+
+	streamEvent, _ := readStreamEvent(t, revoked)
+	if streamEvent != StreamEventRevoked {
+		t.Fatal("Should have pushed the revocation of the account's sessions", streamEvent)
+	}
+
+	denied := openStream("BAR")
+	otherKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "BAR")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	disabled = true
+	_, getErr := sessionService.GetSessionIfValid(context.Background(), otherKey)
+	if getErr != domain.ErrAccountDenied {
+		t.Fatal("The account should have been denied", getErr)
+	}
+
+	streamEvent, _ = readStreamEvent(t, denied)
+	if streamEvent != StreamEventRevoked {
+		t.Fatal("Should have pushed the denial of the account", streamEvent)
+	}
+}
+
+func TestWatchedConnectionsEndWithTheirSession(t *testing.T) {
+	store := cookiestore.NewCookieStore(cookiestore.NewMemoryDenylist(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	logger := domain.FmtLogger(true)
+
+	var stream *SessionStream
+	streamEvents := domain.EventHandlerFunc(func(event domain.Event) {
+		stream.HandleEvent(event)
+	})
+
+	sessionService := session.NewSessionService(5*time.Minute, store, logger, session.WithEventHandler(streamEvents))
+	stream = NewSessionStream(logger, sessionService)
+	cookieService := NewSessionCookieService(false, securecookie.GenerateRandomKey(32))
+	sessionMiddleware := NewSessionMiddleware(logger, sessionService, cookieService)
+
+	sessionKey, authErr := sessionService.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	token, tokenErr := cookieService.SessionToken(sessionKey)
+	if tokenErr != nil {
+		t.Fatal(tokenErr)
+	}
+
+	unauthedW := httptest.NewRecorder()
+	unauthedR := httptest.NewRequest("GET", "/socket", nil)
+	unauthedR.Header.Set("Authorization", "Bearer "+sessionKey)
+
+	_, ok := sessionMiddleware.AuthenticateUpgrade(unauthedW, unauthedR)
+	if ok || unauthedW.Code != 401 {
+		t.Fatal("A token that isn't signed should not authenticate", unauthedW.Code)
+	}
+
+	// Like a real WebSocket handler, this one hands the connection on and returns, which cancels the request's context.
+	type connection struct {
+		session domain.Session
+		ctx     context.Context
+		cancel  context.CancelFunc
+	}
+	connections := make(chan connection, 1)
+	ended := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgradeR, ok := sessionMiddleware.AuthenticateUpgrade(w, r)
+		if !ok {
+			return
+		}
+
+		connected := SessionFromRequestContext(upgradeR)
+		ctx, cancel := stream.Watch(context.WithoutCancel(upgradeR.Context()), connected, func(streamEvent string) {
+			ended <- streamEvent
+		})
+		connections <- connection{connected, ctx, cancel}
+	}))
+	defer server.Close()
+
+	req, reqErr := http.NewRequest("GET", server.URL+"/socket", nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, getErr := server.Client().Do(req)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatal("Should have authenticated the upgrade with the token", resp.StatusCode)
+	}
+
+	conn := <-connections
+	defer conn.cancel()
+	ctx := conn.ctx
+
+	// The cookie store reseals the session when it is extended, so follow the session in the context.
+	connected := conn.session
+	if connected.AccountID != "FOO" {
+		t.Fatal("Should have put the session in the context", connected)
+	}
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("The connection should last as long as its session, not as long as the request")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if SessionFromContext(ctx).SessionKey != connected.SessionKey {
+		t.Fatal("The connection's context should still hold the session")
+	}
+
+	logoutErr := sessionService.UserDidLogout(context.Background(), connected.SessionKey)
+	if logoutErr != nil {
+		t.Fatal(logoutErr)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("The connection's context should have been cancelled")
+	}
+
+	if streamEvent := <-ended; streamEvent != StreamEventRevoked {
+		t.Fatal("Should have been told why the connection ended", streamEvent)
+	}
+}
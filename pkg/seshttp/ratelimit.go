@@ -0,0 +1,141 @@
+package seshttp
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// RateLimiter limits how many requests with invalid sessions each client can make in a window of time
+type RateLimiter interface {
+	// Limited returns how long the client has to wait before it is let through again, or 0 if it is not limited
+	Limited(ctx context.Context, clientKey string) (time.Duration, error)
+
+	// Failed records that the client made a request with an invalid session
+	Failed(ctx context.Context, clientKey string) error
+}
+
+// RemoteIP identifies clients by the IP address the request came from. It is the default way that the
+// middleware tells clients apart for rate limiting. If your app is behind a proxy, use WithClientKey instead.
+func RemoteIP(r *http.Request) string {
+	host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitClient returns how long the client has to wait if it has made too many requests with invalid sessions,
+// logging it and notifying events, or 0 if it may go on. It is 0 if limiter is nil, or if it fails, which is logged.
+func RateLimitClient(ctx context.Context, limiter RateLimiter, clientKey string, log domain.LogService, events domain.EventHandler) time.Duration {
+	if limiter == nil {
+		return 0
+	}
+
+	retryAfter, limitErr := limiter.Limited(ctx, clientKey)
+	if limitErr != nil {
+		log.WarnError(domain.RateLimiterFailed, limitErr, domain.LogFields{"client_key": clientKey})
+		return 0
+	}
+
+	if retryAfter <= 0 {
+		return 0
+	}
+
+	log.Info(domain.RequestRateLimited, domain.LogFields{"client_key": clientKey, "retry_after": retryAfter.String()})
+	events.HandleEvent(domain.Event{Type: domain.EventAuthFailed, Reason: domain.ReasonRateLimited})
+	return retryAfter
+}
+
+// CountClientFailure counts a request with an invalid session against its client, if limiter isn't nil.
+// A failing limiter is logged.
+func CountClientFailure(ctx context.Context, limiter RateLimiter, clientKey string, log domain.LogService) {
+	if limiter == nil {
+		return
+	}
+
+	failErr := limiter.Failed(ctx, clientKey)
+	if failErr != nil {
+		log.WarnError(domain.RateLimiterFailed, failErr, domain.LogFields{"client_key": clientKey})
+	}
+}
+
+// retryAfterSeconds formats a duration for the Retry-After header, rounding up
+func retryAfterSeconds(retryAfter time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+}
+
+// rateWindow counts a client's failures until resetAt
+type rateWindow struct {
+	failures int
+	resetAt  time.Time
+}
+
+// MemoryRateLimiter is a RateLimiter that counts failures in fixed windows, in memory.
+// It is only suitable for a single instance, use a shared backend like seshredis.RateLimiter otherwise.
+type MemoryRateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*rateWindow
+	lastPrune time.Time
+}
+
+// NewMemoryRateLimiter returns a MemoryRateLimiter that lets each client make limit requests with invalid
+// sessions per window. The window starts at a client's first failure.
+func NewMemoryRateLimiter(limit int, window time.Duration) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		limit:   limit,
+		window:  window,
+		now:     time.Now,
+		clients: map[string]*rateWindow{},
+	}
+}
+
+// Limited returns how long until the client's window resets if it has used up its failures
+func (l *MemoryRateLimiter) Limited(ctx context.Context, clientKey string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	client, ok := l.clients[clientKey]
+	if !ok || !now.Before(client.resetAt) || client.failures < l.limit {
+		return 0, nil
+	}
+
+	return client.resetAt.Sub(now), nil
+}
+
+// Failed counts a failure against the client, and forgets about clients whose windows have lapsed at most once a window.
+func (l *MemoryRateLimiter) Failed(ctx context.Context, clientKey string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	if now.Sub(l.lastPrune) >= l.window {
+		for key, client := range l.clients {
+			if !now.Before(client.resetAt) {
+				delete(l.clients, key)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	client, ok := l.clients[clientKey]
+	if !ok || !now.Before(client.resetAt) {
+		client = &rateWindow{resetAt: now.Add(l.window)}
+		l.clients[clientKey] = client
+	}
+	client.failures++
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package seshttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// RememberCookieName is the name of the cookie that is used to store the remember me token
+const RememberCookieName = "sesh-remember-token"
+
+func rememberCookie(token string, expirationDate time.Time, secure bool) *http.Cookie {
+	return &http.Cookie{
+		Secure:   secure,
+		Name:     RememberCookieName,
+		Value:    token,
+		HttpOnly: true,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+		// Unlike the session cookie, this one has to outlive the browser session.
+		Expires: expirationDate,
+	}
+}
+
+// encodeRememberToken signs the token with the newest key, if we have any
+func (s SessionCookieService) encodeRememberToken(token string) (string, error) {
+	if s.keys.IsEmpty() {
+		return token, nil
+	}
+
+	encoded, encodeErr := s.keys.Encode(RememberCookieName, token)
+	if encodeErr != nil {
+		return "", fmt.Errorf("Failed to sign the remember me cookie: %w", encodeErr)
+	}
+
+	return encoded, nil
+}
+
+// AddRememberTokenToResponse adds the remember me cookie to a response, expiring along with the token
+func (s SessionCookieService) AddRememberTokenToResponse(w http.ResponseWriter, token string, expirationDate time.Time) error {
+	cookieValue, encodeErr := s.encodeRememberToken(token)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	http.SetCookie(w, rememberCookie(cookieValue, expirationDate, s.secure))
+
+	return nil
+}
+
+// AddRememberTokenToRequest adds the remember me cookie to a request
+func (s SessionCookieService) AddRememberTokenToRequest(r *http.Request, token string, expirationDate time.Time) error {
+	cookieValue, encodeErr := s.encodeRememberToken(token)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	r.AddCookie(rememberCookie(cookieValue, expirationDate, s.secure))
+
+	return nil
+}
+
+// RememberTokenFromRequest reads the remember me token out of the request's remember me cookie.
+// It returns http.ErrNoCookie if there is no remember me cookie, and keyring.ErrUnknownKey if the cookie wasn't
+// signed by any of our keys. There is no need to re-issue a cookie signed by an old key, every token is replaced
+// when it is used.
+func (s SessionCookieService) RememberTokenFromRequest(r *http.Request) (string, error) {
+	cookie, cookieErr := r.Cookie(RememberCookieName)
+	if cookieErr != nil {
+		return "", cookieErr
+	}
+
+	if s.keys.IsEmpty() {
+		return cookie.Value, nil
+	}
+
+	token := ""
+	_, decodeErr := s.keys.Decode(RememberCookieName, cookie.Value, &token)
+	if decodeErr != nil {
+		return "", decodeErr
+	}
+
+	return token, nil
+}
+
+// DeleteRememberCookie removes the remember me cookie
+func DeleteRememberCookie(w http.ResponseWriter) {
+	cookie := &http.Cookie{
+		Name:     RememberCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Expires:  time.Unix(1, 0),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, cookie)
+}
+
+// remembered logs the client back in with its remember me cookie, if it has a valid one, replacing both its session
+// cookie and its remember me cookie. The remember me cookie is kept if the token was just exchanged by a concurrent
+// request, or if exchanging it failed unexpectedly. It returns false if the client has to log in again, in which case the caller
+// should respond as it would have without a remember me cookie.
+func (service SessionMiddleware) remembered(ctx context.Context, w http.ResponseWriter, r *http.Request) (domain.Session, bool) {
+	if service.remember == nil {
+		return domain.Session{}, false
+	}
+
+	token, cookieErr := service.cookie.RememberTokenFromRequest(r)
+	if cookieErr == http.ErrNoCookie {
+		return domain.Session{}, false
+	}
+	if cookieErr != nil {
+		service.log.WarnError(domain.RememberTokenInvalid, cookieErr, domain.LogFields{})
+		DeleteRememberCookie(w)
+		return domain.Session{}, false
+	}
+
+	accountID, newToken, expirationDate, exchangeErr := service.remember.Exchange(ctx, token)
+	if exchangeErr != nil {
+		switch exchangeErr {
+		case domain.ErrRememberTokenInvalid:
+			service.log.WarnError(domain.RememberTokenInvalid, exchangeErr, domain.LogFields{})
+			DeleteRememberCookie(w)
+		case domain.ErrRememberTokenStolen:
+			// The remember service has already logged and reported it, but whoever used the token first may have
+			// started a session with it.
+			revokeErr := service.session.RevokeAccountSessions(ctx, accountID)
+			if revokeErr != nil {
+				service.log.WarnError(domain.RememberTokenFailed, revokeErr, domain.LogFields{"account_id": accountID})
+			}
+			DeleteRememberCookie(w)
+		default:
+			// The token may well still be good, so keep the cookie for the next request.
+			service.log.WarnError(domain.RememberTokenFailed, exchangeErr, domain.LogFields{})
+		}
+		return domain.Session{}, false
+	}
+
+	opts := []domain.SessionOption{}
+	if service.fingerprint != nil {
+		opts = append(opts, domain.WithFingerprint(service.fingerprint.Fingerprint(r)))
+	}
+
+	sessionKey, authErr := service.session.UserWasRemembered(ctx, accountID, opts...)
+	if authErr != nil {
+		service.log.WarnError(domain.RememberTokenFailed, authErr, domain.LogFields{"account_id": accountID})
+		return domain.Session{}, false
+	}
+
+	session, sessionErr := service.session.GetSessionIfValid(ctx, sessionKey)
+	if sessionErr != nil {
+		service.log.WarnError(domain.RememberTokenFailed, sessionErr, domain.LogFields{"account_id": accountID})
+		return domain.Session{}, false
+	}
+
+	cookieErr = service.cookie.AddSessionKeyToResponse(w, session.SessionKey)
+	if cookieErr != nil {
+		service.log.WarnError(domain.RememberTokenFailed, cookieErr, domain.LogFields{"account_id": accountID})
+		return domain.Session{}, false
+	}
+
+	// A concurrent request that exchanged the same token has already handed out its new token, so there is none here.
+	if newToken != "" {
+		cookieErr = service.cookie.AddRememberTokenToResponse(w, newToken, expirationDate)
+		if cookieErr != nil {
+			// The client is logged in, it just won't be remembered the next time around.
+			service.log.WarnError(domain.RememberTokenFailed, cookieErr, domain.LogFields{"account_id": accountID})
+		}
+	}
+
+	service.log.Info(domain.RememberTokenReissued, domain.LogFields{"session_hash": domain.HashSessionKey(session.SessionKey), "account_id": accountID})
+
+	return session, true
+}
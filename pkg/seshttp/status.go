@@ -0,0 +1,75 @@
+package seshttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// headers describing when the session of a request ends
+const (
+	// ExpiresAtHeader is when the session expires unless it is used again, in RFC 3339 format
+	ExpiresAtHeader = "X-Session-Expires-At"
+	// IdleTimeoutHeader is how long the session lasts without being used, in seconds
+	IdleTimeoutHeader = "X-Session-Idle-Timeout"
+)
+
+// WithExpiryHeaders has the middleware tell clients when their session ends, in the ExpiresAtHeader and
+// IdleTimeoutHeader headers of every response, so that they can warn users before they are logged out.
+func WithExpiryHeaders() Option {
+	return func(m *SessionMiddleware) {
+		m.expiryHeaders = true
+	}
+}
+
+// setExpiryHeaders sets the headers describing when the session ends. The idle timeout is left out for sessions
+// stored without one.
+func setExpiryHeaders(w http.ResponseWriter, session domain.Session) {
+	w.Header().Set(ExpiresAtHeader, session.ExpirationDate.UTC().Format(time.RFC3339))
+	if session.IdleTimeout > 0 {
+		w.Header().Set(IdleTimeoutHeader, strconv.Itoa(int(session.IdleTimeout.Seconds())))
+	}
+}
+
+// SessionStatus is the body of a response from the StatusHandler
+type SessionStatus struct {
+	// ExpiresAt is when the session expires unless it is used again
+	ExpiresAt time.Time `json:"expires_at"`
+	// ExpiresInSeconds is how long the session has left
+	ExpiresInSeconds int `json:"expires_in_seconds"`
+	// IdleTimeoutSeconds is how long the session lasts without being used, it is 0 for sessions stored without one
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds"`
+}
+
+// StatusHandler reports how long the session of a request has left, as a SessionStatus, without extending it.
+// Clients can poll it to count down to the end of the session without keeping the session alive.
+// It must not be wrapped by Middleware, which extends the session. It responds to invalid sessions like Middleware does.
+func (service SessionMiddleware) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := service.authenticate(w, r, "sesh.SessionMiddleware.StatusHandler", service.cookie.SessionKeyFromRequest, service.session.PeekSessionIfValid, false)
+		if !ok {
+			return
+		}
+
+		status := SessionStatus{
+			ExpiresAt:          session.ExpirationDate.UTC(),
+			ExpiresInSeconds:   int(time.Until(session.ExpirationDate).Seconds()),
+			IdleTimeoutSeconds: int(session.IdleTimeout.Seconds()),
+		}
+
+		statusJSON, encodeErr := json.Marshal(status)
+		if encodeErr != nil {
+			service.log.WarnError(domain.SessionUnexpectedError, encodeErr, domain.LogFields{})
+			RespondWithStructuredError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		setExpiryHeaders(w, session)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(statusJSON)
+	})
+}
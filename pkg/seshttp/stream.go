@@ -0,0 +1,373 @@
+package seshttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// events pushed to clients by a SessionStream
+const (
+	// StreamEventExpired means that the session timed out
+	StreamEventExpired = "expired"
+	// StreamEventRevoked means that the session was ended, by logging out or on the server
+	StreamEventRevoked = "revoked"
+	// StreamEventReplaced means that the session was ended because its account logged in again
+	StreamEventReplaced = "replaced"
+	// StreamEventExpiringSoon means that the session is about to time out. Its data is a SessionStatus.
+	StreamEventExpiringSoon = "expiring_soon"
+)
+
+// defaults for a SessionStream
+const (
+	DefaultExpiryWarning   = 2 * time.Minute
+	DefaultStreamHeartbeat = 30 * time.Second
+)
+
+// SessionStream is a Server-Sent Events handler that tells clients as soon as their session ends, so that every open tab
+// can log out at once. It must be wrapped by Middleware, which puts the session in the context. Each stream pushes
+// StreamEventExpiringSoon when its session is about to time out, and one of StreamEventExpired, StreamEventRevoked or
+// StreamEventReplaced once it has ended, after which the stream is closed.
+//
+// A SessionStream learns about sessions being ended from the lifecycle events of the SessionService, so it must be
+// registered as its event handler. To hear about sessions ended by other instances, it is also a
+// domain.RevocationHandler, see dbstore.ListenForRevocations. Either way, it checks with the SessionService before
+// telling the client that its session has ended.
+//
+// Streams follow the session key they were opened with, so they need a store that keeps the same key for the life of
+// a session, unlike the stateless cookiestore.
+type SessionStream struct {
+	log       domain.LogService
+	session   domain.SessionService
+	warning   time.Duration
+	heartbeat time.Duration
+
+	mu          sync.Mutex
+	subscribers map[string]map[*streamSubscriber]struct{}
+}
+
+// streamSubscriber is an open stream, woken with the event to send if its session turns out to have ended
+type streamSubscriber struct {
+	accountID string
+	// actorAccountID is set if the session is an impersonation
+	actorAccountID string
+	wake           chan string
+}
+
+// StreamOption configures optional behavior of a SessionStream
+type StreamOption func(*SessionStream)
+
+// WithExpiryWarning sets how long before its session times out a stream pushes StreamEventExpiringSoon.
+// It defaults to DefaultExpiryWarning.
+func WithExpiryWarning(warning time.Duration) StreamOption {
+	return func(s *SessionStream) {
+		s.warning = warning
+	}
+}
+
+// WithStreamHeartbeat sets how often streams send a comment to keep proxies from closing them.
+// It defaults to DefaultStreamHeartbeat.
+func WithStreamHeartbeat(heartbeat time.Duration) StreamOption {
+	return func(s *SessionStream) {
+		s.heartbeat = heartbeat
+	}
+}
+
+// NewSessionStream returns a SessionStream that checks on sessions with the given SessionService
+func NewSessionStream(log domain.LogService, session domain.SessionService, opts ...StreamOption) *SessionStream {
+	stream := &SessionStream{
+		log:         log,
+		session:     session,
+		warning:     DefaultExpiryWarning,
+		heartbeat:   DefaultStreamHeartbeat,
+		subscribers: map[string]map[*streamSubscriber]struct{}{},
+	}
+
+	for _, opt := range opts {
+		opt(stream)
+	}
+
+	return stream
+}
+
+// subscribe registers a stream for the session
+func (s *SessionStream) subscribe(session domain.Session) (string, *streamSubscriber) {
+	sessionHash := domain.HashSessionKey(session.SessionKey)
+	subscriber := &streamSubscriber{
+		accountID:      session.AccountID,
+		actorAccountID: session.ActorAccountID,
+		// Only the first event matters, any more are dropped rather than blocking the sender.
+		wake: make(chan string, 1),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subscribers[sessionHash] == nil {
+		s.subscribers[sessionHash] = map[*streamSubscriber]struct{}{}
+	}
+	s.subscribers[sessionHash][subscriber] = struct{}{}
+
+	return sessionHash, subscriber
+}
+
+// unsubscribe forgets about a closed stream
+func (s *SessionStream) unsubscribe(sessionHash string, subscriber *streamSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers[sessionHash], subscriber)
+	if len(s.subscribers[sessionHash]) == 0 {
+		delete(s.subscribers, sessionHash)
+	}
+}
+
+// wake has the streams of the sessions that match check their session, without blocking
+func (s *SessionStream) wake(streamEvent string, matches func(sessionHash string, subscriber *streamSubscriber) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sessionHash, subscribers := range s.subscribers {
+		for subscriber := range subscribers {
+			if !matches(sessionHash, subscriber) {
+				continue
+			}
+			select {
+			case subscriber.wake <- streamEvent:
+			default:
+			}
+		}
+	}
+}
+
+// wakeSession has the streams of one session check their session, without blocking
+func (s *SessionStream) wakeSession(sessionHash string, streamEvent string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for subscriber := range s.subscribers[sessionHash] {
+		select {
+		case subscriber.wake <- streamEvent:
+		default:
+		}
+	}
+}
+
+// wakeAccount has the streams of every session of an account check their session, including its impersonations of other
+// accounts, without blocking
+func (s *SessionStream) wakeAccount(accountID string, streamEvent string) {
+	s.wake(streamEvent, func(sessionHash string, subscriber *streamSubscriber) bool {
+		return subscriber.accountID == accountID || subscriber.actorAccountID == accountID
+	})
+}
+
+// HandleEvent wakes the streams of sessions that may have just ended. Events without a SessionHash are about every
+// session of the account, as are denied accounts.
+func (s *SessionStream) HandleEvent(event domain.Event) {
+	switch event.Type {
+	case domain.EventSessionDestroyed, domain.EventImpersonationStopped:
+		if event.SessionHash == "" {
+			s.wakeAccount(event.AccountID, StreamEventRevoked)
+			return
+		}
+		s.wakeSession(event.SessionHash, StreamEventRevoked)
+	case domain.EventAccountDenied:
+		s.wakeAccount(event.AccountID, StreamEventRevoked)
+	case domain.EventSessionReplaced:
+		s.wakeSession(event.SessionHash, StreamEventReplaced)
+	case domain.EventAuthFailed:
+		if event.Reason == domain.ReasonExpired {
+			s.wakeSession(event.SessionHash, StreamEventExpired)
+		}
+	}
+}
+
+// Revoke wakes the streams of revoked sessions
+func (s *SessionStream) Revoke(revocation domain.Revocation) {
+	if revocation.SessionHash != "" {
+		s.wakeSession(revocation.SessionHash, StreamEventRevoked)
+		return
+	}
+
+	s.wakeAccount(revocation.AccountID, StreamEventRevoked)
+}
+
+// Purge wakes every stream, since any of their sessions may have been revoked
+func (s *SessionStream) Purge() {
+	s.wake(StreamEventRevoked, func(sessionHash string, subscriber *streamSubscriber) bool {
+		return true
+	})
+}
+
+// writeStreamEvent writes a single event to the stream and flushes it
+func writeStreamEvent(w http.ResponseWriter, flusher http.Flusher, streamEvent string, data interface{}) error {
+	dataJSON, encodeErr := json.Marshal(data)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	_, writeErr := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", streamEvent, dataJSON)
+	if writeErr != nil {
+		return writeErr
+	}
+
+	flusher.Flush()
+	return nil
+}
+
+// watch follows a session until it ends or ctx is done. It calls onExpiringSoon once each time the session is about to
+// time out, onHeartbeat every heartbeat, and onEnd with the event to send once the session has ended. watch returns
+// when either of the first two returns false, when the session ends, or when it fails to check on the session.
+func (s *SessionStream) watch(ctx context.Context, session domain.Session, onExpiringSoon func(status SessionStatus) bool, onHeartbeat func() bool, onEnd func(streamEvent string)) {
+	sessionHash, subscriber := s.subscribe(session)
+	defer s.unsubscribe(sessionHash, subscriber)
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
+	expiresAt := session.ExpirationDate
+	warned := false
+	for {
+		deadline := expiresAt
+		if !warned {
+			deadline = expiresAt.Add(-s.warning)
+		}
+		// Don't spin if the store disagrees with our clock about when the session ends.
+		wait := time.Until(deadline)
+		if wait < time.Second {
+			wait = time.Second
+		}
+		timer := time.NewTimer(wait)
+
+		streamEvent := ""
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-heartbeat.C:
+			timer.Stop()
+			if !onHeartbeat() {
+				return
+			}
+			continue
+		case streamEvent = <-subscriber.wake:
+			timer.Stop()
+		case <-timer.C:
+			streamEvent = StreamEventExpired
+		}
+
+		current, peekErr := s.session.PeekSessionIfValid(ctx, session.SessionKey)
+		if peekErr != nil {
+			switch peekErr {
+			case domain.ErrSessionExpired:
+				streamEvent = StreamEventExpired
+			case domain.ErrValidSessionNotFound:
+			case domain.ErrAccountDenied:
+				streamEvent = StreamEventRevoked
+			default:
+				if ctx.Err() == nil {
+					s.log.WarnError(domain.SessionStreamFailed, peekErr, domain.LogFields{"session_hash": sessionHash})
+				}
+				return
+			}
+
+			s.log.Info(domain.SessionStreamEnded, domain.LogFields{"session_hash": sessionHash, "event": streamEvent})
+			onEnd(streamEvent)
+			return
+		}
+
+		// The session is still valid, but other requests may have extended it in the meantime.
+		if !current.ExpirationDate.Equal(expiresAt) {
+			expiresAt = current.ExpirationDate
+			warned = false
+		}
+
+		if !warned && time.Until(expiresAt) <= s.warning {
+			warned = true
+			status := SessionStatus{
+				ExpiresAt:          expiresAt.UTC(),
+				ExpiresInSeconds:   int(time.Until(expiresAt).Seconds()),
+				IdleTimeoutSeconds: int(current.IdleTimeout.Seconds()),
+			}
+			if !onExpiringSoon(status) {
+				return
+			}
+		}
+	}
+}
+
+// ServeHTTP streams the session in the request's context until it ends or the client goes away, see EventStream
+func (s *SessionStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session := SessionFromRequestContext(r)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.log.WarnError(domain.SessionStreamUnsupported, fmt.Errorf("%T is not an http.Flusher", w), domain.LogFields{})
+		RespondWithStructuredError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	onExpiringSoon := func(status SessionStatus) bool {
+		return writeStreamEvent(w, flusher, StreamEventExpiringSoon, status) == nil
+	}
+	onHeartbeat := func() bool {
+		_, writeErr := fmt.Fprint(w, ": heartbeat\n\n")
+		if writeErr != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	onEnd := func(streamEvent string) {
+		writeStreamEvent(w, flusher, streamEvent, struct{}{})
+	}
+
+	s.watch(r.Context(), session, onExpiringSoon, onHeartbeat, onEnd)
+}
+
+// EventStream authenticates requests like StatusHandler, without extending their session or logging them back in with
+// a remember me cookie, and streams their session with stream. That way an open stream, or a client reconnecting to
+// it, doesn't keep its session alive. It must not be wrapped by Middleware.
+func (service SessionMiddleware) EventStream(stream *SessionStream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := service.authenticate(w, r, "sesh.SessionMiddleware.EventStream", service.cookie.SessionKeyFromRequest, service.session.PeekSessionIfValid, false)
+		if !ok {
+			return
+		}
+
+		stream.ServeHTTP(w, r.WithContext(SetSessionInRequestContext(r, session)))
+	})
+}
+
+// Watch follows a session that authenticated a long lived connection, like a WebSocket, until it ends.
+// It returns a context derived from ctx that is cancelled once the session has ended, after calling onEnd, if it isn't
+// nil, with StreamEventExpired, StreamEventRevoked or StreamEventReplaced. Call the returned CancelFunc when the
+// connection closes to stop following the session. The context is also cancelled, without calling onEnd, if the
+// session can't be checked on, so the connection doesn't outlive a session that can't be vouched for.
+// Connections outlive the request that opened them, so ctx should not be the request's context, which is cancelled
+// once the handler returns. Use context.WithoutCancel to keep its values.
+func (s *SessionStream) Watch(ctx context.Context, session domain.Session, onEnd func(streamEvent string)) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer cancel()
+		keepWatching := func() bool { return true }
+		s.watch(ctx, session, func(status SessionStatus) bool { return true }, keepWatching, func(streamEvent string) {
+			if onEnd != nil {
+				onEnd(streamEvent)
+			}
+		})
+	}()
+
+	return ctx, cancel
+}
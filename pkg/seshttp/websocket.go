@@ -0,0 +1,51 @@
+package seshttp
+
+import (
+	"net/http"
+	"strings"
+)
+
+// bearerPrefix starts an Authorization header holding a token
+const bearerPrefix = "Bearer "
+
+// SessionToken returns the value of the session cookie for a session key, for clients that can't use cookies but can
+// send it as a bearer token, see SessionKeyFromUpgradeRequest.
+func (s SessionCookieService) SessionToken(sessionKey string) (string, error) {
+	return s.encodeSessionKey(sessionKey)
+}
+
+// SessionKeyFromToken verifies a SessionToken, returning its session key. staleKey is true when the token was signed by
+// a key other than the newest.
+func (s SessionCookieService) SessionKeyFromToken(token string) (sessionKey string, staleKey bool, err error) {
+	return s.decodeSessionKey(token)
+}
+
+// SessionKeyFromUpgradeRequest reads the session key out of a request to upgrade to a WebSocket. It takes it from the
+// session cookie, which browsers send with the upgrade request, or else from an "Authorization: Bearer" header
+// holding a SessionToken, for other clients. It returns http.ErrNoCookie if the request has neither.
+func (s SessionCookieService) SessionKeyFromUpgradeRequest(r *http.Request) (sessionKey string, staleKey bool, err error) {
+	sessionKey, staleKey, err = s.SessionKeyFromRequest(r)
+	if err != http.ErrNoCookie {
+		return sessionKey, staleKey, err
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return "", false, http.ErrNoCookie
+	}
+
+	return s.SessionKeyFromToken(strings.TrimPrefix(authorization, bearerPrefix))
+}
+
+// AuthenticateUpgrade verifies the session of a request to upgrade to a WebSocket, from its cookie or bearer token, see
+// SessionKeyFromUpgradeRequest. If the session is valid it returns the request with the session in its context, like
+// Middleware does. Otherwise it responds with an error, before the upgrade, and returns false.
+// The session is only checked once, use SessionStream.Watch to close the connection when the session ends.
+func (service SessionMiddleware) AuthenticateUpgrade(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	session, ok := service.authenticate(w, r, "sesh.SessionMiddleware.AuthenticateUpgrade", service.cookie.SessionKeyFromUpgradeRequest, service.session.GetSessionIfValid, false)
+	if !ok {
+		return r, false
+	}
+
+	return r.WithContext(SetSessionInRequestContext(r, session)), true
+}
@@ -0,0 +1,169 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// maxCachedAccounts bounds the accountCache, which is emptied if it fills up with accounts that are still fresh
+const maxCachedAccounts = 10000
+
+// accountCache remembers which accounts the AccountValidator allowed, so that it isn't asked on every request
+type accountCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	allowedAt map[string]time.Time
+}
+
+func newAccountCache(ttl time.Duration) *accountCache {
+	return &accountCache{
+		ttl:       ttl,
+		allowedAt: map[string]time.Time{},
+	}
+}
+
+// allowed reports whether the account was allowed within the TTL
+func (c *accountCache) allowed(accountID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	allowedAt, ok := c.allowedAt[accountID]
+	return ok && time.Since(allowedAt) < c.ttl
+}
+
+// allow records that the account was just allowed
+func (c *accountCache) allow(accountID string) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.allowedAt) >= maxCachedAccounts {
+		for cachedID, allowedAt := range c.allowedAt {
+			if time.Since(allowedAt) >= c.ttl {
+				delete(c.allowedAt, cachedID)
+			}
+		}
+		if len(c.allowedAt) >= maxCachedAccounts {
+			c.allowedAt = map[string]time.Time{}
+		}
+	}
+
+	c.allowedAt[accountID] = time.Now()
+}
+
+// forget drops a denied account
+func (c *accountCache) forget(accountID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.allowedAt, accountID)
+}
+
+// checkAccount returns ErrAccountDenied if the AccountValidator doesn't allow the account
+func (s Service) checkAccount(ctx context.Context, accountID string) error {
+	if s.validator == nil {
+		return nil
+	}
+
+	allowed, validateErr := s.validator(ctx, accountID)
+	if validateErr != nil {
+		return validateErr
+	}
+	if !allowed {
+		return domain.ErrAccountDenied
+	}
+
+	return nil
+}
+
+// checkSessionAccounts checks the account of a valid session, and the actor's too if it is an impersonation, using
+// the cache. If either is denied, it destroys their sessions and returns ErrAccountDenied.
+func (s Service) checkSessionAccounts(ctx context.Context, sessionKey string, session domain.Session) error {
+	accountIDs := []string{session.AccountID}
+	if session.IsImpersonation() {
+		accountIDs = append(accountIDs, session.ActorAccountID)
+	}
+
+	for _, accountID := range accountIDs {
+		if s.validatedAccounts.allowed(accountID) {
+			continue
+		}
+
+		validateErr := s.checkAccount(ctx, accountID)
+		if validateErr == domain.ErrAccountDenied {
+			return s.denyAccount(ctx, accountID, sessionKey)
+		}
+		if validateErr != nil {
+			return validateErr
+		}
+
+		s.validatedAccounts.allow(accountID)
+	}
+
+	return nil
+}
+
+// denyAccount destroys the sessions of an account the AccountValidator doesn't allow, along with sessionKey if it is
+// set, and returns ErrAccountDenied, or an error if the sessions couldn't be destroyed. Sessions the store can't find are
+// still denied, since the AccountValidator is asked about them again when they are used.
+func (s Service) denyAccount(ctx context.Context, accountID string, sessionKey string) error {
+	if s.validatedAccounts != nil {
+		s.validatedAccounts.forget(accountID)
+	}
+
+	fields := domain.LogFields{"account_id": accountID}
+
+	deleteErr := s.deleteAccountSessions(ctx, accountID, sessionKey)
+	if deleteErr == domain.ErrAccountSessionsNotStored {
+		s.log.WarnError(domain.AccountSessionsNotFound, deleteErr, fields)
+	} else if deleteErr != nil {
+		return deleteErr
+	}
+
+	event := domain.Event{Type: domain.EventAccountDenied, AccountID: accountID}
+	if sessionKey != "" {
+		fields["session_hash"] = domain.HashSessionKey(sessionKey)
+		event.SessionHash = domain.HashSessionKey(sessionKey)
+	}
+	s.log.Info(domain.AccountDenied, fields)
+	s.emit(event)
+
+	return domain.ErrAccountDenied
+}
+
+// deleteAccountSessions destroys every session of an account, along with sessionKey if it is set. Stores that can't find
+// an account's sessions, like those sealed in cookies, rely on account epochs to end them, so without epochs it returns
+// ErrAccountSessionsNotStored for those.
+func (s Service) deleteAccountSessions(ctx context.Context, accountID string, sessionKey string) error {
+	deleteErr := s.store.DeleteAccountSessions(ctx, accountID)
+	notStored := deleteErr == domain.ErrAccountSessionsNotStored
+	if deleteErr != nil && !notStored {
+		return deleteErr
+	}
+
+	if sessionKey != "" {
+		deleteErr := s.store.DeleteSession(ctx, sessionKey)
+		if deleteErr != nil && deleteErr != domain.ErrValidSessionNotFound {
+			return deleteErr
+		}
+	}
+
+	// Sessions the store can't delete are ended by moving the account on.
+	if s.epochs != nil {
+		_, incrementErr := s.incrementAccountEpoch(ctx, accountID)
+		if incrementErr != nil {
+			return incrementErr
+		}
+	} else if notStored {
+		return domain.ErrAccountSessionsNotStored
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/trussworks/sesh/pkg/domain"
+)
+
+// DefaultEpochCacheTTL is how long account epochs are cached unless WithAccountEpochCache says otherwise
+const DefaultEpochCacheTTL = 5 * time.Second
+
+// cachedEpoch is an account's epoch as of fetchedAt
+type cachedEpoch struct {
+	epoch     int64
+	fetchedAt time.Time
+}
+
+// epochCache remembers the epochs of accounts, so that they aren't fetched on every request
+type epochCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	epochs map[string]cachedEpoch
+}
+
+func newEpochCache(ttl time.Duration) *epochCache {
+	return &epochCache{
+		ttl:    ttl,
+		epochs: map[string]cachedEpoch{},
+	}
+}
+
+// get returns the account's epoch if it was fetched within the TTL
+func (c *epochCache) get(accountID string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.epochs[accountID]
+	if !ok || time.Since(cached.fetchedAt) >= c.ttl {
+		return 0, false
+	}
+	return cached.epoch, true
+}
+
+// set records the account's current epoch. An epoch is never replaced by an earlier one, which a fetch that raced an
+// increment could return.
+func (c *epochCache) set(accountID string, epoch int64) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.epochs) >= maxCachedAccounts {
+		for cachedID, cached := range c.epochs {
+			if time.Since(cached.fetchedAt) >= c.ttl {
+				delete(c.epochs, cachedID)
+			}
+		}
+		if len(c.epochs) >= maxCachedAccounts {
+			c.epochs = map[string]cachedEpoch{}
+		}
+	}
+
+	if cached, ok := c.epochs[accountID]; ok && cached.epoch > epoch && time.Since(cached.fetchedAt) < c.ttl {
+		return
+	}
+	c.epochs[accountID] = cachedEpoch{epoch: epoch, fetchedAt: time.Now()}
+}
+
+// forget drops an account's epoch, so that it is fetched again
+func (c *epochCache) forget(accountID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.epochs, accountID)
+}
+
+// purge drops every epoch
+func (c *epochCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epochs = map[string]cachedEpoch{}
+}
+
+// accountEpoch returns the account's epoch, from the cache if it was fetched recently
+func (s Service) accountEpoch(ctx context.Context, accountID string) (int64, error) {
+	if epoch, ok := s.cachedEpochs.get(accountID); ok {
+		return epoch, nil
+	}
+
+	epoch, fetchErr := s.epochs.FetchAccountEpoch(ctx, accountID)
+	if fetchErr != nil {
+		return 0, fetchErr
+	}
+
+	s.cachedEpochs.set(accountID, epoch)
+	return epoch, nil
+}
+
+// incrementAccountEpoch moves the account on to a new epoch, which this instance sees right away
+func (s Service) incrementAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	epoch, incrementErr := s.epochs.IncrementAccountEpoch(ctx, accountID)
+	if incrementErr != nil {
+		s.cachedEpochs.forget(accountID)
+		return 0, incrementErr
+	}
+
+	s.cachedEpochs.set(accountID, epoch)
+	return epoch, nil
+}
+
+// Revoke drops the cached epoch of an account whose sessions were all revoked, which may be because another instance
+// invalidated its epoch. It makes the Service a domain.RevocationHandler, pass it revocations from other instances so
+// that they see InvalidateAccountEpoch right away rather than once the cached epoch expires.
+func (s Service) Revoke(revocation domain.Revocation) {
+	if revocation.SessionHash != "" {
+		return
+	}
+	s.cachedEpochs.forget(revocation.AccountID)
+}
+
+// Purge drops every cached epoch, since revocations may have been missed
+func (s Service) Purge() {
+	s.cachedEpochs.purge()
+}
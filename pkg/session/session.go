@@ -1,7 +1,7 @@
 package session
 
 import (
-	"crypto/sha512"
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"errors"
@@ -9,23 +9,104 @@ import (
 	"time"
 
 	"github.com/gorilla/securecookie"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/trussworks/sesh/internal/seshtrace"
 	"github.com/trussworks/sesh/pkg/domain"
 )
 
+// DefaultPendingTimeout is how long users have to complete their login unless WithPendingTimeout says otherwise
+const DefaultPendingTimeout = 5 * time.Minute
+
 // Service represents a SessionService internally
 type Service struct {
-	timeout time.Duration
-	store   domain.SessionStorageService
-	log     domain.LogService
+	timeout        time.Duration
+	pendingTimeout time.Duration
+	store          domain.SessionStorageService
+	log            domain.LogService
+	events         []domain.EventHandler
+	epochs         domain.AccountEpochStorageService
+	cachedEpochs   *epochCache
+	validator      domain.AccountValidator
+	// validatedAccounts is set if sessions are checked with the validator on every request
+	validatedAccounts *accountCache
+}
+
+// Option configures optional behavior of a Service
+type Option func(*Service)
+
+// WithEventHandler has the Service notify the given handler of session lifecycle events.
+// It can be passed more than once to notify several handlers.
+func WithEventHandler(handler domain.EventHandler) Option {
+	return func(s *Service) {
+		s.events = append(s.events, handler)
+	}
+}
+
+// WithPendingTimeout sets how long pending sessions last. They are never extended, so this is how long a user
+// has between the first and second step of logging in.
+func WithPendingTimeout(timeout time.Duration) Option {
+	return func(s *Service) {
+		s.pendingTimeout = timeout
+	}
+}
+
+// WithAccountEpochs stamps new sessions with their account's epoch, and rejects sessions from an earlier epoch, so that
+// InvalidateAccountEpoch can end every session of an account at once, wherever it is kept. Epochs are cached for
+// DefaultEpochCacheTTL, see WithAccountEpochCache, so that checking a session doesn't cost a round trip to epochs.
+func WithAccountEpochs(epochs domain.AccountEpochStorageService) Option {
+	return func(s *Service) {
+		s.epochs = epochs
+	}
+}
+
+// WithAccountEpochCache sets how long account epochs are cached, 0 fetches them every time a session is checked.
+// InvalidateAccountEpoch takes effect right away on the instance that calls it, and on other instances once the cached
+// epoch expires, or right away if they are passed the revocation, see Revoke.
+func WithAccountEpochCache(ttl time.Duration) Option {
+	return func(s *Service) {
+		s.cachedEpochs = newEpochCache(ttl)
+	}
+}
+
+// WithAccountValidator has the Service ask validator whether an account is allowed before creating a session for it.
+// Denied accounts have their sessions destroyed, and logging in fails with ErrAccountDenied.
+func WithAccountValidator(validator domain.AccountValidator) Option {
+	return func(s *Service) {
+		s.validator = validator
+	}
+}
+
+// WithRequestAccountValidation also has the Service ask the AccountValidator whether the account of every valid session
+// is still allowed, so that disabling an account ends its sessions right away. Accounts that were allowed aren't
+// asked about again for cacheTTL, 0 asks every time. It does nothing without WithAccountValidator.
+func WithRequestAccountValidation(cacheTTL time.Duration) Option {
+	return func(s *Service) {
+		s.validatedAccounts = newAccountCache(cacheTTL)
+	}
 }
 
 // NewSessionService returns a SessionService
-func NewSessionService(timeout time.Duration, store domain.SessionStorageService, log domain.LogService) *Service {
-	return &Service{
-		timeout,
-		store,
-		log,
+func NewSessionService(timeout time.Duration, store domain.SessionStorageService, log domain.LogService, opts ...Option) *Service {
+	service := &Service{
+		timeout:        timeout,
+		pendingTimeout: DefaultPendingTimeout,
+		cachedEpochs:   newEpochCache(DefaultEpochCacheTTL),
+		store:          store,
+		log:            log,
+	}
+
+	for _, opt := range opts {
+		opt(service)
+	}
+
+	return service
+}
+
+// emit notifies all the event handlers of an event
+func (s Service) emit(event domain.Event) {
+	for _, handler := range s.events {
+		handler.HandleEvent(event)
 	}
 }
 
@@ -42,79 +123,510 @@ func generateSessionKey() (string, error) {
 
 }
 
-func hashSessionKey(sessionKey string) string {
-	hashed := sha512.Sum512([]byte(sessionKey))
-	hexEncoded := hex.EncodeToString(hashed[:])
-	return hexEncoded[:12]
+// withActor adds the actor of an impersonation session to log fields
+func withActor(fields domain.LogFields, session domain.Session) domain.LogFields {
+	if session.IsImpersonation() {
+		fields["account_id"] = session.AccountID
+		fields["actor_account_id"] = session.ActorAccountID
+	}
+	return fields
 }
 
-// UserDidAuthenticate returns a session key and an error if applicable
-func (s Service) UserDidAuthenticate(accountID string) (string, error) {
+// idleTimeout returns the idle timeout chosen for a session, or the service's timeout if none was
+func (s Service) idleTimeout(metadata domain.SessionMetadata) time.Duration {
+	if metadata.IdleTimeout > 0 {
+		return metadata.IdleTimeout
+	}
+	return s.timeout
+}
+
+// startSession creates a session with a new key, returning it along with the session it replaced, if any.
+func (s Service) startSession(ctx context.Context, accountID string, timeout time.Duration, metadata domain.SessionMetadata) (domain.Session, *domain.Session, error) {
 	sessionKey, keyErr := generateSessionKey()
 	if keyErr != nil {
-		return "", keyErr
+		return domain.Session{}, nil, keyErr
 	}
 
-	// First, check to see if there is an extant session in the DB, expired or otherwise
-	extantSession, fetchErr := s.store.FetchPossiblyExpiredSession(accountID)
-	// Little uncommon Go logic here. First, return the error if it wasn't a Not Found error
-	if fetchErr != nil && fetchErr != sql.ErrNoRows {
-		return "", fetchErr
+	validateErr := s.checkAccount(ctx, accountID)
+	if validateErr == domain.ErrAccountDenied {
+		return domain.Session{}, nil, s.denyAccount(ctx, accountID, "")
 	}
-	// Then, if we successfully got a session back, deal with that. If we got ErrNoRows, we just want to skip this part.
-	if fetchErr == nil {
-		if extantSession.ExpirationDate.Before(time.Now().UTC()) {
-			// If the session is expired, delete it.
-			s.log.Info(fmt.Sprintf("Creating new Session: Previous session expired at %s", extantSession.ExpirationDate), domain.LogFields{"account_id": accountID})
-			delErr := s.store.DeleteSession(extantSession.SessionKey)
-			if delErr != nil {
-				s.log.WarnError("Unexpectedly failed to delete an expired session during authentication", delErr, domain.LogFields{"account_id": accountID})
-				// We will continue and attempt to create the new session here, anyway.
-			}
-		} else {
-			// If the session is valid, log that this is a concurrent login, and then delete it.
-			s.log.Info(domain.SessionConcurrentLogin, domain.LogFields{"prev_session_hash": hashSessionKey(extantSession.SessionKey)})
-			delErr := s.store.DeleteSession(extantSession.SessionKey)
-			if delErr != nil {
-				s.log.WarnError("Unexpectedly failed to delete an expired session during authentication", delErr, domain.LogFields{"account_id": accountID})
-				// We will continue and attempt to create the new session here, anyway.
-			}
+	if validateErr != nil {
+		return domain.Session{}, nil, validateErr
+	}
+
+	if s.epochs != nil {
+		// A new session must not be stamped with a stale epoch, which would end it once the cache caught up.
+		epoch, epochErr := s.epochs.FetchAccountEpoch(ctx, accountID)
+		if epochErr != nil {
+			return domain.Session{}, nil, epochErr
 		}
+		s.cachedEpochs.set(accountID, epoch)
+		metadata.Epoch = epoch
+	}
+
+	// Replace the account's extant session, expired or otherwise, in one go so that concurrent logins don't race.
+	return s.store.ReplaceSessionForAccount(ctx, accountID, sessionKey, timeout, metadata)
+}
+
+// logReplaced logs the session that a login replaced
+func (s Service) logReplaced(accountID string, replaced *domain.Session) {
+	if replaced == nil {
+		return
+	}
+
+	if replaced.ExpirationDate.Before(time.Now().UTC()) {
+		s.log.Info(fmt.Sprintf("Creating new Session: Previous session expired at %s", replaced.ExpirationDate), domain.LogFields{"account_id": accountID})
+	} else {
+		// If the session was valid, log that this is a concurrent login.
+		s.log.Info(domain.SessionConcurrentLogin, domain.LogFields{"prev_session_hash": domain.HashSessionKey(replaced.SessionKey)})
+		s.emit(domain.Event{Type: domain.EventSessionReplaced, SessionHash: domain.HashSessionKey(replaced.SessionKey), AccountID: accountID})
 	}
+}
+
+// UserDidAuthenticate returns a session key and an error if applicable
+// opts set metadata for the new session, like the fingerprint of the client that logged in, or an idle timeout other
+// than the service's. The idle timeout is stored with the session, so changing the service's timeout later doesn't
+// change it.
+func (s Service) UserDidAuthenticate(ctx context.Context, accountID string, opts ...domain.SessionOption) (string, error) {
+	// Logging in is when the user proves who they are, so the session is elevated as of now.
+	metadata := domain.NewSessionMetadata(opts...)
+	metadata.ElevatedAt = time.Now().UTC()
+	metadata.IdleTimeout = s.idleTimeout(metadata)
 
-	createErr := s.store.CreateSession(accountID, sessionKey, s.timeout)
-	if createErr != nil {
-		return "", createErr
+	session, replaced, startErr := s.startSession(ctx, accountID, metadata.IdleTimeout, metadata)
+	if startErr != nil {
+		return "", startErr
 	}
-	s.log.Info(domain.SessionCreated, domain.LogFields{"session_hash": hashSessionKey(sessionKey)})
 
-	return sessionKey, createErr
+	s.logReplaced(accountID, replaced)
+
+	s.log.Info(domain.SessionCreated, domain.LogFields{"session_hash": domain.HashSessionKey(session.SessionKey)})
+	s.emit(domain.Event{Type: domain.EventSessionCreated, SessionHash: domain.HashSessionKey(session.SessionKey), AccountID: accountID})
+
+	return session.SessionKey, nil
 }
 
-// GetSessionIfValid returns a session if the session key is valid and an error otherwise
-func (s Service) GetSessionIfValid(sessionKey string) (domain.Session, error) {
-	session, fetchErr := s.store.ExtendAndFetchSession(sessionKey, s.timeout)
+// UserWasRemembered returns the key of a session for an account that was logged back in with a remember me token.
+// The session is at the lowest authentication level and has never been elevated, so that RequireAuthLevel asks the user
+// to prove themselves before anything sensitive. It is kept alongside the account's active session, if it has one,
+// and only replaces the account's last remembered session.
+func (s Service) UserWasRemembered(ctx context.Context, accountID string, opts ...domain.SessionOption) (string, error) {
+	metadata := domain.NewSessionMetadata(opts...)
+	metadata.State = domain.SessionStateRemembered
+	metadata.AuthLevel = domain.AuthLevelPassword
+	metadata.ElevatedAt = time.Time{}
+	metadata.IdleTimeout = s.idleTimeout(metadata)
+
+	session, replaced, startErr := s.startSession(ctx, accountID, metadata.IdleTimeout, metadata)
+	if startErr != nil {
+		return "", startErr
+	}
+
+	s.logReplaced(accountID, replaced)
+
+	s.log.Info(domain.SessionRememberedCreated, domain.LogFields{"session_hash": domain.HashSessionKey(session.SessionKey)})
+	s.emit(domain.Event{Type: domain.EventSessionCreated, SessionHash: domain.HashSessionKey(session.SessionKey), AccountID: accountID})
+
+	return session.SessionKey, nil
+}
+
+// UserDidPartiallyAuthenticate returns the key of a pending session, which lasts for the pending timeout and can only
+// be used to complete the login with UserDidCompleteAuthentication. An idle timeout set by opts applies to the session
+// once the login is complete. The account's active session, if it has one, is only replaced once the login is complete.
+func (s Service) UserDidPartiallyAuthenticate(ctx context.Context, accountID string, opts ...domain.SessionOption) (string, error) {
+	metadata := domain.NewSessionMetadata(opts...)
+	metadata.State = domain.SessionStatePending
+	metadata.ElevatedAt = time.Now().UTC()
+
+	session, replaced, startErr := s.startSession(ctx, accountID, s.pendingTimeout, metadata)
+	if startErr != nil {
+		return "", startErr
+	}
+
+	s.logReplaced(accountID, replaced)
+
+	s.log.Info(domain.SessionPendingCreated, domain.LogFields{"session_hash": domain.HashSessionKey(session.SessionKey)})
+	s.emit(domain.Event{Type: domain.EventSessionPending, SessionHash: domain.HashSessionKey(session.SessionKey), AccountID: accountID})
+
+	return session.SessionKey, nil
+}
+
+// UserDidCompleteAuthentication replaces a pending session with an active session at the given level, and returns
+// the new session's key. The key is rotated so that the pending session's key is worthless once the login is complete.
+func (s Service) UserDidCompleteAuthentication(ctx context.Context, pendingSessionKey string, level domain.AuthLevel) (string, error) {
+	pending, fetchErr := s.GetPendingSessionIfValid(ctx, pendingSessionKey)
 	if fetchErr != nil {
-		if fetchErr == domain.ErrSessionExpired {
-			s.log.Info(domain.SessionExpired, domain.LogFields{"session_hash": hashSessionKey(sessionKey)})
-		} else if fetchErr == domain.ErrValidSessionNotFound {
-			s.log.Info(domain.SessionDoesNotExist, domain.LogFields{"session_hash": hashSessionKey(sessionKey)})
+		return "", fetchErr
+	}
+
+	metadata := pending.SessionMetadata
+	metadata.State = domain.SessionStateActive
+	metadata.AuthLevel = level
+	metadata.ElevatedAt = time.Now().UTC()
+	metadata.IdleTimeout = s.idleTimeout(metadata)
+
+	session, replaced, startErr := s.startSession(ctx, pending.AccountID, metadata.IdleTimeout, metadata)
+	if startErr != nil {
+		return "", startErr
+	}
+
+	s.logReplaced(pending.AccountID, replaced)
+
+	// The pending session was kept alongside the account's active session, which has just been replaced, so end it too.
+	deleteErr := s.store.DeleteSession(ctx, pendingSessionKey)
+	if deleteErr != nil && deleteErr != domain.ErrValidSessionNotFound {
+		return "", deleteErr
+	}
+
+	s.log.Info(domain.SessionPromoted, domain.LogFields{"prev_session_hash": domain.HashSessionKey(pendingSessionKey), "session_hash": domain.HashSessionKey(session.SessionKey)})
+	s.emit(domain.Event{Type: domain.EventSessionCreated, SessionHash: domain.HashSessionKey(session.SessionKey), AccountID: pending.AccountID})
+
+	return session.SessionKey, nil
+}
+
+// GetSessionIfValid returns a session if the session key is valid and an error otherwise
+func (s Service) GetSessionIfValid(ctx context.Context, sessionKey string) (session domain.Session, err error) {
+	ctx, span := seshtrace.Start(ctx, "sesh.Service.GetSessionIfValid", trace.WithAttributes(seshtrace.SessionHash(sessionKey)))
+	defer func() { seshtrace.End(span, err) }()
+
+	session, err = s.store.ExtendAndFetchSession(ctx, sessionKey, s.timeout)
+	return s.validSession(ctx, sessionKey, session, err, true)
+}
+
+// PeekSessionIfValid returns a session if the session key is valid and an error otherwise, without extending it.
+// It is for checking how long a session has left without giving it more.
+func (s Service) PeekSessionIfValid(ctx context.Context, sessionKey string) (session domain.Session, err error) {
+	ctx, span := seshtrace.Start(ctx, "sesh.Service.PeekSessionIfValid", trace.WithAttributes(seshtrace.SessionHash(sessionKey)))
+	defer func() { seshtrace.End(span, err) }()
+
+	session, err = s.store.FetchSession(ctx, sessionKey)
+	return s.validSession(ctx, sessionKey, session, err, false)
+}
+
+// checkEpoch returns ErrSessionInvalidated if the session is from an earlier epoch than its account's
+func (s Service) checkEpoch(ctx context.Context, session domain.Session) error {
+	if s.epochs == nil {
+		return nil
+	}
+
+	epoch, epochErr := s.accountEpoch(ctx, session.AccountID)
+	if epochErr != nil {
+		return epochErr
+	}
+
+	if session.Epoch < epoch {
+		return domain.ErrSessionInvalidated
+	}
+
+	// Invalidating the actor's account also ends their impersonations.
+	if session.IsImpersonation() {
+		actorEpoch, actorErr := s.accountEpoch(ctx, session.ActorAccountID)
+		if actorErr != nil {
+			return actorErr
+		}
+
+		if session.ActorEpoch < actorEpoch {
+			return domain.ErrSessionInvalidated
 		}
+	}
+	return nil
+}
 
+// actorSession returns the actor's own session of an impersonation, possibly expired, or ErrValidSessionNotFound if it
+// has been replaced or ended, or if the store couldn't find it when the impersonation started.
+func (s Service) actorSession(ctx context.Context, session domain.Session) (domain.Session, error) {
+	if session.ActorSessionHash == "" {
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	}
+
+	actor, fetchErr := s.store.FetchPossiblyExpiredSession(ctx, session.ActorAccountID)
+	if fetchErr == sql.ErrNoRows {
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	}
+	if fetchErr != nil {
 		return domain.Session{}, fetchErr
 	}
 
+	if domain.HashSessionKey(actor.SessionKey) != session.ActorSessionHash {
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	}
+
+	return actor, nil
+}
+
+// keepActorAlive extends the actor's own session of an impersonation, or only checks it if extend is false, so that it
+// is still there to go back to when the impersonation stops. If the actor's session has ended, the impersonation is
+// ended too and it returns ErrValidSessionNotFound.
+func (s Service) keepActorAlive(ctx context.Context, sessionKey string, session domain.Session, extend bool) error {
+	// Without the hash, the store can't find the actor's session, so there is nothing to keep alive.
+	if !session.IsImpersonation() || session.ActorSessionHash == "" {
+		return nil
+	}
+
+	actor, actorErr := s.actorSession(ctx, session)
+	if actorErr == nil {
+		if extend {
+			_, actorErr = s.store.ExtendAndFetchSession(ctx, actor.SessionKey, s.timeout)
+		} else {
+			_, actorErr = s.store.FetchSession(ctx, actor.SessionKey)
+		}
+	}
+	if actorErr != domain.ErrValidSessionNotFound && actorErr != domain.ErrSessionExpired {
+		return actorErr
+	}
+
+	deleteErr := s.store.DeleteSession(ctx, sessionKey)
+	if deleteErr != nil && deleteErr != domain.ErrValidSessionNotFound {
+		return deleteErr
+	}
+
+	s.log.Info(domain.ImpersonationActorEnded, withActor(domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey), "actor_session_hash": session.ActorSessionHash}, session))
+	s.emit(domain.Event{Type: domain.EventSessionDestroyed, SessionHash: domain.HashSessionKey(sessionKey), AccountID: session.AccountID, ActorAccountID: session.ActorAccountID, Reason: domain.ReasonActorEnded})
+
+	return domain.ErrValidSessionNotFound
+}
+
+// logInvalidated logs and reports a session from an earlier epoch, which is then treated as if it didn't exist
+func (s Service) logInvalidated(sessionKey string, session domain.Session) error {
+	s.log.Info(domain.SessionInvalidated, domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey), "account_id": session.AccountID})
+	s.emit(domain.Event{Type: domain.EventAuthFailed, SessionHash: domain.HashSessionKey(sessionKey), AccountID: session.AccountID, Reason: domain.ReasonInvalidated})
+	return domain.ErrValidSessionNotFound
+}
+
+// validSession turns pending sessions into ErrSessionPending, and logs and reports the sessions that aren't valid.
+// The actor's own session of an impersonation is extended along with it if extendActor is set.
+func (s Service) validSession(ctx context.Context, sessionKey string, session domain.Session, err error, extendActor bool) (domain.Session, error) {
+	if err == nil {
+		err = s.checkEpoch(ctx, session)
+		if err == domain.ErrSessionInvalidated {
+			return domain.Session{}, s.logInvalidated(sessionKey, session)
+		}
+	}
+	if err == nil {
+		err = s.keepActorAlive(ctx, sessionKey, session, extendActor)
+	}
+	if err == nil && s.validatedAccounts != nil {
+		err = s.checkSessionAccounts(ctx, sessionKey, session)
+		if err == domain.ErrAccountDenied {
+			return domain.Session{}, err
+		}
+	}
+	if err == nil && session.IsPending() {
+		err = domain.ErrSessionPending
+	}
+	if err != nil {
+		reason := domain.ReasonUnexpected
+		if err == domain.ErrSessionExpired {
+			s.log.Info(domain.SessionExpired, domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey)})
+			reason = domain.ReasonExpired
+		} else if err == domain.ErrValidSessionNotFound {
+			s.log.Info(domain.SessionDoesNotExist, domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey)})
+			reason = domain.ReasonNotFound
+		} else if err == domain.ErrSessionPending {
+			s.log.Info(domain.SessionPending, domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey)})
+			reason = domain.ReasonPending
+		}
+		s.emit(domain.Event{Type: domain.EventAuthFailed, SessionHash: domain.HashSessionKey(sessionKey), Reason: reason})
+
+		return domain.Session{}, err
+	}
+
+	return session, nil
+}
+
+// GetPendingSessionIfValid returns a pending session without extending it, and an error if it isn't valid or isn't pending.
+// With WithRequestAccountValidation, it returns ErrAccountDenied if the AccountValidator no longer allows the account.
+func (s Service) GetPendingSessionIfValid(ctx context.Context, sessionKey string) (session domain.Session, err error) {
+	ctx, span := seshtrace.Start(ctx, "sesh.Service.GetPendingSessionIfValid", trace.WithAttributes(seshtrace.SessionHash(sessionKey)))
+	defer func() { seshtrace.End(span, err) }()
+
+	session, err = s.store.FetchSession(ctx, sessionKey)
+	if err == nil {
+		err = s.checkEpoch(ctx, session)
+		if err == domain.ErrSessionInvalidated {
+			return domain.Session{}, s.logInvalidated(sessionKey, session)
+		}
+	}
+	if err == nil && !session.IsPending() {
+		err = domain.ErrValidSessionNotFound
+	}
+	if err == nil && s.validatedAccounts != nil {
+		err = s.checkSessionAccounts(ctx, sessionKey, session)
+		if err == domain.ErrAccountDenied {
+			return domain.Session{}, err
+		}
+	}
+	if err != nil {
+		reason := domain.ReasonUnexpected
+		if err == domain.ErrSessionExpired {
+			s.log.Info(domain.SessionExpired, domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey)})
+			reason = domain.ReasonExpired
+		} else if err == domain.ErrValidSessionNotFound {
+			s.log.Info(domain.SessionDoesNotExist, domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey)})
+			reason = domain.ReasonNotFound
+		}
+		s.emit(domain.Event{Type: domain.EventAuthFailed, SessionHash: domain.HashSessionKey(sessionKey), Reason: reason})
+
+		return domain.Session{}, err
+	}
+
 	return session, nil
 }
 
 // UserDidLogout attempts to end the session and returns an error on failure
-func (s Service) UserDidLogout(sessionKey string) error {
-	delErr := s.store.DeleteSession(sessionKey)
+func (s Service) UserDidLogout(ctx context.Context, sessionKey string) error {
+	// Look the session up first so that the logout of an impersonation can be tied to its actor.
+	// It is only for the logs, so failing to find it is left to DeleteSession.
+	session, _ := s.store.FetchSession(ctx, sessionKey)
+
+	delErr := s.store.DeleteSession(ctx, sessionKey)
 	if delErr != nil {
 		return delErr
 	}
 
-	s.log.Info(domain.SessionDestroyed, domain.LogFields{"session_hash": hashSessionKey(sessionKey)})
+	s.log.Info(domain.SessionDestroyed, withActor(domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey)}, session))
+	s.emit(domain.Event{Type: domain.EventSessionDestroyed, SessionHash: domain.HashSessionKey(sessionKey), AccountID: session.AccountID, ActorAccountID: session.ActorAccountID})
+
+	return nil
+}
+
+// InvalidateAccountEpoch moves the account on to a new epoch, so that every session it had is no longer valid.
+// It returns ErrAccountEpochsUnsupported unless the Service was given WithAccountEpochs.
+func (s Service) InvalidateAccountEpoch(ctx context.Context, accountID string) (err error) {
+	ctx, span := seshtrace.Start(ctx, "sesh.Service.InvalidateAccountEpoch")
+	defer func() { seshtrace.End(span, err) }()
+
+	if s.epochs == nil {
+		return domain.ErrAccountEpochsUnsupported
+	}
+
+	epoch, incrementErr := s.incrementAccountEpoch(ctx, accountID)
+	if incrementErr != nil {
+		return incrementErr
+	}
+
+	s.log.Info(domain.AccountEpochInvalidated, domain.LogFields{"account_id": accountID, "epoch": fmt.Sprint(epoch)})
+	s.emit(domain.Event{Type: domain.EventSessionDestroyed, AccountID: accountID, Reason: domain.ReasonInvalidated})
+
+	return nil
+}
+
+// RevokeAccountSessions ends every session of an account, including its impersonations of other accounts. With
+// WithAccountEpochs the account is also moved on to a new epoch, which is the only way to end sessions that the store
+// can't find, otherwise those stores return ErrAccountSessionsNotStored.
+func (s Service) RevokeAccountSessions(ctx context.Context, accountID string) (err error) {
+	ctx, span := seshtrace.Start(ctx, "sesh.Service.RevokeAccountSessions")
+	defer func() { seshtrace.End(span, err) }()
+
+	deleteErr := s.deleteAccountSessions(ctx, accountID, "")
+	if deleteErr != nil {
+		return deleteErr
+	}
+
+	s.log.Info(domain.AccountSessionsEnded, domain.LogFields{"account_id": accountID})
+	s.emit(domain.Event{Type: domain.EventSessionDestroyed, AccountID: accountID, Reason: domain.ReasonRevoked})
 
 	return nil
 }
+
+// StartImpersonation creates a session for targetAccountID that records the account of the actor's session as its
+// actor. The actor's session is left as it is, so that StopImpersonation can go back to it. The new session has the
+// actor's authentication level, as of when the actor proved it.
+func (s Service) StartImpersonation(ctx context.Context, actorSessionKey string, targetAccountID string, opts ...domain.SessionOption) (string, error) {
+	// This also turns away pending sessions with ErrSessionPending.
+	actor, fetchErr := s.PeekSessionIfValid(ctx, actorSessionKey)
+	if fetchErr != nil {
+		return "", fetchErr
+	}
+
+	if actor.IsImpersonation() {
+		return "", domain.ErrAlreadyImpersonating
+	}
+
+	metadata := domain.NewSessionMetadata(opts...)
+	metadata.AuthLevel = actor.AuthLevel
+	metadata.ElevatedAt = actor.ElevatedAt
+	metadata.ActorAccountID = actor.AccountID
+	metadata.ActorEpoch = actor.Epoch
+	// The impersonation can't outlast the actor's own session, so it doesn't last any longer without being used.
+	metadata.IdleTimeout = s.idleTimeout(metadata)
+	if actorTimeout := s.idleTimeout(actor.SessionMetadata); actorTimeout < metadata.IdleTimeout {
+		metadata.IdleTimeout = actorTimeout
+	}
+
+	// Only a hash of the actor's session is kept, to find it again with. Stores that can't find it, like the
+	// cookiestore, leave the actor to log in again once the impersonation stops.
+	own, ownErr := s.store.FetchPossiblyExpiredSession(ctx, actor.AccountID)
+	if ownErr == nil && own.SessionKey == actor.SessionKey {
+		metadata.ActorSessionHash = domain.HashSessionKey(actor.SessionKey)
+	}
+
+	session, replaced, startErr := s.startSession(ctx, targetAccountID, metadata.IdleTimeout, metadata)
+	if startErr != nil {
+		return "", startErr
+	}
+
+	// This can only have replaced the same actor's earlier impersonation of the account.
+	s.logReplaced(targetAccountID, replaced)
+
+	s.log.Info(domain.ImpersonationStarted, withActor(domain.LogFields{"session_hash": domain.HashSessionKey(session.SessionKey), "actor_session_hash": domain.HashSessionKey(actor.SessionKey)}, session))
+	s.emit(domain.Event{Type: domain.EventImpersonationStarted, SessionHash: domain.HashSessionKey(session.SessionKey), AccountID: targetAccountID, ActorAccountID: actor.AccountID})
+
+	return session.SessionKey, nil
+}
+
+// StopImpersonation ends an impersonation session and returns the key of the actor's own session, extending it.
+// It returns ErrNotImpersonating if the session isn't an impersonation, and ErrValidSessionNotFound or
+// ErrSessionExpired if the actor's session ended while the impersonation was going on, or if the store can't find it.
+func (s Service) StopImpersonation(ctx context.Context, sessionKey string) (string, error) {
+	session, fetchErr := s.store.FetchSession(ctx, sessionKey)
+	if fetchErr != nil {
+		return "", fetchErr
+	}
+
+	if !session.IsImpersonation() {
+		return "", domain.ErrNotImpersonating
+	}
+
+	deleteErr := s.store.DeleteSession(ctx, sessionKey)
+	if deleteErr != nil {
+		return "", deleteErr
+	}
+
+	s.log.Info(domain.ImpersonationStopped, withActor(domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey), "actor_session_hash": session.ActorSessionHash}, session))
+	s.emit(domain.Event{Type: domain.EventImpersonationStopped, SessionHash: domain.HashSessionKey(sessionKey), AccountID: session.AccountID, ActorAccountID: session.ActorAccountID})
+
+	actor, actorErr := s.actorSession(ctx, session)
+	if actorErr == nil {
+		actor, actorErr = s.GetSessionIfValid(ctx, actor.SessionKey)
+	}
+	if actorErr != nil {
+		return "", actorErr
+	}
+
+	return actor.SessionKey, nil
+}
+
+// Elevate sets the authentication level of a valid session and records that the user has just proven it.
+// It returns the updated session, whose key the client must be given if it changed.
+func (s Service) Elevate(ctx context.Context, sessionKey string, level domain.AuthLevel) (domain.Session, error) {
+	session, fetchErr := s.store.FetchSession(ctx, sessionKey)
+	if fetchErr != nil {
+		return domain.Session{}, fetchErr
+	}
+
+	metadata := session.SessionMetadata
+	metadata.AuthLevel = level
+	metadata.ElevatedAt = time.Now().UTC()
+
+	elevated, updateErr := s.store.UpdateSessionMetadata(ctx, sessionKey, metadata)
+	if updateErr != nil {
+		return domain.Session{}, updateErr
+	}
+
+	s.log.Info(domain.SessionElevated, withActor(domain.LogFields{"session_hash": domain.HashSessionKey(sessionKey), "auth_level": level.String()}, session))
+	s.emit(domain.Event{Type: domain.EventSessionElevated, SessionHash: domain.HashSessionKey(sessionKey), AccountID: session.AccountID, ActorAccountID: session.ActorAccountID, Reason: level.String()})
+
+	return elevated, nil
+}
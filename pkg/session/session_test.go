@@ -1,15 +1,20 @@
 package session
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/securecookie"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 
+	"github.com/trussworks/sesh/pkg/cachestore"
+	"github.com/trussworks/sesh/pkg/cookiestore"
 	"github.com/trussworks/sesh/pkg/dbstore"
 	"github.com/trussworks/sesh/pkg/domain"
 	"github.com/trussworks/sesh/pkg/mock"
@@ -38,6 +43,11 @@ func getTestStore(t *testing.T) domain.SessionStorageService {
 		return nil
 	}
 
+	migrateErr := dbstore.Migrate(context.Background(), connection)
+	if migrateErr != nil {
+		t.Fatal(migrateErr)
+	}
+
 	return dbstore.NewDBStore(connection)
 
 }
@@ -51,7 +61,7 @@ func TestAuthExists(t *testing.T) {
 	sessionLog := domain.FmtLogger(true)
 	session := NewSessionService(timeout, store, sessionLog)
 
-	session.UserDidAuthenticate("foo")
+	session.UserDidAuthenticate(context.Background(), "foo")
 }
 
 func TestLogSessionCreatedDestroyed(t *testing.T) {
@@ -65,7 +75,7 @@ func TestLogSessionCreatedDestroyed(t *testing.T) {
 
 	accountID := uuid.New().String()
 
-	sessionKey, authErr := session.UserDidAuthenticate(accountID)
+	sessionKey, authErr := session.UserDidAuthenticate(context.Background(), accountID)
 	if authErr != nil {
 		t.Fatal(authErr)
 	}
@@ -88,7 +98,7 @@ func TestLogSessionCreatedDestroyed(t *testing.T) {
 		t.Fatal("We logged the actual session key!")
 	}
 
-	delErr := session.UserDidLogout(sessionKey)
+	delErr := session.UserDidLogout(context.Background(), sessionKey)
 	if delErr != nil {
 		t.Fatal(delErr)
 	}
@@ -111,7 +121,7 @@ func TestLogSessionCreatedDestroyed(t *testing.T) {
 		t.Fatal("We logged the actual session key!")
 	}
 
-	_, getErr := session.GetSessionIfValid(sessionKey)
+	_, getErr := session.GetSessionIfValid(context.Background(), sessionKey)
 	if getErr != domain.ErrValidSessionNotFound {
 		t.Fatal(getErr)
 	}
@@ -143,7 +153,7 @@ func TestLogSessionExpired(t *testing.T) {
 
 	accountID := uuid.New().String()
 
-	sessionKey, authErr := session.UserDidAuthenticate(accountID)
+	sessionKey, authErr := session.UserDidAuthenticate(context.Background(), accountID)
 	if authErr != nil {
 		t.Fatal(authErr)
 	}
@@ -157,7 +167,7 @@ func TestLogSessionExpired(t *testing.T) {
 		t.Fatal("Wrong Log Level", logCreateMsg.Level)
 	}
 
-	_, getErr := session.GetSessionIfValid(sessionKey)
+	_, getErr := session.GetSessionIfValid(context.Background(), sessionKey)
 	if getErr != domain.ErrSessionExpired {
 		t.Fatal("didn't get the right error back getting the expired session:", getErr)
 	}
@@ -177,7 +187,7 @@ func TestLogSessionExpired(t *testing.T) {
 	}
 
 	// make sure you can re-auth after ending a session
-	_, newAuthErr := session.UserDidAuthenticate(accountID)
+	_, newAuthErr := session.UserDidAuthenticate(context.Background(), accountID)
 	if newAuthErr != nil {
 		t.Fatal(newAuthErr)
 	}
@@ -196,7 +206,7 @@ func TestLogConcurrentSession(t *testing.T) {
 
 	accountID := uuid.New().String()
 
-	_, authErr := session.UserDidAuthenticate(accountID)
+	_, authErr := session.UserDidAuthenticate(context.Background(), accountID)
 	if authErr != nil {
 		t.Fatal(authErr)
 	}
@@ -207,7 +217,7 @@ func TestLogConcurrentSession(t *testing.T) {
 	}
 
 	// Now login again:
-	_, authAgainErr := session.UserDidAuthenticate(accountID)
+	_, authAgainErr := session.UserDidAuthenticate(context.Background(), accountID)
 	if authAgainErr != nil {
 		t.Fatal(authAgainErr)
 	}
@@ -223,3 +233,500 @@ func TestLogConcurrentSession(t *testing.T) {
 	}
 
 }
+
+// memoryEpochs is an AccountEpochStorageService that keeps epochs in a map
+type memoryEpochs map[string]int64
+
+func (e memoryEpochs) FetchAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	return e[accountID], nil
+}
+
+func (e memoryEpochs) IncrementAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	e[accountID]++
+	return e[accountID], nil
+}
+
+func TestSessionsFromAnEarlierEpochAreInvalid(t *testing.T) {
+	// Sealed sessions can't be deleted, so this is the only way to end them all.
+	store := cookiestore.NewCookieStore(nil, securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	sessionLog := mock.NewLogRecorder(domain.FmtLogger(true))
+	events := []domain.Event{}
+	epochs := memoryEpochs{}
+	session := NewSessionService(time.Minute, store, &sessionLog, WithAccountEpochs(epochs),
+		WithEventHandler(domain.EventHandlerFunc(func(event domain.Event) { events = append(events, event) })))
+
+	sessionKey, authErr := session.UserDidAuthenticate(context.Background(), "alice")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+	otherKey, otherErr := session.UserDidAuthenticate(context.Background(), "bob")
+	if otherErr != nil {
+		t.Fatal(otherErr)
+	}
+
+	invalidateErr := session.InvalidateAccountEpoch(context.Background(), "alice")
+	if invalidateErr != nil {
+		t.Fatal(invalidateErr)
+	}
+
+	_, getErr := session.GetSessionIfValid(context.Background(), sessionKey)
+	if getErr != domain.ErrValidSessionNotFound {
+		t.Fatal("Sessions from an earlier epoch should not be valid", getErr)
+	}
+
+	_, logErr := sessionLog.GetOnlyMatchingMessage(domain.SessionInvalidated)
+	if logErr != nil {
+		t.Fatal(logErr)
+	}
+
+	last := events[len(events)-1]
+	if last.Type != domain.EventAuthFailed || last.Reason != domain.ReasonInvalidated || last.AccountID != "alice" {
+		t.Fatal("Should have reported the invalidated session", last)
+	}
+
+	_, otherGetErr := session.GetSessionIfValid(context.Background(), otherKey)
+	if otherGetErr != nil {
+		t.Fatal("Other accounts' sessions should still be valid", otherGetErr)
+	}
+
+	newKey, newErr := session.UserDidAuthenticate(context.Background(), "alice")
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+
+	newSession, newGetErr := session.GetSessionIfValid(context.Background(), newKey)
+	if newGetErr != nil {
+		t.Fatal("Sessions created since should be valid", newGetErr)
+	}
+	if newSession.Epoch != 1 {
+		t.Fatal("The new session should be stamped with the account's epoch", newSession.Epoch)
+	}
+
+	unsupported := NewSessionService(time.Minute, store, &sessionLog)
+	if err := unsupported.InvalidateAccountEpoch(context.Background(), "alice"); err != domain.ErrAccountEpochsUnsupported {
+		t.Fatal("Should not invalidate anything without epochs", err)
+	}
+}
+
+func TestDeniedAccountsLoseTheirSessions(t *testing.T) {
+	store := cookiestore.NewCookieStore(nil, securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	sessionLog := mock.NewLogRecorder(domain.FmtLogger(true))
+	events := []domain.Event{}
+	disabled := map[string]bool{}
+	asked := 0
+	validator := func(ctx context.Context, accountID string) (bool, error) {
+		asked++
+		return !disabled[accountID], nil
+	}
+	session := NewSessionService(time.Minute, store, &sessionLog, WithAccountEpochs(memoryEpochs{}),
+		WithAccountValidator(validator), WithRequestAccountValidation(time.Minute),
+		WithEventHandler(domain.EventHandlerFunc(func(event domain.Event) { events = append(events, event) })))
+
+	sessionKey, authErr := session.UserDidAuthenticate(context.Background(), "alice")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, getErr := session.GetSessionIfValid(context.Background(), sessionKey)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+	}
+	if asked != 2 {
+		t.Fatal("Allowed accounts should be cached between requests", asked)
+	}
+
+	disabled["alice"] = true
+	uncached := NewSessionService(time.Minute, store, &sessionLog, WithAccountEpochs(memoryEpochs{}),
+		WithAccountValidator(validator), WithRequestAccountValidation(0),
+		WithEventHandler(domain.EventHandlerFunc(func(event domain.Event) { events = append(events, event) })))
+
+	_, getErr := uncached.GetSessionIfValid(context.Background(), sessionKey)
+	if getErr != domain.ErrAccountDenied {
+		t.Fatal("Sessions of denied accounts should not be valid", getErr)
+	}
+
+	_, logErr := sessionLog.GetOnlyMatchingMessage(domain.AccountDenied)
+	if logErr != nil {
+		t.Fatal(logErr)
+	}
+
+	last := events[len(events)-1]
+	if last.Type != domain.EventAccountDenied || last.AccountID != "alice" || last.SessionHash != domain.HashSessionKey(sessionKey) {
+		t.Fatal("Should have reported the denied account", last)
+	}
+
+	// The account has moved on, so its sealed session stays invalid even if it is allowed again.
+	disabled["alice"] = false
+	_, allowedErr := uncached.GetSessionIfValid(context.Background(), sessionKey)
+	if allowedErr != domain.ErrValidSessionNotFound {
+		t.Fatal("The denied session should have been destroyed", allowedErr)
+	}
+
+	disabled["alice"] = true
+	_, loginErr := session.UserDidAuthenticate(context.Background(), "alice")
+	if loginErr != domain.ErrAccountDenied {
+		t.Fatal("Denied accounts should not be able to log in", loginErr)
+	}
+
+	// Nor finish logging in, if they were denied halfway through.
+	pendingKey, pendingErr := uncached.UserDidPartiallyAuthenticate(context.Background(), "bob")
+	if pendingErr != nil {
+		t.Fatal(pendingErr)
+	}
+
+	disabled["bob"] = true
+	_, getPendingErr := uncached.GetPendingSessionIfValid(context.Background(), pendingKey)
+	if getPendingErr != domain.ErrAccountDenied {
+		t.Fatal("Pending sessions of denied accounts should not be valid", getPendingErr)
+	}
+}
+
+// memoryStore is a SessionStorageService that keeps sessions in a map, with a clock that tests can move on
+type memoryStore struct {
+	domain.SessionStorageService
+	now      time.Time
+	sessions map[string]domain.Session
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		now:      time.Now().UTC(),
+		sessions: map[string]domain.Session{},
+	}
+}
+
+func (s *memoryStore) ReplaceSessionForAccount(ctx context.Context, accountID string, sessionKey string, expirationDuration time.Duration, metadata domain.SessionMetadata) (domain.Session, *domain.Session, error) {
+	var replaced *domain.Session
+	for extantKey, extant := range s.sessions {
+		if extant.AccountID == accountID && extant.ActorAccountID == metadata.ActorAccountID && extant.State == metadata.State {
+			replaced = &extant
+			delete(s.sessions, extantKey)
+		}
+	}
+
+	session := domain.Session{
+		AccountID:       accountID,
+		SessionKey:      sessionKey,
+		ExpirationDate:  s.now.Add(expirationDuration),
+		SessionMetadata: metadata,
+	}
+	s.sessions[sessionKey] = session
+	return session, replaced, nil
+}
+
+func (s *memoryStore) FetchPossiblyExpiredSession(ctx context.Context, accountID string) (domain.Session, error) {
+	for _, session := range s.sessions {
+		if session.AccountID == accountID && !session.IsImpersonation() && !session.IsPending() {
+			return session, nil
+		}
+	}
+	return domain.Session{}, sql.ErrNoRows
+}
+
+func (s *memoryStore) DeleteSession(ctx context.Context, sessionKey string) error {
+	if _, ok := s.sessions[sessionKey]; !ok {
+		return domain.ErrValidSessionNotFound
+	}
+	delete(s.sessions, sessionKey)
+	return nil
+}
+
+func (s *memoryStore) DeleteAccountSessions(ctx context.Context, accountID string) error {
+	for sessionKey, session := range s.sessions {
+		if session.AccountID == accountID || session.ActorAccountID == accountID {
+			delete(s.sessions, sessionKey)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) FetchSession(ctx context.Context, sessionKey string) (domain.Session, error) {
+	session, ok := s.sessions[sessionKey]
+	if !ok {
+		return domain.Session{}, domain.ErrValidSessionNotFound
+	}
+	if !session.ExpirationDate.After(s.now) {
+		return domain.Session{}, domain.ErrSessionExpired
+	}
+	return session, nil
+}
+
+func (s *memoryStore) ExtendAndFetchSession(ctx context.Context, sessionKey string, expirationDuration time.Duration) (domain.Session, error) {
+	session, fetchErr := s.FetchSession(ctx, sessionKey)
+	if fetchErr != nil {
+		return domain.Session{}, fetchErr
+	}
+
+	if session.IdleTimeout > 0 {
+		expirationDuration = session.IdleTimeout
+	}
+	session.ExpirationDate = s.now.Add(expirationDuration)
+	s.sessions[sessionKey] = session
+	return session, nil
+}
+
+func TestImpersonationKeepsTheActorsSessionAlive(t *testing.T) {
+	store := newMemoryStore()
+	sessionLog := mock.NewLogRecorder(domain.FmtLogger(true))
+	events := []domain.Event{}
+	session := NewSessionService(10*time.Minute, store, &sessionLog,
+		WithEventHandler(domain.EventHandlerFunc(func(event domain.Event) { events = append(events, event) })))
+
+	adminKey, authErr := session.UserDidAuthenticate(context.Background(), "ADMIN")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	impersonationKey, startErr := session.StartImpersonation(context.Background(), adminKey, "CUSTOMER")
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+
+	impersonation := store.sessions[impersonationKey]
+	if impersonation.ActorSessionHash != domain.HashSessionKey(adminKey) {
+		t.Fatal("Should have kept only the hash of the admin's session", impersonation.ActorSessionHash)
+	}
+
+	// Each request moves the clock on by most of the admin's timeout, which the admin's session would not survive alone.
+	for i := 0; i < 3; i++ {
+		store.now = store.now.Add(8 * time.Minute)
+		_, getErr := session.GetSessionIfValid(context.Background(), impersonationKey)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+	}
+
+	restoredKey, stopErr := session.StopImpersonation(context.Background(), impersonationKey)
+	if stopErr != nil {
+		t.Fatal("Should have restored the admin's session", stopErr)
+	}
+	if restoredKey != adminKey {
+		t.Fatal("Should have restored the admin's own session", restoredKey)
+	}
+
+	impersonationKey, startErr = session.StartImpersonation(context.Background(), adminKey, "CUSTOMER")
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+
+	logoutErr := session.UserDidLogout(context.Background(), adminKey)
+	if logoutErr != nil {
+		t.Fatal(logoutErr)
+	}
+
+	_, endedErr := session.GetSessionIfValid(context.Background(), impersonationKey)
+	if endedErr != domain.ErrValidSessionNotFound {
+		t.Fatal("The impersonation should end with the admin's session", endedErr)
+	}
+	if _, ok := store.sessions[impersonationKey]; ok {
+		t.Fatal("Should have deleted the impersonation")
+	}
+
+	_, logErr := sessionLog.GetOnlyMatchingMessage(domain.ImpersonationActorEnded)
+	if logErr != nil {
+		t.Fatal(logErr)
+	}
+
+	ended := false
+	for _, event := range events {
+		if event.Type == domain.EventSessionDestroyed && event.Reason == domain.ReasonActorEnded && event.ActorAccountID == "ADMIN" {
+			ended = true
+		}
+	}
+	if !ended {
+		t.Fatal("Should have reported the end of the impersonation", events)
+	}
+}
+
+func TestInvalidatingTheActorEndsTheirImpersonations(t *testing.T) {
+	store := newMemoryStore()
+	sessionLog := mock.NewLogRecorder(domain.FmtLogger(true))
+	session := NewSessionService(10*time.Minute, store, &sessionLog, WithAccountEpochs(memoryEpochs{}))
+
+	adminKey, authErr := session.UserDidAuthenticate(context.Background(), "ADMIN")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	impersonationKey, startErr := session.StartImpersonation(context.Background(), adminKey, "CUSTOMER")
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+
+	invalidateErr := session.InvalidateAccountEpoch(context.Background(), "ADMIN")
+	if invalidateErr != nil {
+		t.Fatal(invalidateErr)
+	}
+
+	_, getErr := session.GetSessionIfValid(context.Background(), impersonationKey)
+	if getErr != domain.ErrValidSessionNotFound {
+		t.Fatal("Invalidating the admin's account should end their impersonations", getErr)
+	}
+}
+
+func TestRevokingAnAccountEndsEverySessionThroughTheCache(t *testing.T) {
+	store := cachestore.NewCacheStore(newMemoryStore())
+	sessionLog := mock.NewLogRecorder(domain.FmtLogger(true))
+	session := NewSessionService(10*time.Minute, store, &sessionLog)
+
+	adminKey, authErr := session.UserDidAuthenticate(context.Background(), "ADMIN")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	pendingKey, pendingErr := session.UserDidPartiallyAuthenticate(context.Background(), "ADMIN")
+	if pendingErr != nil {
+		t.Fatal(pendingErr)
+	}
+
+	impersonationKey, startErr := session.StartImpersonation(context.Background(), adminKey, "CUSTOMER")
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+
+	_, getErr := session.GetSessionIfValid(context.Background(), impersonationKey)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+
+	revokeErr := session.RevokeAccountSessions(context.Background(), "ADMIN")
+	if revokeErr != nil {
+		t.Fatal(revokeErr)
+	}
+
+	for _, sessionKey := range []string{adminKey, impersonationKey} {
+		_, getErr := session.GetSessionIfValid(context.Background(), sessionKey)
+		if getErr != domain.ErrValidSessionNotFound {
+			t.Fatal("Revoking the account should end its sessions and impersonations", getErr)
+		}
+	}
+
+	_, getPendingErr := session.GetPendingSessionIfValid(context.Background(), pendingKey)
+	if getPendingErr != domain.ErrValidSessionNotFound {
+		t.Fatal("Revoking the account should end its pending sessions", getPendingErr)
+	}
+
+	// Sealed sessions can't be found, so without epochs they can't all be ended.
+	sealed := NewSessionService(10*time.Minute, cookiestore.NewCookieStore(nil, securecookie.GenerateRandomKey(32)), &sessionLog)
+	if err := sealed.RevokeAccountSessions(context.Background(), "ADMIN"); err != domain.ErrAccountSessionsNotStored {
+		t.Fatal("Should not pretend to have ended sealed sessions", err)
+	}
+}
+
+func TestRememberedSessionsAreKeptAlongsideTheActiveSession(t *testing.T) {
+	store := newMemoryStore()
+	sessionLog := mock.NewLogRecorder(domain.FmtLogger(true))
+	session := NewSessionService(10*time.Minute, store, &sessionLog, WithAccountEpochs(memoryEpochs{}))
+
+	activeKey, authErr := session.UserDidAuthenticate(context.Background(), "FOO", domain.WithAuthLevel(domain.AuthLevelMFA))
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	rememberedKey, rememberedErr := session.UserWasRemembered(context.Background(), "FOO", domain.WithAuthLevel(domain.AuthLevelMFA))
+	if rememberedErr != nil {
+		t.Fatal(rememberedErr)
+	}
+
+	_, activeErr := session.GetSessionIfValid(context.Background(), activeKey)
+	if activeErr != nil {
+		t.Fatal("Being remembered on one device should not end the session on another", activeErr)
+	}
+
+	remembered, getErr := session.GetSessionIfValid(context.Background(), rememberedKey)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if remembered.State != domain.SessionStateRemembered || remembered.AuthLevel != domain.AuthLevelPassword || !remembered.ElevatedAt.IsZero() {
+		t.Fatal("A remembered session should be at the lowest level and never have been elevated", remembered.SessionMetadata)
+	}
+
+	revokeErr := session.RevokeAccountSessions(context.Background(), "FOO")
+	if revokeErr != nil {
+		t.Fatal(revokeErr)
+	}
+
+	for _, sessionKey := range []string{activeKey, rememberedKey} {
+		_, revokedErr := session.GetSessionIfValid(context.Background(), sessionKey)
+		if revokedErr != domain.ErrValidSessionNotFound {
+			t.Fatal("Every session of the account should have been revoked", revokedErr)
+		}
+	}
+
+	_, logErr := sessionLog.GetOnlyMatchingMessage(domain.AccountSessionsEnded)
+	if logErr != nil {
+		t.Fatal(logErr)
+	}
+}
+
+// countingEpochs is a memoryEpochs that counts how often epochs are fetched
+type countingEpochs struct {
+	memoryEpochs
+	fetches int
+}
+
+func (e *countingEpochs) FetchAccountEpoch(ctx context.Context, accountID string) (int64, error) {
+	e.fetches++
+	return e.memoryEpochs.FetchAccountEpoch(ctx, accountID)
+}
+
+func TestAccountEpochsAreCached(t *testing.T) {
+	store := newMemoryStore()
+	sessionLog := mock.NewLogRecorder(domain.FmtLogger(true))
+	epochs := &countingEpochs{memoryEpochs: memoryEpochs{}}
+	session := NewSessionService(10*time.Minute, store, &sessionLog, WithAccountEpochs(epochs))
+	// otherInstance shares the store and the epochs, like another instance of the app would
+	otherInstance := NewSessionService(10*time.Minute, store, &sessionLog, WithAccountEpochs(epochs))
+
+	sessionKey, authErr := session.UserDidAuthenticate(context.Background(), "FOO")
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+
+	fetches := epochs.fetches
+	for i := 0; i < 5; i++ {
+		_, getErr := session.GetSessionIfValid(context.Background(), sessionKey)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+	}
+	if epochs.fetches != fetches {
+		t.Fatal("Should have used the cached epoch", epochs.fetches-fetches)
+	}
+
+	invalidateErr := otherInstance.InvalidateAccountEpoch(context.Background(), "FOO")
+	if invalidateErr != nil {
+		t.Fatal(invalidateErr)
+	}
+
+	_, otherErr := otherInstance.GetSessionIfValid(context.Background(), sessionKey)
+	if otherErr != domain.ErrValidSessionNotFound {
+		t.Fatal("The instance that invalidated the account should see it right away", otherErr)
+	}
+
+	session.Revoke(domain.Revocation{AccountID: "FOO"})
+
+	_, revokedErr := session.GetSessionIfValid(context.Background(), sessionKey)
+	if revokedErr != domain.ErrValidSessionNotFound {
+		t.Fatal("A revocation of the account should drop its cached epoch", revokedErr)
+	}
+
+	uncached := NewSessionService(10*time.Minute, store, &sessionLog, WithAccountEpochs(epochs), WithAccountEpochCache(0))
+	newKey, newErr := uncached.UserDidAuthenticate(context.Background(), "FOO")
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+
+	fetches = epochs.fetches
+	for i := 0; i < 3; i++ {
+		_, getErr := uncached.GetSessionIfValid(context.Background(), newKey)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+	}
+	if epochs.fetches != fetches+3 {
+		t.Fatal("Without a cache the epoch should be fetched every time", epochs.fetches-fetches)
+	}
+}
@@ -5,6 +5,8 @@ package sesh
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -12,28 +14,133 @@ import (
 
 	"github.com/trussworks/sesh/pkg/dbstore"
 	"github.com/trussworks/sesh/pkg/domain"
+	"github.com/trussworks/sesh/pkg/remember"
+	"github.com/trussworks/sesh/pkg/seshadmin"
 	"github.com/trussworks/sesh/pkg/seshttp"
 	"github.com/trussworks/sesh/pkg/session"
 )
 
 // Sessions manage browser sessions with a db table and logs all significant lifecycle events
 type Sessions struct {
-	session    domain.SessionService
-	middleware *seshttp.SessionMiddleware
-	cookie     seshttp.SessionCookieService
+	session     domain.SessionService
+	middleware  *seshttp.SessionMiddleware
+	cookie      seshttp.SessionCookieService
+	fingerprint *seshttp.FingerprintPolicy
+	remember    domain.RememberService
+	// rememberTokens are deleted along with every session of an account
+	rememberTokens domain.RememberTokenStorageService
+	stream         *seshttp.SessionStream
+	admin          *seshadmin.Handler
+	// revocations are told about sessions revoked by other instances, the store first if it caches sessions, then the
+	// session service, which caches epochs
+	revocations []domain.RevocationHandler
 }
 
 // NewSessions returns a configured Sessions, taking an existing sqlx.DB as the first argument.
-func NewSessions(db *sqlx.DB, log domain.LogService, timeout time.Duration, useSecureCookie bool) Sessions {
+func NewSessions(db *sqlx.DB, log domain.LogService, timeout time.Duration, useSecureCookie bool, opts ...Option) Sessions {
 	store := dbstore.NewDBStore(db)
-	session := session.NewSessionService(timeout, store, log)
-	middleware := seshttp.NewSessionMiddleware(log, session)
-	cookie := seshttp.NewSessionCookieService(useSecureCookie)
+	return NewSessionsWithStore(store, log, timeout, useSecureCookie, opts...)
+}
+
+// NewSessionsWithStore returns a configured Sessions that keeps sessions in the given store.
+// Use it to pick a storage mode other than the default postgres table, for instance the stateless cookiestore.
+func NewSessionsWithStore(store domain.SessionStorageService, log domain.LogService, timeout time.Duration, useSecureCookie bool, opts ...Option) Sessions {
+	config := newConfig(opts)
+
+	sessionOptions := []session.Option{}
+	middlewareOptions := []seshttp.Option{}
+	for _, handler := range config.eventHandlers {
+		sessionOptions = append(sessionOptions, session.WithEventHandler(handler))
+		middlewareOptions = append(middlewareOptions, seshttp.WithEventHandler(handler))
+	}
+
+	if config.epochs != nil {
+		sessionOptions = append(sessionOptions, session.WithAccountEpochs(config.epochs))
+	}
+	if config.cacheEpochs {
+		sessionOptions = append(sessionOptions, session.WithAccountEpochCache(config.epochCacheTTL))
+	}
+
+	if config.validator != nil {
+		sessionOptions = append(sessionOptions, session.WithAccountValidator(config.validator))
+	}
+	if config.validateRequests {
+		sessionOptions = append(sessionOptions, session.WithRequestAccountValidation(config.validationTTL))
+	}
+
+	if config.pendingTimeout != 0 {
+		sessionOptions = append(sessionOptions, session.WithPendingTimeout(config.pendingTimeout))
+	}
+
+	if config.rateLimiter != nil {
+		middlewareOptions = append(middlewareOptions, seshttp.WithRateLimiter(config.rateLimiter))
+	}
+	if config.clientKey != nil {
+		middlewareOptions = append(middlewareOptions, seshttp.WithClientKey(config.clientKey))
+	}
+	if config.fingerprint != nil {
+		middlewareOptions = append(middlewareOptions, seshttp.WithFingerprintPolicy(*config.fingerprint))
+	}
+	if config.expiryHeaders {
+		middlewareOptions = append(middlewareOptions, seshttp.WithExpiryHeaders())
+	}
+
+	var rememberService domain.RememberService
+	if config.rememberTokens != nil {
+		rememberOptions := []remember.Option{}
+		for _, handler := range config.eventHandlers {
+			rememberOptions = append(rememberOptions, remember.WithEventHandler(handler))
+		}
+		rememberService = remember.NewRememberService(config.rememberDuration, config.rememberTokens, log, rememberOptions...)
+		middlewareOptions = append(middlewareOptions, seshttp.WithRememberService(rememberService))
+	}
+
+	// The stream needs the session service, which needs to send the stream its events.
+	var stream *seshttp.SessionStream
+	sessionOptions = append(sessionOptions, session.WithEventHandler(domain.EventHandlerFunc(func(event domain.Event) {
+		stream.HandleEvent(event)
+	})))
+
+	streamOptions := []seshttp.StreamOption{}
+	if config.expiryWarning != 0 {
+		streamOptions = append(streamOptions, seshttp.WithExpiryWarning(config.expiryWarning))
+	}
+
+	session := session.NewSessionService(timeout, store, log, sessionOptions...)
+	stream = seshttp.NewSessionStream(log, session, streamOptions...)
+
+	revocations := []domain.RevocationHandler{}
+	if cache, ok := store.(domain.RevocationHandler); ok {
+		revocations = append(revocations, cache)
+	}
+	// The session service drops the cached epochs of revoked accounts before the stream checks on their sessions.
+	revocations = append(revocations, session, stream)
+
+	adminOptions := []seshadmin.Option{}
+	for _, handler := range config.eventHandlers {
+		adminOptions = append(adminOptions, seshadmin.WithEventHandler(handler))
+	}
+	for _, handler := range revocations {
+		adminOptions = append(adminOptions, seshadmin.WithRevocationHandler(handler))
+	}
+	if config.rememberTokens != nil {
+		adminOptions = append(adminOptions, seshadmin.WithRememberTokens(config.rememberTokens))
+	}
+	admin := seshadmin.NewHandler(log, config.adminStore, config.adminAuthorizer, adminOptions...)
+
+	cookie := seshttp.NewSessionCookieService(useSecureCookie, config.cookieKeys...)
+	middleware := seshttp.NewSessionMiddleware(log, session, cookie, middlewareOptions...)
 
 	return Sessions{
 		session,
 		middleware,
 		cookie,
+		config.fingerprint,
+		rememberService,
+		config.rememberTokens,
+		stream,
+		admin,
+		revocations,
 	}
 }
 
@@ -43,43 +150,331 @@ type Session struct {
 	AccountID      string
 	SessionKey     string
 	ExpirationDate time.Time
+	// AuthLevel is how strongly the user has proven who they are, see Sessions.Elevate
+	AuthLevel domain.AuthLevel
+	// ElevatedAt is when the user last proved it, at login or when the session was elevated
+	ElevatedAt time.Time
+	// ActorAccountID is the account that is really using the session if it is impersonating AccountID, see
+	// Sessions.StartImpersonation. It is empty otherwise.
+	ActorAccountID string
+	// IdleTimeout is how long the session lasts without being used, see domain.WithIdleTimeout
+	IdleTimeout time.Duration
 }
 
 // UserDidAuthenticate creates a new session and writes an HTTPOnly cookie to track that session
+// opts set metadata for the session, like domain.WithIdleTimeout to give it a timeout of its own.
+// It isn't bound to a fingerprint, use UserDidAuthenticateContext for that.
+// it returns errors
+func (s Sessions) UserDidAuthenticate(w http.ResponseWriter, accountID string, opts ...domain.SessionOption) (sessionKey string, err error) {
+	return s.userDidAuthenticate(context.Background(), w, accountID, opts)
+}
+
+// UserDidAuthenticateContext is UserDidAuthenticate for the login request r. The session store calls use r's context,
+// so they are traced and cancelled along with the request, and the session is bound to the client making r if
+// sessions are bound to a fingerprint, see WithFingerprintPolicy.
+// it returns errors
+func (s Sessions) UserDidAuthenticateContext(w http.ResponseWriter, r *http.Request, accountID string, opts ...domain.SessionOption) (sessionKey string, err error) {
+	return s.userDidAuthenticate(r.Context(), w, accountID, append(s.sessionOptions(r), opts...))
+}
+
+func (s Sessions) userDidAuthenticate(ctx context.Context, w http.ResponseWriter, accountID string, opts []domain.SessionOption) (string, error) {
+	sessionKey, authErr := s.session.UserDidAuthenticate(ctx, accountID, opts...)
+	if authErr != nil {
+		return "", authErr
+	}
+
+	cookieErr := s.writeSessionKey(ctx, w, sessionKey)
+	if cookieErr != nil {
+		return "", cookieErr
+	}
+
+	return sessionKey, nil
+}
+
+// writeSessionKey writes a newly created, elevated or restored session to the session cookie. If it can't, it ends the
+// session, so that a session nobody can use, like an impersonation, isn't left behind.
+func (s Sessions) writeSessionKey(ctx context.Context, w http.ResponseWriter, sessionKey string) error {
+	cookieErr := s.cookie.AddSessionKeyToResponse(w, sessionKey)
+	if cookieErr != nil {
+		logoutErr := s.session.UserDidLogout(ctx, sessionKey)
+		if logoutErr != nil {
+			return fmt.Errorf("Failed to end the session after failing to write its cookie (%s): %w", cookieErr, logoutErr)
+		}
+		return cookieErr
+	}
+
+	return nil
+}
+
+// UserDidPartiallyAuthenticate creates a pending session for a user that has completed the first step of logging in,
+// like entering their password, and writes it to the session cookie. Pending sessions are rejected by the
+// AuthenticationMiddleware, they are only accepted by handlers behind RequirePending.
+// opts set metadata for the session once the login is complete, like UserDidAuthenticate's.
 // it returns errors
-func (s Sessions) UserDidAuthenticate(w http.ResponseWriter, accountID string) (sessionKey string, err error) {
-	sessionKey, authErr := s.session.UserDidAuthenticate(accountID)
+func (s Sessions) UserDidPartiallyAuthenticate(w http.ResponseWriter, r *http.Request, accountID string, opts ...domain.SessionOption) (sessionKey string, err error) {
+	sessionKey, authErr := s.session.UserDidPartiallyAuthenticate(r.Context(), accountID, append(s.sessionOptions(r), opts...)...)
 	if authErr != nil {
 		return "", authErr
 	}
 
-	s.cookie.AddSessionKeyToResponse(w, sessionKey)
+	cookieErr := s.writeSessionKey(r.Context(), w, sessionKey)
+	if cookieErr != nil {
+		return "", cookieErr
+	}
+
+	return sessionKey, nil
+}
+
+// UserDidCompleteAuthentication promotes the pending session to a full session at the given level once the user has
+// completed logging in, and writes its new key to the session cookie. r must have passed through RequirePending.
+// it returns errors
+func (s Sessions) UserDidCompleteAuthentication(w http.ResponseWriter, r *http.Request, level domain.AuthLevel) (sessionKey string, err error) {
+	pending := seshttp.SessionFromRequestContext(r)
+
+	sessionKey, completeErr := s.session.UserDidCompleteAuthentication(r.Context(), pending.SessionKey, level)
+	if completeErr != nil {
+		return "", completeErr
+	}
+
+	cookieErr := s.writeSessionKey(r.Context(), w, sessionKey)
+	if cookieErr != nil {
+		return "", cookieErr
+	}
 
 	return sessionKey, nil
 }
 
-// UserDidLogout destroys the session and removes the session cookie.
+// sessionOptions returns the metadata to record with a session created by the login request r
+func (s Sessions) sessionOptions(r *http.Request) []domain.SessionOption {
+	opts := []domain.SessionOption{}
+	if s.fingerprint != nil {
+		opts = append(opts, domain.WithFingerprint(s.fingerprint.Fingerprint(r)))
+	}
+	return opts
+}
+
+// UserDidLogout destroys the session and removes the session cookie, along with the remember me token if there is one.
 // it returns errors
 func (s Sessions) UserDidLogout(w http.ResponseWriter, r *http.Request) error {
 	session := seshttp.SessionFromRequestContext(r)
 
-	logoutErr := s.session.UserDidLogout(session.SessionKey)
+	logoutErr := s.session.UserDidLogout(r.Context(), session.SessionKey)
 	if logoutErr != nil {
 		return logoutErr
 	}
 
 	seshttp.DeleteSessionCookie(w)
 
+	if s.remember != nil {
+		token, cookieErr := s.cookie.RememberTokenFromRequest(r)
+		if cookieErr == nil {
+			forgetErr := s.remember.Forget(r.Context(), token)
+			if forgetErr != nil {
+				return forgetErr
+			}
+		}
+		seshttp.DeleteRememberCookie(w)
+	}
+
+	return nil
+}
+
+// RememberAccount issues a remember me token for the account and writes it to a persistent cookie, so that the user is
+// logged back in once their session ends, even after they close their browser. Call it along with UserDidAuthenticate
+// when the user has asked to be remembered. It needs the WithRememberMe option.
+// it returns errors
+func (s Sessions) RememberAccount(w http.ResponseWriter, r *http.Request, accountID string) error {
+	if s.remember == nil {
+		return errors.New("Remember me is not enabled, see WithRememberMe")
+	}
+
+	token, expirationDate, rememberErr := s.remember.Remember(r.Context(), accountID)
+	if rememberErr != nil {
+		return rememberErr
+	}
+
+	return s.cookie.AddRememberTokenToResponse(w, token, expirationDate)
+}
+
+// Elevate records that the user has just proven who they are at the given level, for instance by entering a one time
+// code, and writes the session cookie again if the session key changed. r must have passed through the
+// AuthenticationMiddleware. Sessions start at domain.AuthLevelPassword unless domain.WithAuthLevel says otherwise.
+// it returns errors
+func (s Sessions) Elevate(w http.ResponseWriter, r *http.Request, level domain.AuthLevel) error {
+	session := seshttp.SessionFromRequestContext(r)
+
+	elevated, elevateErr := s.session.Elevate(r.Context(), session.SessionKey, level)
+	if elevateErr != nil {
+		return elevateErr
+	}
+
+	if elevated.SessionKey != session.SessionKey {
+		return s.writeSessionKey(r.Context(), w, elevated.SessionKey)
+	}
+
 	return nil
 }
 
+// RequireAuthLevel returns middleware for sensitive routes that must be wrapped by the AuthenticationMiddleware.
+// It only lets a request through if its session was elevated to at least the given level within maxAge, or at any time
+// if maxAge is 0. Otherwise it responds with 403 Forbidden and the error code "step_up_required".
+func (s Sessions) RequireAuthLevel(level domain.AuthLevel, maxAge time.Duration) func(http.Handler) http.Handler {
+	return s.middleware.RequireAuthLevel(level, maxAge)
+}
+
+// StartImpersonation lets the user of the current session use the app as targetAccountID, by writing a session for
+// targetAccountID to the session cookie. The new session records the user's own account as its ActorAccountID, and
+// every lifecycle event of the session is logged with both. r must have passed through the AuthenticationMiddleware.
+// It is up to you to check that the user is allowed to impersonate anyone before calling it.
+// it returns errors
+func (s Sessions) StartImpersonation(w http.ResponseWriter, r *http.Request, targetAccountID string) error {
+	actor := seshttp.SessionFromRequestContext(r)
+
+	sessionKey, startErr := s.session.StartImpersonation(r.Context(), actor.SessionKey, targetAccountID, s.sessionOptions(r)...)
+	if startErr != nil {
+		return startErr
+	}
+
+	return s.writeSessionKey(r.Context(), w, sessionKey)
+}
+
+// StopImpersonation ends the impersonation session of the current request and writes the actor's own session back to
+// the session cookie. r must have passed through the AuthenticationMiddleware. If the actor's session ended while
+// they were impersonating someone, or the store can't find it, like the stateless cookiestore, the cookie is removed
+// and the error is returned, so they have to log in again. They also have to if the cookie can't be written, since the
+// actor's session is ended then.
+// it returns errors
+func (s Sessions) StopImpersonation(w http.ResponseWriter, r *http.Request) error {
+	session := seshttp.SessionFromRequestContext(r)
+
+	actorSessionKey, stopErr := s.session.StopImpersonation(r.Context(), session.SessionKey)
+	if stopErr != nil {
+		if stopErr == domain.ErrValidSessionNotFound || stopErr == domain.ErrSessionExpired {
+			seshttp.DeleteSessionCookie(w)
+		}
+		return stopErr
+	}
+
+	return s.writeSessionKey(r.Context(), w, actorSessionKey)
+}
+
+// RequirePending is middleware for the handler that completes a login, like the one that checks a one time code.
+// It only accepts pending sessions, see UserDidPartiallyAuthenticate, and stores the session in the context.
+func (s Sessions) RequirePending() func(http.Handler) http.Handler {
+	return s.middleware.RequirePending
+}
+
 // AuthenticationMiddleware reads the session cookie and verifies that the request is being made by someone with a valid session
 // It then stores the current session in the context, which can be retrieved with SessionFromContext(ctx)
 // If the session is invalid it responds with an error and does not call any further handlers.
+// Pending sessions are rejected with 401 Unauthorized and the error code "login_incomplete".
 func (s Sessions) AuthenticationMiddleware() func(http.Handler) http.Handler {
 	return s.middleware.Middleware
 }
 
+// StatusHandler reports how long the session of a request has left without extending it, so that clients can warn
+// users that they are about to be logged out. It responds with JSON like
+//
+//	{"expires_at": "2020-01-01T12:05:00Z", "expires_in_seconds": 300, "idle_timeout_seconds": 900}
+//
+// and sets the same headers as WithExpiryHeaders. Mount it outside of the AuthenticationMiddleware, which would extend
+// the session. Requests without a valid session get the same errors as the AuthenticationMiddleware gives.
+func (s Sessions) StatusHandler() http.Handler {
+	return s.middleware.StatusHandler()
+}
+
+// EventStreamHandler is a Server-Sent Events endpoint that tells clients as soon as their session ends, so that every
+// open tab can log out at once. It authenticates requests like the StatusHandler, without extending their session or
+// logging them back in with a remember me cookie, so mount it on its own, outside of the AuthenticationMiddleware:
+//
+//	mux.Handle("/session/events", sessions.EventStreamHandler())
+//
+// It pushes "expiring_soon" when the session is about to time out, then one of "expired", "revoked" or "replaced" when
+// it has ended and closes the stream. It needs a store that keeps sessions, not the stateless cookiestore.
+func (s Sessions) EventStreamHandler() http.Handler {
+	return s.middleware.EventStream(s.stream)
+}
+
+// AuthenticateWebSocket verifies the session of a request to upgrade to a WebSocket, from the session cookie or from an
+// "Authorization: Bearer" header holding the cookie's value, see seshttp.SessionCookieService.SessionToken.
+// If the session is valid it returns the request to upgrade, with the session in its context, and true. The context is
+// not cancelled when the handler returns, so it can be handed on to whatever serves the connection. It is cancelled
+// once the session ends, after calling onEnd, if it isn't nil, with "expired", "revoked" or "replaced", so
+// the connection can be closed. Call the returned CancelFunc once the connection closes.
+// If the session isn't valid it responds with an error and returns false, in which case don't upgrade.
+// Like EventStreamHandler, it needs a store that keeps sessions.
+func (s Sessions) AuthenticateWebSocket(w http.ResponseWriter, r *http.Request, onEnd func(reason string)) (*http.Request, context.CancelFunc, bool) {
+	r, ok := s.middleware.AuthenticateUpgrade(w, r)
+	if !ok {
+		return r, func() {}, false
+	}
+
+	// The connection outlives the handler, and the request's context is cancelled as soon as the handler returns, so
+	// keep its values but not its cancellation.
+	ctx, cancel := s.stream.Watch(context.WithoutCancel(r.Context()), seshttp.SessionFromRequestContext(r), onEnd)
+	return r.WithContext(ctx), cancel, true
+}
+
+// AdminHandler is a JSON API to list, inspect and revoke sessions, and count them, see seshadmin.Handler for its
+// endpoints. It turns away every request unless it was set up with WithAdmin, whose authorizer decides who may use it.
+// Put it behind the AuthenticationMiddleware so the authorizer can check the admin's session:
+//
+//	mux.Handle("/admin/sessions/", http.StripPrefix("/admin/sessions", sessions.AuthenticationMiddleware()(sessions.AdminHandler())))
+func (s Sessions) AdminHandler() http.Handler {
+	return s.admin
+}
+
+// InvalidateAccountEpoch ends every session of an account at once, wherever it is: in the database, sealed in a cookie,
+// or cached. It moves the account on to a new epoch, so it needs WithAccountEpochs, and deletes the account's remember
+// me tokens so that they can't start new sessions. Sessions created afterwards are valid as usual.
+// it returns errors
+func (s Sessions) InvalidateAccountEpoch(ctx context.Context, accountID string) error {
+	invalidateErr := s.session.InvalidateAccountEpoch(ctx, accountID)
+	if invalidateErr != nil {
+		return invalidateErr
+	}
+
+	if s.rememberTokens != nil {
+		forgetErr := s.rememberTokens.DeleteAccountRememberTokens(ctx, accountID)
+		if forgetErr != nil {
+			return forgetErr
+		}
+	}
+
+	// The sessions are already invalid, this lets go of them sooner.
+	s.Revoke(domain.Revocation{AccountID: accountID})
+	return nil
+}
+
+// Revoke tells the store, if it is a cache like cachestore.CacheStore, the session service, which caches account epochs,
+// and then the EventStreamHandler about sessions revoked by other instances. It makes Sessions a domain.RevocationHandler that can be passed to
+// dbstore.ListenForRevocations in place of the store.
+func (s Sessions) Revoke(revocation domain.Revocation) {
+	for _, handler := range s.revocations {
+		handler.Revoke(revocation)
+	}
+}
+
+// Purge empties the store, if it is a cache, drops every cached account epoch, and has the EventStreamHandler check on
+// every session it is streaming, since any of them may have been revoked.
+func (s Sessions) Purge() {
+	for _, handler := range s.revocations {
+		handler.Purge()
+	}
+}
+
+// SessionService returns the service that Sessions uses to manage sessions, for plugging sesh into other transports,
+// like seshgrpc.NewInterceptor
+func (s Sessions) SessionService() domain.SessionService {
+	return s.session
+}
+
+// CookieService returns the service that Sessions uses to read and write session cookies, with the keys from
+// WithCookieKeys
+func (s Sessions) CookieService() seshttp.SessionCookieService {
+	return s.cookie
+}
+
 // SessionFromContext pulls the current sesh.Session object out of the context
 // This function is all that is required in your handlers to get the current session information
 func SessionFromContext(ctx context.Context) Session {
@@ -88,6 +483,10 @@ func SessionFromContext(ctx context.Context) Session {
 		AccountID:      domainSession.AccountID,
 		SessionKey:     domainSession.SessionKey,
 		ExpirationDate: domainSession.ExpirationDate,
+		AuthLevel:      domainSession.AuthLevel,
+		ElevatedAt:     domainSession.ElevatedAt,
+		ActorAccountID: domainSession.ActorAccountID,
+		IdleTimeout:    domainSession.IdleTimeout,
 	}
 	return session
 }
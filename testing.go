@@ -17,6 +17,12 @@ func ContextWithTestSession(ctx context.Context, session Session) context.Contex
 		AccountID:      session.AccountID,
 		SessionKey:     session.SessionKey,
 		ExpirationDate: session.ExpirationDate,
+		SessionMetadata: domain.SessionMetadata{
+			AuthLevel:      session.AuthLevel,
+			ElevatedAt:     session.ElevatedAt,
+			ActorAccountID: session.ActorAccountID,
+			IdleTimeout:    session.IdleTimeout,
+		},
 	}
 
 	return seshttp.SetSessionInContext(ctx, domainSession)
@@ -24,14 +30,12 @@ func ContextWithTestSession(ctx context.Context, session Session) context.Contex
 
 // AuthenticateUserAndAddToTestRequest is not used in the operation of sesh. It is intended to
 // be used in your tests to create a valid session for a request, alleviating you from having to make a login request
-// as part of the test.
+// as part of the test. If sessions are bound to a fingerprint, the session is bound to the client making r.
 func (s Sessions) AuthenticateUserAndAddToTestRequest(r *http.Request, accountID string) error {
-	sessionKey, authErr := s.session.UserDidAuthenticate(accountID)
+	sessionKey, authErr := s.session.UserDidAuthenticate(r.Context(), accountID, s.sessionOptions(r)...)
 	if authErr != nil {
 		return authErr
 	}
 
-	s.cookie.AddSessionKeyToRequest(r, sessionKey)
-
-	return nil
+	return s.cookie.AddSessionKeyToRequest(r, sessionKey)
 }